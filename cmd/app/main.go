@@ -12,10 +12,16 @@ import (
 
 	"authSAS/internal/app"
 	"authSAS/internal/config"
+	"authSAS/internal/models"
 	"authSAS/internal/services"
 	"authSAS/internal/storages/mockups"
 	"authSAS/internal/storages/postgres"
 	redisStorage "authSAS/internal/storages/redis"
+	emailsender "authSAS/internal/utils/emailSender"
+	utils_hash "authSAS/internal/utils/hash"
+	utils_jwt "authSAS/internal/utils/jwt"
+	smssender "authSAS/internal/utils/smsSender"
+	webhooksender "authSAS/internal/utils/webhookSender"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
@@ -48,7 +54,10 @@ func main() {
 		defer client.Close()
 	}
 	
-	application := app.NewApp(logger, cfg, permanentStorage, temporaryStorage)
+	codeDeliverer := initCodeDeliverer(logger, cfg)
+	securityNotifier := initSecurityNotifier(logger, cfg)
+
+	application := app.NewApp(logger, cfg, mustLoadKeyRing(cfg), codeDeliverer, securityNotifier, permanentStorage, temporaryStorage)
 
 	logger.Info("Application initialized", "op_time", time.Since(startApp).Milliseconds())
 
@@ -135,7 +144,7 @@ func initTemporaryStorage(logger *slog.Logger, cfg *config.Config) (*redis.Clien
 			panic(`redis init error:`)
 		}
 		client := redis.NewClient(opt)
-		temporaryStorage = redisStorage.NewStorage(client, cfg.TempStorage.CodeTTL)
+		temporaryStorage = redisStorage.NewStorage(client, cfg.TempStorage.CodeTTL, mustLoadCodeHMACKey(cfg))
 
 	case productionMode:
 		opt, err := redis.ParseURL(cfg.TempStorage.TempStoragePath)
@@ -143,11 +152,75 @@ func initTemporaryStorage(logger *slog.Logger, cfg *config.Config) (*redis.Clien
 			panic(`redis init error:`)
 		}
 		client := redis.NewClient(opt)
-		temporaryStorage = redisStorage.NewStorage(client, cfg.TempStorage.CodeTTL)
+		temporaryStorage = redisStorage.NewStorage(client, cfg.TempStorage.CodeTTL, mustLoadCodeHMACKey(cfg))
 	}
 
 
 	logger.Info("Temporary DB initialized", "op_time", time.Since(start).Milliseconds())
 
 	return client, temporaryStorage
-}
\ No newline at end of file
+}
+
+func initCodeDeliverer(logger *slog.Logger, cfg *config.Config) services.CodeDeliverer {
+	switch cfg.AppMode {
+	case testMode, localMode:
+		return mockups.NewCodeDelivererMokup()
+	}
+
+	channels := map[models.DeliveryChannel]services.CodeDeliverer{
+		models.DeliveryChannelEmail: emailsender.NewEmailSender(logger, cfg.EmailSender.Email, cfg.EmailSender.Password),
+	}
+
+	if cfg.CodeDelivery.SMS.URL != "" {
+		channels[models.DeliveryChannelSMS] = smssender.NewSMSSender(logger, cfg.CodeDelivery.SMS.URL, cfg.CodeDelivery.SMS.Token, cfg.CodeDelivery.SMS.From, cfg.CodeDelivery.Timeout)
+	}
+
+	if cfg.CodeDelivery.Webhook.URL != "" {
+		channels[models.DeliveryChannelWebhook] = webhooksender.NewWebhookSender(logger, cfg.CodeDelivery.Webhook.URL, cfg.CodeDelivery.Webhook.Secret, cfg.CodeDelivery.Timeout)
+	}
+
+	logger.Info("Code delivery initialized", "channels", len(channels))
+
+	return services.NewChannelRouter(logger, channels)
+}
+
+func initSecurityNotifier(logger *slog.Logger, cfg *config.Config) services.SecurityNotifier {
+	switch cfg.AppMode {
+	case testMode, localMode:
+		return mockups.NewCodeDelivererMokup()
+	}
+
+	return emailsender.NewEmailSender(logger, cfg.EmailSender.Email, cfg.EmailSender.Password)
+}
+
+func mustLoadCodeHMACKey(cfg *config.Config) []byte {
+	key, err := utils_hash.DecodeHMACKey(cfg.TempStorage.CodeHMACKey)
+	if err != nil {
+		panic("code hmac key init error: " + err.Error())
+	}
+
+	return key
+}
+
+func mustLoadKeyRing(cfg *config.Config) *utils_jwt.KeyRing {
+	keyRing, err := utils_jwt.LoadKeyRing(cfg.JWTKeys.ActiveKid, keySpecs(cfg.JWTKeys), cfg.JWTSecret)
+	if err != nil {
+		panic("jwt key ring init error: " + err.Error())
+	}
+
+	return keyRing
+}
+
+func keySpecs(keysConfig config.JWTKeysConfig) []utils_jwt.KeySpec {
+	specs := make([]utils_jwt.KeySpec, 0, len(keysConfig.Keys))
+	for _, key := range keysConfig.Keys {
+		specs = append(specs, utils_jwt.KeySpec{
+			Kid: key.Kid,
+			Algorithm: key.Algorithm,
+			PrivateKeyPath: key.PrivateKeyPath,
+			Secret: key.Secret,
+		})
+	}
+
+	return specs
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"authSAS/internal/config"
+	utils_jwt "authSAS/internal/utils/jwt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Operator tool for jwt signing keys rotation:
+//
+//	1. go run ./cmd/keys generate -alg ES256 -out ./keys/new.pem
+//	2. add the key to jwt_keys.keys, restart instances and wait until verifiers refresh JWKS
+//	3. go run ./cmd/keys promote -config ./config/config.yaml -kid new
+//	4. restart instances, the old key keeps verifying its tokens until they expire
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Args[2:])
+	case "promote":
+		err = promote(os.Args[2:])
+	case "list":
+		err = list(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keys generate -alg RS256|ES256|EdDSA -out key.pem")
+	fmt.Fprintln(os.Stderr, "       keys promote -config config.yaml -kid <kid>")
+	fmt.Fprintln(os.Stderr, "       keys list -config config.yaml")
+}
+
+func generate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	alg := flags.String("alg", "ES256", "Key algorithm: RS256, ES256, EdDSA")
+	out := flags.String("out", "", "Path of the PEM private key file")
+	flags.Parse(args)
+
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	var private any
+	var err error
+
+	switch *alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("%w: %s", utils_jwt.ErrUnsupportedAlgorithm, *alg)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(*out, pemData, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s key written to %s\n", *alg, *out)
+
+	return nil
+}
+
+func promote(args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	path := flags.String("config", "", "Path to config .yaml file")
+	kid := flags.String("kid", "", "Kid of the key that must sign new tokens")
+	flags.Parse(args)
+
+	if *path == "" || *kid == "" {
+		return errors.New("-config and -kid are required")
+	}
+
+	cfg := config.MustLoadByPath(*path)
+
+	previousKid := cfg.JWTKeys.ActiveKid
+	if previousKid == *kid {
+		return fmt.Errorf("key %q is already active", *kid)
+	}
+
+	// new ring must load, so a broken key never gets to production config
+	if _, err := utils_jwt.LoadKeyRing(*kid, keySpecs(cfg.JWTKeys), cfg.JWTSecret); err != nil {
+		return err
+	}
+
+	if err := setActiveKid(*path, *kid); err != nil {
+		return err
+	}
+
+	fmt.Printf("active key changed: %s -> %s (%s stays verify-only)\n", previousKid, *kid, previousKid)
+	fmt.Println("restart instances to start signing with the new key")
+
+	return nil
+}
+
+func list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	path := flags.String("config", "", "Path to config .yaml file")
+	flags.Parse(args)
+
+	if *path == "" {
+		return errors.New("-config is required")
+	}
+
+	cfg := config.MustLoadByPath(*path)
+
+	for _, key := range cfg.JWTKeys.Keys {
+		state := "verify-only"
+		if key.Kid == cfg.JWTKeys.ActiveKid {
+			state = "active"
+		}
+		fmt.Printf("%s\t%s\t%s\n", key.Kid, key.Algorithm, state)
+	}
+
+	return nil
+}
+
+func keySpecs(keysConfig config.JWTKeysConfig) []utils_jwt.KeySpec {
+	specs := make([]utils_jwt.KeySpec, 0, len(keysConfig.Keys))
+	for _, key := range keysConfig.Keys {
+		specs = append(specs, utils_jwt.KeySpec{
+			Kid: key.Kid,
+			Algorithm: key.Algorithm,
+			PrivateKeyPath: key.PrivateKeyPath,
+			Secret: key.Secret,
+		})
+	}
+
+	return specs
+}
+
+// setActiveKid rewrites jwt_keys.active_kid through yaml nodes, so comments of the file are kept
+func setActiveKid(path string, kid string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if len(doc.Content) == 0 {
+		return errors.New("config file is empty")
+	}
+
+	keysNode := mappingValue(doc.Content[0], "jwt_keys")
+	if keysNode == nil {
+		return errors.New("jwt_keys section not found")
+	}
+
+	activeNode := mappingValue(keysNode, "active_kid")
+	if activeNode == nil {
+		keysNode.Content = append(keysNode.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "active_kid"},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: kid},
+		)
+	} else {
+		activeNode.Value = kid
+	}
+
+	var out bytes.Buffer
+
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, out.Bytes(), info.Mode())
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
@@ -1,40 +1,81 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"authSAS/internal/config"
 	authServer "authSAS/internal/server"
 	"authSAS/internal/services"
-	emailsender "authSAS/internal/utils/emailSender"
+	utils_client "authSAS/internal/utils/clientInfo"
+	utils_jwt "authSAS/internal/utils/jwt"
+	utils_random "authSAS/internal/utils/randomCode"
+	utils_secretbox "authSAS/internal/utils/secretBox"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"google.golang.org/grpc"
 )
 
 type App struct {
 	logger *slog.Logger
 	grpsServer *grpc.Server
+	httpServer *http.Server
+	blacklistPurger *services.BlacklistPurger
+	workersCtx context.Context
+	stopWorkers context.CancelFunc
+	workers sync.WaitGroup
 	config *config.Config
 }
 
-func NewApp(logger *slog.Logger, config *config.Config, permanentStorage services.PermanentStorage, temporaryStorage services.TemporaryStorage) *App {
+func NewApp(logger *slog.Logger, config *config.Config, keyRing *utils_jwt.KeyRing, codeDeliverer services.CodeDeliverer, securityNotifier services.SecurityNotifier, permanentStorage services.PermanentStorage, temporaryStorage services.TemporaryStorage) *App {
 
-	sender := emailsender.NewEmailSender(logger, config.EmailSender.Email, config.EmailSender.Password)
+	logger.Info("JWT key ring loaded", "active_kid", keyRing.Active().Kid, "alg", keyRing.Active().Method.Alg())
 
-	sessionService := services.NewSessionService(logger, config.JWTTokenTTL, config.JWTSecret, sender, permanentStorage, temporaryStorage)
-	accountService := services.NewAccountService(logger, config.JWTTokenTTL, sender, permanentStorage, temporaryStorage)
+	revocationChecker := services.NewRevocationChecker(logger, config.RevocationCache.TTL, config.RevocationCache.NegativeTTL, config.RevocationCache.Size, permanentStorage, temporaryStorage)
+	totpAuthenticator := services.NewTOTPAuthenticator(logger, config.TOTP.Issuer, mustLoadTOTPSecretBox(config), permanentStorage)
+	recoveryCodes := services.NewRecoveryCodes(logger, permanentStorage)
+	passkeyAuthenticator := services.NewPasskeyAuthenticator(logger, mustLoadWebAuthn(config), permanentStorage, temporaryStorage)
+	magicLinks := services.NewMagicLinks(logger, mustLoadMagicLinkTemplate(config), config.TempStorage.CodeTTL, keyRing, tokenOptions(config), temporaryStorage)
+	trustedDevices := services.NewTrustedDevices(logger, config.DeviceTrustTTL, keyRing, tokenOptions(config), permanentStorage)
+	codeAttemptsLimiter := services.NewCodeAttemptsLimiter(logger, config.TempStorage.CodeMaxAttempts, temporaryStorage)
+	codeSendLimiter := services.NewCodeSendLimiter(logger, codeSendLimits(config), temporaryStorage)
+	codeFormats := mustLoadCodeFormats(config)
+	sessionService := services.NewSessionService(logger, config.JWTTokenTTL, config.RefreshTokenTTL, keyRing, tokenOptions(config), mustLoadChallengeBinding(config), revocationChecker, totpAuthenticator, recoveryCodes, passkeyAuthenticator, magicLinks, trustedDevices, codeAttemptsLimiter, codeSendLimiter, codeFormats, codeDeliverer, permanentStorage, temporaryStorage)
+	accountService := services.NewAccountService(logger, config.JWTTokenTTL, sessionService, sessionService, revocationChecker, totpAuthenticator, recoveryCodes, codeAttemptsLimiter, codeSendLimiter, codeFormats, codeDeliverer, securityNotifier, permanentStorage, temporaryStorage)
+	blacklistPurger := services.NewBlacklistPurger(logger, mustLoadBlacklistPurgeInterval(config), permanentStorage)
 	logger.Info("All services initialized")
 
-	grpsServer := grpc.NewServer()
+	grpsServer := grpc.NewServer(grpc.UnaryInterceptor(mustLoadTrustedProxies(config).UnaryServerInterceptor()))
 
 	authServer.RegisterServer(grpsServer, sessionService, accountService)
 	logger.Info("gRPC server registered")
 
+	var httpServer *http.Server
+	if config.Http.Port != 0 {
+		httpServer = &http.Server{
+			Addr: fmt.Sprintf("%s:%d", config.Http.Domain, config.Http.Port),
+			Handler: authServer.NewHTTPHandler(sessionService, sessionService, introspectionClients(config)),
+			ReadHeaderTimeout: config.Grpc.RequestTimeout,
+		}
+		logger.Info("HTTP server registered")
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+
 	return &App{
 		logger: logger,
 		grpsServer: grpsServer,
+		httpServer: httpServer,
+		blacklistPurger: blacklistPurger,
+		workersCtx: workersCtx,
+		stopWorkers: stopWorkers,
 		config: config,
 	}
 }
@@ -46,6 +87,18 @@ func (a *App) MustRun() {
 }
 
 func (a *App) StopApp() {
+	a.stopWorkers()
+	a.workers.Wait()
+
+	if a.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.Grpc.RequestTimeout)
+		defer cancel()
+
+		if err := a.httpServer.Shutdown(ctx); err != nil {
+			a.logger.Error("HTTP server shutdown error", "err", err.Error())
+		}
+	}
+
 	a.grpsServer.GracefulStop()
 }
 
@@ -55,9 +108,152 @@ func (a *App) runApp() error {
 		return fmt.Errorf("listen failed: - err: %w", err)
 	}
 
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		a.blacklistPurger.Run(a.workersCtx)
+	}()
+
+	if a.httpServer != nil {
+		go func() {
+			if err := a.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(fmt.Errorf("httpServer serve failed: - err: %w", err))
+			}
+		}()
+	}
+
 	if err := a.grpsServer.Serve(l); err != nil {
 		return fmt.Errorf("grpcServer serve failed: - err: %w", err)
 	}
 
 	return nil
 }
+
+// mustLoadTOTPSecretBox returns nil while encryption key is not configured, TOTP enrollment is disabled then
+func mustLoadTOTPSecretBox(config *config.Config) *utils_secretbox.SecretBox {
+	if config.TOTP.EncryptionKey == "" {
+		return nil
+	}
+
+	secretBox, err := utils_secretbox.NewSecretBox(config.TOTP.EncryptionKey)
+	if err != nil {
+		panic("totp encryption key init error: " + err.Error())
+	}
+
+	return secretBox
+}
+
+// mustLoadWebAuthn returns nil while relying party id is not configured, passkeys are disabled then
+func mustLoadWebAuthn(config *config.Config) *webauthn.WebAuthn {
+	if config.WebAuthn.RPID == "" {
+		return nil
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID: config.WebAuthn.RPID,
+		RPDisplayName: config.WebAuthn.RPDisplayName,
+		RPOrigins: config.WebAuthn.RPOrigins,
+	})
+	if err != nil {
+		panic("webauthn init error: " + err.Error())
+	}
+
+	return webAuthn
+}
+
+// mustLoadMagicLinkTemplate returns empty template while it is not configured, magic links are disabled then
+func mustLoadMagicLinkTemplate(config *config.Config) string {
+	urlTemplate := config.MagicLink.URLTemplate
+	if urlTemplate != "" && !strings.Contains(urlTemplate, services.MagicLinkTokenPlaceholder) {
+		panic("magic link config error: url_template has no " + services.MagicLinkTokenPlaceholder)
+	}
+
+	return urlTemplate
+}
+
+func mustLoadChallengeBinding(config *config.Config) services.ChallengeBinding {
+	challengeBinding := services.ChallengeBinding(config.LoginChallengeBinding)
+	if err := challengeBinding.Validate(); err != nil {
+		panic("login challenge config error: " + err.Error() + ": " + config.LoginChallengeBinding)
+	}
+
+	return challengeBinding
+}
+
+func mustLoadTrustedProxies(config *config.Config) utils_client.TrustedProxies {
+	trustedProxies, err := utils_client.ParseTrustedProxies(config.Grpc.TrustedProxies)
+	if err != nil {
+		panic("grpc config error: " + err.Error())
+	}
+
+	return trustedProxies
+}
+
+// mustLoadBlacklistPurgeInterval refuses non-positive interval, the purger ticker can't run with it
+func mustLoadBlacklistPurgeInterval(config *config.Config) time.Duration {
+	if config.BlacklistPurgeInterval <= 0 {
+		panic("blacklist purge config error: blacklist_purge_interval must be positive, got " + config.BlacklistPurgeInterval.String())
+	}
+
+	return config.BlacklistPurgeInterval
+}
+
+func mustLoadCodeFormats(config *config.Config) services.CodeFormats {
+	codeFormats := services.CodeFormats{
+		TwoFA: otpFormat(config.Codes.TwoFA),
+		EmailVerify: otpFormat(config.Codes.EmailVerify),
+		PassRecover: otpFormat(config.Codes.PassRecover),
+	}
+
+	for _, format := range []utils_random.OTPFormat{codeFormats.TwoFA, codeFormats.EmailVerify, codeFormats.PassRecover} {
+		if err := format.Validate(); err != nil {
+			panic("codes config error: " + err.Error())
+		}
+	}
+
+	return codeFormats
+}
+
+func otpFormat(codeConfig config.CodeConfig) utils_random.OTPFormat {
+	return utils_random.OTPFormat{
+		Length: codeConfig.Length,
+		Alphabet: codeConfig.Alphabet,
+		GroupSize: codeConfig.GroupSize,
+	}
+}
+
+func codeSendLimits(config *config.Config) services.CodeSendLimits {
+	return services.CodeSendLimits{
+		TwoFA: sendLimit(config.CodeSending.TwoFA),
+		TwoFASettings: sendLimit(config.CodeSending.TwoFASettings),
+		EmailVerify: sendLimit(config.CodeSending.EmailVerify),
+		PassRecover: sendLimit(config.CodeSending.PassRecover),
+		ChangeEmail: sendLimit(config.CodeSending.ChangeEmail),
+		ConfirmPhone: sendLimit(config.CodeSending.ConfirmPhone),
+		MagicLink: sendLimit(config.CodeSending.MagicLink),
+	}
+}
+
+func sendLimit(limitConfig config.SendLimitConfig) services.SendLimit {
+	return services.SendLimit{
+		Cooldown: limitConfig.Cooldown,
+		DailyQuota: limitConfig.DailyQuota,
+	}
+}
+
+func introspectionClients(config *config.Config) map[string]string {
+	clients := make(map[string]string, len(config.Http.IntrospectionClients))
+	for _, client := range config.Http.IntrospectionClients {
+		clients[client.ClientId] = client.ClientSecret
+	}
+
+	return clients
+}
+
+func tokenOptions(config *config.Config) utils_jwt.Options {
+	return utils_jwt.Options{
+		Issuer: config.JWTIssuer,
+		Audience: config.JWTAudience,
+		Leeway: config.JWTLeeway,
+	}
+}
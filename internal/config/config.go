@@ -11,10 +11,26 @@ import (
 type Config struct {
 	AppMode         string            `yaml:"app_mode" env-required:"true"`
 	PermStoragePath string            `yaml:"permanent_storage_path" env-required:"true"`
-	JWTTokenTTL     time.Duration     `yaml:"jwt_token_ttl" env-default:"24h"`
-	JWTSecret     string    `yaml:"jwt_secret" env-required:"true"`
+	JWTTokenTTL     time.Duration     `yaml:"jwt_token_ttl" env-default:"15m"`
+	RefreshTokenTTL time.Duration     `yaml:"refresh_token_ttl" env-default:"720h"`
+	DeviceTrustTTL  time.Duration     `yaml:"device_trust_ttl" env-default:"720h"`
+	LoginChallengeBinding string      `yaml:"login_challenge_binding" env-default:"ip_user_agent"`
+	BlacklistPurgeInterval time.Duration `yaml:"blacklist_purge_interval" env-default:"1h"`
+	JWTSecret     string    `yaml:"jwt_secret"`
+	JWTKeys         JWTKeysConfig     `yaml:"jwt_keys"`
+	JWTIssuer       string            `yaml:"jwt_issuer" env-default:"authSAS"`
+	JWTAudience     []string          `yaml:"jwt_audience" env-default:"authSAS"`
+	JWTLeeway       time.Duration     `yaml:"jwt_leeway" env-default:"30s"`
 	Grpc            GrpcCnofig        `yaml:"grpc"`
+	Http            HttpConfig        `yaml:"http"`
 	TempStorage     TempStorageConfig `yaml:"temp_storage"`
+	Codes           CodesConfig       `yaml:"codes"`
+	CodeSending     CodeSendingConfig `yaml:"code_sending"`
+	RevocationCache RevocationCacheConfig `yaml:"revocation_cache"`
+	TOTP            TOTPConfig        `yaml:"totp"`
+	WebAuthn        WebAuthnConfig    `yaml:"webauthn"`
+	MagicLink       MagicLinkConfig   `yaml:"magic_link"`
+	CodeDelivery    CodeDeliveryConfig `yaml:"code_delivery"`
 	EmailSender EmailSender `yaml:"email_sender"`
 }
 
@@ -22,11 +38,118 @@ type GrpcCnofig struct {
 	Domain         string        `yaml:"domain" env-required:"true"`
 	Port           int           `yaml:"port" env-required:"true"`
 	RequestTimeout time.Duration `yaml:"req_timeout" env-default:"1m"`
+	TrustedProxies []string      `yaml:"trusted_proxies"` // CIDRs or addresses, client ip of their calls is taken from x-forwarded-for
+}
+
+// JWTKeysConfig is a key ring: tokens are signed by the active key,
+// other keys only verify tokens issued before rotation
+type JWTKeysConfig struct {
+	ActiveKid string         `yaml:"active_kid" env-default:"main"`
+	Keys      []JWTKeyConfig `yaml:"keys"`
+}
+
+type JWTKeyConfig struct {
+	Kid            string `yaml:"kid"`
+	Algorithm      string `yaml:"algorithm"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+	Secret         string `yaml:"secret"`
+}
+
+// HttpConfig of the optional http listener, it is disabled while port is 0
+type HttpConfig struct {
+	Domain string `yaml:"domain" env-default:"0.0.0.0"`
+	Port   int    `yaml:"port"`
+	IntrospectionClients []IntrospectionClientConfig `yaml:"introspection_clients"`
+}
+
+// IntrospectionClientConfig are credentials of a resource server allowed to call POST /introspect
+type IntrospectionClientConfig struct {
+	ClientId     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
 }
 
 type TempStorageConfig struct {
 	TempStoragePath string `yaml:"temporary_storage_path" env-required:"true"`
 	CodeTTL  time.Duration `yaml:"code_ttl" env-default:"10m"`
+	CodeMaxAttempts int    `yaml:"code_max_attempts" env-default:"5"`
+	CodeHMACKey string     `yaml:"code_hmac_key"` // base64 of at least 32 bytes, codes are kept as HMAC digests
+}
+
+// CodesConfig sets format of emailed one-time codes per purpose,
+// two_fa is used for login codes and 2FA settings codes
+type CodesConfig struct {
+	TwoFA       CodeConfig `yaml:"two_fa"`
+	EmailVerify CodeConfig `yaml:"email_verify"`
+	PassRecover CodeConfig `yaml:"pass_recover"`
+}
+
+type CodeConfig struct {
+	Length    int    `yaml:"length" env-default:"6"`
+	Alphabet  string `yaml:"alphabet" env-default:"numeric"` // numeric or alphanumeric
+	GroupSize int    `yaml:"group_size"` // 0 sends the code in one piece
+}
+
+// CodeSendingConfig limits how often codes of each purpose are sent to one recipient,
+// 0 falls back to the default, a negative value turns the limit off
+type CodeSendingConfig struct {
+	TwoFA         SendLimitConfig `yaml:"two_fa"`
+	TwoFASettings SendLimitConfig `yaml:"two_fa_settings"`
+	EmailVerify   SendLimitConfig `yaml:"email_verify"`
+	PassRecover   SendLimitConfig `yaml:"pass_recover"`
+	ChangeEmail   SendLimitConfig `yaml:"change_email"`
+	ConfirmPhone  SendLimitConfig `yaml:"confirm_phone"`
+	MagicLink     SendLimitConfig `yaml:"magic_link"`
+}
+
+type SendLimitConfig struct {
+	Cooldown   time.Duration `yaml:"cooldown" env-default:"60s"` // between two sends
+	DailyQuota int           `yaml:"daily_quota" env-default:"10"` // sends within 24h since the first one
+}
+
+// RevocationCacheConfig of the in-process cache in front of redis and postgres revocation lookups
+type RevocationCacheConfig struct {
+	TTL         time.Duration `yaml:"ttl" env-default:"1m"`
+	NegativeTTL time.Duration `yaml:"negative_ttl" env-default:"5s"`
+	Size        int           `yaml:"size" env-default:"10000"`
+}
+
+// TOTPConfig of authenticator app 2FA, enrollment is disabled while encryption key is empty
+type TOTPConfig struct {
+	Issuer        string `yaml:"issuer" env-default:"authSAS"`
+	EncryptionKey string `yaml:"encryption_key"` // base64 of 32 bytes, encrypts stored secrets
+}
+
+// WebAuthnConfig of the relying party for passkeys, they are disabled while rp_id is empty
+type WebAuthnConfig struct {
+	RPID          string   `yaml:"rp_id"`
+	RPDisplayName string   `yaml:"rp_display_name" env-default:"authSAS"`
+	RPOrigins     []string `yaml:"rp_origins"`
+}
+
+// MagicLinkConfig of passwordless login by emailed link, the link lives temp_storage.code_ttl
+type MagicLinkConfig struct {
+	URLTemplate string `yaml:"url_template"` // {token} is replaced by the link token, empty disables magic links
+}
+
+// CodeDeliveryConfig of code channels besides email, a channel is disabled while its url is empty.
+// Test and local modes record codes in memory instead of sending them
+type CodeDeliveryConfig struct {
+	Timeout time.Duration `yaml:"timeout" env-default:"5s"`
+	SMS     SMSConfig     `yaml:"sms"`
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+// SMSConfig of generic HTTP SMS provider, it gets POST {"from", "to", "text"}
+type SMSConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"` // sent as bearer token
+	From  string `yaml:"from" env-default:"authSAS"`
+}
+
+// WebhookConfig of chat bot webhook, request body is signed by secret (X-Signature: sha256=<hex HMAC>)
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
 }
 
 type EmailSender struct {
@@ -69,4 +192,4 @@ func fillConfigPath() string {
 	}
 
 	return path
-}
\ No newline at end of file
+}
@@ -0,0 +1,16 @@
+package models
+
+// CodePurpose tells which emailed code is meant, codes of different purposes never mix
+type CodePurpose string
+
+const (
+	CodePurposeLogin CodePurpose = "login_challenge" // id is the login challenge id
+	CodePurposeTwoFA CodePurpose = "2fa_code" // emailed login code, id is the login challenge id
+	CodePurposeEmailVerify CodePurpose = "email_verify" // id is the email
+	CodePurposePassRecover CodePurpose = "pass_recover" // id is the email
+	CodePurposeTwoFASettings CodePurpose = "2fa_settings" // id is the email
+	CodePurposeMagicLink CodePurpose = "magic_link" // the code is the link token, id is its jti
+	CodePurposeChangeEmail CodePurpose = "change_email" // sent to the new address, id is the current email
+	CodePurposeConfirmPhone CodePurpose = "confirm_phone" // sent to the new phone, id is the email
+	CodePurposeTOTP CodePurpose = "totp" // authenticator app code, nothing is kept, only guesses are counted, id is the email
+)
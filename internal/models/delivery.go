@@ -0,0 +1,24 @@
+package models
+
+// DeliveryChannel is the way one-time codes reach the user
+type DeliveryChannel string
+
+const (
+	DeliveryChannelEmail DeliveryChannel = "email"
+	DeliveryChannelSMS DeliveryChannel = "sms"
+	DeliveryChannelWebhook DeliveryChannel = "webhook" // chat bots
+)
+
+// CodeMessage is a one-time code (or magic link) on its way to the user
+type CodeMessage struct {
+	Purpose CodePurpose
+	Code string // formatted the way the user should type it
+}
+
+// Text is the message shown to the user
+func (m CodeMessage) Text() string {
+	if m.Purpose == CodePurposeMagicLink {
+		return "Follow the link to log in: " + m.Code
+	}
+	return "Here is your code: " + m.Code
+}
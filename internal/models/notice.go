@@ -0,0 +1,46 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// SecurityEvent is a change of the account the user is told about
+type SecurityEvent string
+
+const (
+	SecurityEventPasswordChanged SecurityEvent = "password_changed"
+	SecurityEventEmailChanged SecurityEvent = "email_changed" // sent to the old address
+)
+
+// SecurityNotice tells the user about a change of the account, so a change they didn't make gets noticed
+type SecurityNotice struct {
+	Event SecurityEvent
+	At time.Time
+	ClientIP string
+	UserAgent string
+}
+
+// Text is the message shown to the user
+func (n SecurityNotice) Text() string {
+	var change string
+	switch n.Event {
+	case SecurityEventPasswordChanged:
+		change = "Your password was changed"
+	case SecurityEventEmailChanged:
+		change = "The email of your account was changed"
+	default:
+		change = "Your account settings were changed"
+	}
+
+	client := "an unknown device"
+	if n.ClientIP != "" {
+		client = n.ClientIP
+		if n.UserAgent != "" {
+			client += " (" + n.UserAgent + ")"
+		}
+	}
+
+	return fmt.Sprintf("%s at %s from %s. If it wasn't you, recover your password right away.",
+		change, n.At.UTC().Format(time.RFC1123), client)
+}
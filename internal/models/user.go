@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type User struct {
 	Id int64
 	Email string
@@ -7,4 +9,71 @@ type User struct {
 	IsVerified bool
 	Use2FA bool
 	IsAdmin bool
-}
\ No newline at end of file
+	TokenVersion int64
+	TOTPSecret string // encrypted, empty while not enrolled
+	TOTPEnabled bool
+	TOTPLastStep int64
+	Phone string // E.164, empty while not set
+	PreferredChannel DeliveryChannel // where one-time codes go, empty is email
+}
+
+// RecoveryCode is a single-use 2FA backup code, only the bcrypt hash is stored
+type RecoveryCode struct {
+	Id int64
+	UserId int64
+	CodeHash []byte
+}
+
+// WebAuthnCredential is a registered passkey of the user
+type WebAuthnCredential struct {
+	Id []byte
+	UserId int64
+	PublicKey []byte // COSE encoded
+	AttestationType string
+	Transports []string
+	SignCount uint32
+	AAGUID []byte
+	BackupEligible bool
+	BackupState bool
+	CreatedAt time.Time
+}
+
+// LoginChallenge is a login waiting for the second factor, it is bound to the client that passed the password step
+type LoginChallenge struct {
+	Id string
+	UserId int64
+	ClientIP string
+	UserAgent string
+}
+
+type RefreshToken struct {
+	Id int64
+	UserId int64
+	FamilyId string
+	TokenHash string
+	ExpiresAt time.Time
+	IsUsed bool
+	IsRevoked bool
+}
+
+type Session struct {
+	Id string
+	UserId int64
+	IssuedAt time.Time
+	ExpiresAt time.Time
+	ClientIP string
+	UserAgent string
+	IsRevoked bool
+}
+// TrustedDevice skips the second factor on login until it expires or is revoked,
+// it stops working once token version of the user is bumped (password change, logout everywhere)
+type TrustedDevice struct {
+	Id string
+	UserId int64
+	TokenVersion int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	LastUsedAt time.Time
+	ClientIP string
+	UserAgent string
+}
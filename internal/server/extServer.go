@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+
+	extv1 "authSAS/api/extv1"
+	"authSAS/internal/models"
+)
+
+// ExtServer serves the AuthExt service, it has the calls the Auth service of authSASproto has no room for
+type ExtServer struct {
+	extv1.UnimplementedAuthExtServer
+	sessionService SessionService
+	accountService AccountService
+}
+
+// Logic
+
+func (s *ExtServer) ValidateToken(ctx context.Context, req *extv1.ValidateTokenRequest) (*extv1.ValidateTokenResponse, error) {
+
+	token := req.GetToken()
+
+	uid, email, isAdmin, err := s.sessionService.ValidateToken(ctx, token)
+
+	return &extv1.ValidateTokenResponse{
+		UserId: uid,
+		Email: email,
+		IsAdmin: isAdmin,
+	}, statusError(err)
+}
+
+func (s *ExtServer) Refresh(ctx context.Context, req *extv1.RefreshRequest) (*extv1.RefreshResponse, error) {
+
+	refreshToken := req.GetRefreshToken()
+
+	token, newRefreshToken, err := s.sessionService.Refresh(ctx, refreshToken)
+
+	return &extv1.RefreshResponse{
+		Token: token,
+		RefreshToken: newRefreshToken,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ListSessions(ctx context.Context, req *extv1.ListSessionsRequest) (*extv1.ListSessionsResponse, error) {
+
+	token := req.GetToken()
+
+	sessions, currentSessionId, err := s.sessionService.ListSessions(ctx, token)
+
+	resp := &extv1.ListSessionsResponse{}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &extv1.Session{
+			Id: session.Id,
+			IssuedAt: session.IssuedAt.Unix(),
+			ExpiresAt: session.ExpiresAt.Unix(),
+			ClientIp: session.ClientIP,
+			UserAgent: session.UserAgent,
+			Current: session.Id == currentSessionId,
+		})
+	}
+
+	return resp, statusError(err)
+}
+
+func (s *ExtServer) RevokeSession(ctx context.Context, req *extv1.RevokeSessionRequest) (*extv1.RevokeSessionResponse, error) {
+
+	token := req.GetToken()
+	sessionId := req.GetSessionId()
+
+	msg, err := s.sessionService.RevokeSession(ctx, token, sessionId)
+
+	return &extv1.RevokeSessionResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) RevokeOtherSessions(ctx context.Context, req *extv1.RevokeOtherSessionsRequest) (*extv1.RevokeOtherSessionsResponse, error) {
+
+	token := req.GetToken()
+
+	msg, err := s.sessionService.RevokeOtherSessions(ctx, token)
+
+	return &extv1.RevokeOtherSessionsResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) LogoutAll(ctx context.Context, req *extv1.LogoutAllRequest) (*extv1.LogoutAllResponse, error) {
+
+	token := req.GetToken()
+
+	msg, err := s.sessionService.LogoutAll(ctx, token)
+
+	return &extv1.LogoutAllResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) EnrollTOTP(ctx context.Context, req *extv1.EnrollTOTPRequest) (*extv1.EnrollTOTPResponse, error) {
+
+	token := req.GetToken()
+	withQRCode := req.GetWithQrCode()
+
+	secret, uri, qrCode, err := s.sessionService.EnrollTOTP(ctx, token, withQRCode)
+
+	return &extv1.EnrollTOTPResponse{
+		Secret: secret,
+		Uri: uri,
+		QrCode: qrCode,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ConfirmTOTP(ctx context.Context, req *extv1.ConfirmTOTPRequest) (*extv1.ConfirmTOTPResponse, error) {
+
+	token := req.GetToken()
+	code := req.GetCode()
+
+	msg, recoveryCodes, err := s.sessionService.ConfirmTOTP(ctx, token, code)
+
+	return &extv1.ConfirmTOTPResponse{
+		Msg: msg,
+		RecoveryCodes: recoveryCodes,
+	}, statusError(err)
+}
+
+func (s *ExtServer) TwoFASettingsSendCode(ctx context.Context, req *extv1.TwoFASettingsSendCodeRequest) (*extv1.TwoFASettingsSendCodeResponse, error) {
+
+	token := req.GetToken()
+
+	msg, err := s.accountService.TwoFASettingsSendCode(ctx, token)
+
+	setRetryAfterHeader(ctx, err)
+
+	return &extv1.TwoFASettingsSendCodeResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) Enable2FA(ctx context.Context, req *extv1.Enable2FARequest) (*extv1.Enable2FAResponse, error) {
+
+	token := req.GetToken()
+	code := req.GetCode()
+
+	msg, recoveryCodes, err := s.accountService.Enable2FA(ctx, token, code)
+
+	return &extv1.Enable2FAResponse{
+		Msg: msg,
+		RecoveryCodes: recoveryCodes,
+	}, statusError(err)
+}
+
+func (s *ExtServer) Disable2FA(ctx context.Context, req *extv1.Disable2FARequest) (*extv1.Disable2FAResponse, error) {
+
+	token := req.GetToken()
+	password := req.GetPassword()
+	code := req.GetCode()
+
+	msg, err := s.accountService.Disable2FA(ctx, token, password, code)
+
+	return &extv1.Disable2FAResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) RegenerateRecoveryCodes(ctx context.Context, req *extv1.RegenerateRecoveryCodesRequest) (*extv1.RegenerateRecoveryCodesResponse, error) {
+
+	token := req.GetToken()
+	password := req.GetPassword()
+
+	recoveryCodes, err := s.accountService.RegenerateRecoveryCodes(ctx, token, password)
+
+	return &extv1.RegenerateRecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+	}, statusError(err)
+}
+
+func (s *ExtServer) BeginPasskeyRegistration(ctx context.Context, req *extv1.BeginPasskeyRegistrationRequest) (*extv1.BeginPasskeyRegistrationResponse, error) {
+
+	token := req.GetToken()
+
+	options, challengeId, err := s.sessionService.BeginPasskeyRegistration(ctx, token)
+
+	return &extv1.BeginPasskeyRegistrationResponse{
+		Options: options,
+		ChallengeId: challengeId,
+	}, statusError(err)
+}
+
+func (s *ExtServer) FinishPasskeyRegistration(ctx context.Context, req *extv1.FinishPasskeyRegistrationRequest) (*extv1.FinishPasskeyRegistrationResponse, error) {
+
+	token := req.GetToken()
+	challengeId := req.GetChallengeId()
+	response := req.GetResponse()
+
+	msg, err := s.sessionService.FinishPasskeyRegistration(ctx, token, challengeId, response)
+
+	return &extv1.FinishPasskeyRegistrationResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) BeginPasskeyLogin(ctx context.Context, req *extv1.BeginPasskeyLoginRequest) (*extv1.BeginPasskeyLoginResponse, error) {
+
+	loginChallengeId := req.GetLoginChallengeId()
+
+	options, challengeId, err := s.sessionService.BeginPasskeyLogin(ctx, loginChallengeId)
+
+	return &extv1.BeginPasskeyLoginResponse{
+		Options: options,
+		ChallengeId: challengeId,
+	}, statusError(err)
+}
+
+func (s *ExtServer) FinishPasskeyLogin(ctx context.Context, req *extv1.FinishPasskeyLoginRequest) (*extv1.FinishPasskeyLoginResponse, error) {
+
+	challengeId := req.GetChallengeId()
+	response := req.GetResponse()
+
+	token, refreshToken, err := s.sessionService.FinishPasskeyLogin(ctx, challengeId, response)
+
+	return &extv1.FinishPasskeyLoginResponse{
+		Token: token,
+		RefreshToken: refreshToken,
+	}, statusError(err)
+}
+
+func (s *ExtServer) RequestMagicLink(ctx context.Context, req *extv1.RequestMagicLinkRequest) (*extv1.RequestMagicLinkResponse, error) {
+
+	email := req.GetEmail()
+
+	msg, err := s.sessionService.RequestMagicLink(ctx, email)
+
+	setRetryAfterHeader(ctx, err)
+
+	return &extv1.RequestMagicLinkResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ConsumeMagicLink(ctx context.Context, req *extv1.ConsumeMagicLinkRequest) (*extv1.ConsumeMagicLinkResponse, error) {
+
+	linkToken := req.GetLinkToken()
+
+	token, refreshToken, challengeId, msg, err := s.sessionService.ConsumeMagicLink(ctx, linkToken)
+
+	return &extv1.ConsumeMagicLinkResponse{
+		Token: token,
+		RefreshToken: refreshToken,
+		ChallengeId: challengeId,
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) SetCodeChannelSendCode(ctx context.Context, req *extv1.SetCodeChannelSendCodeRequest) (*extv1.SetCodeChannelSendCodeResponse, error) {
+
+	token := req.GetToken()
+	password := req.GetPassword()
+	phone := req.GetPhone()
+
+	msg, err := s.accountService.SetCodeChannelSendCode(ctx, token, password, phone)
+
+	setRetryAfterHeader(ctx, err)
+
+	return &extv1.SetCodeChannelSendCodeResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) SetCodeChannel(ctx context.Context, req *extv1.SetCodeChannelRequest) (*extv1.SetCodeChannelResponse, error) {
+
+	token := req.GetToken()
+	password := req.GetPassword()
+	phone := req.GetPhone()
+	channel := models.DeliveryChannel(req.GetChannel())
+	code := req.GetCode()
+
+	msg, err := s.accountService.SetCodeChannel(ctx, token, password, phone, channel, code)
+
+	return &extv1.SetCodeChannelResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ListTrustedDevices(ctx context.Context, req *extv1.ListTrustedDevicesRequest) (*extv1.ListTrustedDevicesResponse, error) {
+
+	token := req.GetToken()
+
+	devices, err := s.sessionService.ListTrustedDevices(ctx, token)
+
+	resp := &extv1.ListTrustedDevicesResponse{}
+	for _, device := range devices {
+		resp.Devices = append(resp.Devices, &extv1.TrustedDevice{
+			Id: device.Id,
+			CreatedAt: device.CreatedAt.Unix(),
+			ExpiresAt: device.ExpiresAt.Unix(),
+			LastUsedAt: device.LastUsedAt.Unix(),
+			ClientIp: device.ClientIP,
+			UserAgent: device.UserAgent,
+		})
+	}
+
+	return resp, statusError(err)
+}
+
+func (s *ExtServer) RevokeTrustedDevice(ctx context.Context, req *extv1.RevokeTrustedDeviceRequest) (*extv1.RevokeTrustedDeviceResponse, error) {
+
+	token := req.GetToken()
+	deviceId := req.GetDeviceId()
+
+	msg, err := s.sessionService.RevokeTrustedDevice(ctx, token, deviceId)
+
+	return &extv1.RevokeTrustedDeviceResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ChangePassword(ctx context.Context, req *extv1.ChangePasswordRequest) (*extv1.ChangePasswordResponse, error) {
+
+	token := req.GetToken()
+	currentPassword := req.GetCurrentPassword()
+	newPassword := req.GetNewPassword()
+	revokeOthers := req.GetRevokeOtherSessions()
+
+	msg, err := s.accountService.ChangePassword(ctx, token, currentPassword, newPassword, revokeOthers)
+
+	return &extv1.ChangePasswordResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ChangeEmailSendCode(ctx context.Context, req *extv1.ChangeEmailSendCodeRequest) (*extv1.ChangeEmailSendCodeResponse, error) {
+
+	token := req.GetToken()
+	password := req.GetPassword()
+	newEmail := req.GetNewEmail()
+
+	msg, err := s.accountService.ChangeEmailSendCode(ctx, token, password, newEmail)
+
+	setRetryAfterHeader(ctx, err)
+
+	return &extv1.ChangeEmailSendCodeResponse{
+		Msg: msg,
+	}, statusError(err)
+}
+
+func (s *ExtServer) ChangeEmail(ctx context.Context, req *extv1.ChangeEmailRequest) (*extv1.ChangeEmailResponse, error) {
+
+	token := req.GetToken()
+	newEmail := req.GetNewEmail()
+	code := req.GetCode()
+
+	msg, err := s.accountService.ChangeEmail(ctx, token, newEmail, code)
+
+	return &extv1.ChangeEmailResponse{
+		Msg: msg,
+	}, statusError(err)
+}
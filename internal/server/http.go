@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	utils_jwt "authSAS/internal/utils/jwt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type KeysProvider interface {
+	GetJWKS(ctx context.Context) (jwks utils_jwt.JWKS, err error)
+}
+
+type TokenIntrospector interface {
+	IntrospectToken(ctx context.Context, token string) (claims *utils_jwt.Claims, active bool, err error)
+}
+
+type HTTPServer struct {
+	keysProvider KeysProvider
+	tokenIntrospector TokenIntrospector
+	introspectionClients map[string]string
+}
+
+// introspectionResponse is RFC 7662 answer, inactive token gets only {"active": false}
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Nbf       int64    `json:"nbf,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Sid       string   `json:"sid,omitempty"`
+}
+
+// NewHTTPHandler serves JWKS and token introspection, introspectionClients maps client_id to client_secret
+func NewHTTPHandler(keysProvider KeysProvider, tokenIntrospector TokenIntrospector, introspectionClients map[string]string) http.Handler {
+	s := &HTTPServer{
+		keysProvider: keysProvider,
+		tokenIntrospector: tokenIntrospector,
+		introspectionClients: introspectionClients,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", s.JWKS)
+	mux.HandleFunc("POST /introspect", s.Introspect)
+
+	return mux
+}
+
+// Logic
+
+func (s *HTTPServer) JWKS(w http.ResponseWriter, r *http.Request) {
+
+	jwks, err := s.keysProvider.GetJWKS(r.Context())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jwks)
+}
+
+func (s *HTTPServer) Introspect(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !s.authenticateClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// only access tokens are introspected, token_type_hint is ignored as the spec allows
+	claims, active, err := s.tokenIntrospector.IntrospectToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if !active {
+		writeJSON(w, http.StatusOK, introspectionResponse{Active: false})
+		return
+	}
+
+	scope := "user"
+	if claims.IsAdmin {
+		scope += " admin"
+	}
+
+	writeJSON(w, http.StatusOK, introspectionResponse{
+		Active: true,
+		Scope: scope,
+		Username: claims.Email,
+		TokenType: "Bearer",
+		Exp: numericDate(claims.ExpiresAt),
+		Iat: numericDate(claims.IssuedAt),
+		Nbf: numericDate(claims.NotBefore),
+		Sub: strconv.FormatInt(claims.UID, 10),
+		Aud: claims.Audience,
+		Iss: claims.Issuer,
+		Jti: claims.ID,
+		Sid: claims.SessionId,
+	})
+}
+
+// Helpers
+
+// authenticateClient accepts client_secret_basic and client_secret_post credentials
+func (s *HTTPServer) authenticateClient(r *http.Request) bool {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+
+	if clientId == "" || clientSecret == "" {
+		return false
+	}
+
+	expected, ok := s.introspectionClients[clientId]
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(clientSecret), []byte(expected)) == 1
+}
+
+func numericDate(date *jwt.NumericDate) int64 {
+	if date == nil {
+		return 0
+	}
+	return date.Unix()
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
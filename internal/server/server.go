@@ -2,24 +2,63 @@ package server
 
 import (
 	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	extv1 "authSAS/api/extv1"
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_client "authSAS/internal/utils/clientInfo"
 
 	sasv1 "github.com/BegunovDmitry/authSASproto/result/go"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type SessionService interface {
-	Login(ctx context.Context, email string, password string) (token string, msg string, err error)
+	Login(ctx context.Context, email string, password string) (token string, refreshToken string, challengeId string, msg string, err error)
 	Logout(ctx context.Context, token string) (msg string, err error)
-	LoginWith2FACode(ctx context.Context, email string, code int) (token string, err error)
+	LoginWith2FACode(ctx context.Context, challengeId string, code string, rememberDevice bool) (token string, refreshToken string, deviceTrustToken string, err error)
+	ValidateToken(ctx context.Context, token string) (uid int64, email string, isAdmin bool, err error)
+	Refresh(ctx context.Context, refreshToken string) (token string, newRefreshToken string, err error)
+	ListSessions(ctx context.Context, token string) (sessions []models.Session, currentSessionId string, err error)
+	RevokeSession(ctx context.Context, token string, sessionId string) (msg string, err error)
+	RevokeOtherSessions(ctx context.Context, token string) (msg string, err error)
+	LogoutAll(ctx context.Context, token string) (msg string, err error)
+	ListTrustedDevices(ctx context.Context, token string) (devices []models.TrustedDevice, err error)
+	RevokeTrustedDevice(ctx context.Context, token string, deviceId string) (msg string, err error)
+	EnrollTOTP(ctx context.Context, token string, withQRCode bool) (secret string, uri string, qrCode []byte, err error)
+	ConfirmTOTP(ctx context.Context, token string, code string) (msg string, recoveryCodes []string, err error)
+	BeginPasskeyRegistration(ctx context.Context, token string) (options []byte, challengeId string, err error)
+	FinishPasskeyRegistration(ctx context.Context, token string, challengeId string, response []byte) (msg string, err error)
+	BeginPasskeyLogin(ctx context.Context, loginChallengeId string) (options []byte, challengeId string, err error)
+	FinishPasskeyLogin(ctx context.Context, challengeId string, response []byte) (token string, refreshToken string, err error)
+	RequestMagicLink(ctx context.Context, email string) (msg string, err error)
+	ConsumeMagicLink(ctx context.Context, linkToken string) (token string, refreshToken string, challengeId string, msg string, err error)
 }
 
 type AccountService interface {
 	Register(ctx context.Context, email string, password string) (userId int64, err error)
 	EmailVerifySendCode(ctx context.Context, email string) (msg string, err error)
-	EmailVerify(ctx context.Context, email string, code int) (msg string, err error)
+	EmailVerify(ctx context.Context, email string, code string) (msg string, err error)
 	PasswordRecoverSendCode(ctx context.Context, email string) (msg string, err error)
-	PasswordRecover(ctx context.Context, email string, newPassword string, code int) (msg string, err error)
+	PasswordRecover(ctx context.Context, email string, newPassword string, code string) (msg string, err error)
+	ChangePassword(ctx context.Context, token string, currentPassword string, newPassword string, revokeOthers bool) (msg string, err error)
+	TwoFASettingsSendCode(ctx context.Context, token string) (msg string, err error)
+	Enable2FA(ctx context.Context, token string, code string) (msg string, recoveryCodes []string, err error)
+	Disable2FA(ctx context.Context, token string, password string, code string) (msg string, err error)
+	RegenerateRecoveryCodes(ctx context.Context, token string, password string) (recoveryCodes []string, err error)
+	SetCodeChannelSendCode(ctx context.Context, token string, password string, phone string) (msg string, err error)
+	SetCodeChannel(ctx context.Context, token string, password string, phone string, channel models.DeliveryChannel, code string) (msg string, err error)
+	ChangeEmailSendCode(ctx context.Context, token string, password string, newEmail string) (msg string, err error)
+	ChangeEmail(ctx context.Context, token string, newEmail string, code string) (msg string, err error)
 }
 
 type Server struct {
@@ -28,8 +67,28 @@ type Server struct {
 	accountService AccountService
 }
 
+// refreshTokenHeader is the response metadata key with the refresh token, LoginResponce has no field for it
+const refreshTokenHeader = "refresh-token"
+
+// loginChallengeHeader is the metadata key with id of the pending 2FA login, Login sends it
+// in response and LoginWith2FACode expects it in request (email of LoginWith2FACodeRequest is not used)
+const loginChallengeHeader = "login-challenge"
+
+// otpCodeHeader is the request metadata key with the code as the user typed it,
+// it takes precedence over int32 code fields that can't carry alphanumeric codes
+const otpCodeHeader = "otp-code"
+
+// rememberDeviceHeader set to "true" in LoginWith2FACode request asks for a device trust token,
+// it comes back in the device-trust response header, Login reads it from request metadata
+const rememberDeviceHeader = "remember-device"
+
+// retryAfterHeader is the response metadata key with whole seconds left until a code may be sent again,
+// the same time comes as RetryInfo in details of the ResourceExhausted status
+const retryAfterHeader = "retry-after"
+
 func RegisterServer(grpc *grpc.Server, sessionService SessionService, accountService AccountService) {
 	sasv1.RegisterAuthServer(grpc, &Server{sessionService: sessionService, accountService: accountService})
+	extv1.RegisterAuthExtServer(grpc, &ExtServer{sessionService: sessionService, accountService: accountService})
 }
 
 // Logic
@@ -39,12 +98,16 @@ func (s *Server) Login(ctx context.Context, req *sasv1.LoginRequest) (*sasv1.Log
 	email := req.GetEmail()
 	password := req.GetPassword()
 
-	token, msg, err := s.sessionService.Login(ctx, email, password)
+	token, refreshToken, challengeId, msg, err := s.sessionService.Login(ctx, email, password)
+
+	setRefreshTokenHeader(ctx, refreshToken)
+	setLoginChallengeHeader(ctx, challengeId)
+	setRetryAfterHeader(ctx, err)
 
 	return &sasv1.LoginResponce{
 		Token: token,
 		Msg: msg,
-	}, err
+	}, statusError(err)
 
 }
 
@@ -62,14 +125,19 @@ func (s *Server) Logout(ctx context.Context, req *sasv1.LogoutRequest) (*sasv1.L
 
 func (s *Server) LoginWith2FACode(ctx context.Context, req *sasv1.LoginWith2FACodeRequest) (*sasv1.LoginWith2FACodeResponce, error) {
 
-	email := req.GetEmail()
-	code := req.GetCode()
+	challengeId := metadataValue(ctx, loginChallengeHeader)
+	code := codeFromRequest(ctx, req.GetCode())
+
+	rememberDevice := metadataValue(ctx, rememberDeviceHeader) == "true"
+
+	token, refreshToken, deviceTrustToken, err := s.sessionService.LoginWith2FACode(ctx, challengeId, code, rememberDevice)
 
-	token, err := s.sessionService.LoginWith2FACode(ctx, email, int(code))
+	setRefreshTokenHeader(ctx, refreshToken)
+	setDeviceTrustHeader(ctx, deviceTrustToken)
 
 	return &sasv1.LoginWith2FACodeResponce{
 		Token: token,
-	}, err
+	}, statusError(err)
 
 }
 
@@ -91,21 +159,23 @@ func (s *Server) EmailVerifySendCode(ctx context.Context, req *sasv1.EmailVerify
 
 	msg, err := s.accountService.EmailVerifySendCode(ctx, email)
 
+	setRetryAfterHeader(ctx, err)
+
 	return &sasv1.EmailVerifySendCodeResponce{
 		Msg: msg,
-	}, err
+	}, statusError(err)
 }
 
 func (s *Server) EmailVerify(ctx context.Context, req *sasv1.EmailVerifyRequest) (*sasv1.EmailVerifyResponce, error) {
 
 	email := req.GetEmail()
-	code := req.GetCode()
+	code := codeFromRequest(ctx, req.GetCode())
 
-	msg, err := s.accountService.EmailVerify(ctx, email, int(code))
+	msg, err := s.accountService.EmailVerify(ctx, email, code)
 
 	return &sasv1.EmailVerifyResponce{
 		Msg: msg,
-	}, err
+	}, statusError(err)
 }
 
 func (s *Server) PasswordRecoverSendCode(ctx context.Context, req *sasv1.PasswordRecoverSendCodeRequest) (*sasv1.PasswordRecoverSendCodeResponce, error) {
@@ -114,21 +184,108 @@ func (s *Server) PasswordRecoverSendCode(ctx context.Context, req *sasv1.Passwor
 
 	msg, err := s.accountService.PasswordRecoverSendCode(ctx, email)
 
+	setRetryAfterHeader(ctx, err)
+
 	return &sasv1.PasswordRecoverSendCodeResponce{
 		Msg: msg,
-	}, err
+	}, statusError(err)
 }
 
 func (s *Server) PasswordRecover(ctx context.Context, req *sasv1.PasswordRecoverRequest) (*sasv1.PasswordRecoverResponce, error) {
 
 	email := req.GetEmail()
 	newPassword := req.GetNewPassword()
-	code := req.GetCode()
+	code := codeFromRequest(ctx, req.GetCode())
 
-	msg, err := s.accountService.PasswordRecover(ctx, email, newPassword, int(code))
+	msg, err := s.accountService.PasswordRecover(ctx, email, newPassword, code)
 
 	return &sasv1.PasswordRecoverResponce{
 		Msg: msg,
-	}, err
+	}, statusError(err)
+}
+
+// Helpers
+
+func setRefreshTokenHeader(ctx context.Context, refreshToken string) {
+	if refreshToken == "" {
+		return
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(refreshTokenHeader, refreshToken))
+}
+
+func setLoginChallengeHeader(ctx context.Context, challengeId string) {
+	if challengeId == "" {
+		return
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(loginChallengeHeader, challengeId))
 }
 
+func setDeviceTrustHeader(ctx context.Context, deviceTrustToken string) {
+	if deviceTrustToken == "" {
+		return
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(utils_client.DeviceTrustHeader, deviceTrustToken))
+}
+
+func setRetryAfterHeader(ctx context.Context, err error) {
+	var retryErr *utils.RetryAfterError
+	if !errors.As(err, &retryErr) {
+		return
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(retryAfterHeader, strconv.FormatInt(retryAfterSeconds(retryErr), 10)))
+}
+
+// retryAfterSeconds rounds up, so the client doesn't come back a moment too early
+func retryAfterSeconds(retryErr *utils.RetryAfterError) int64 {
+	return int64(math.Ceil(retryErr.RetryAfter.Seconds()))
+}
+
+func codeFromRequest(ctx context.Context, code int32) string {
+	if value := metadataValue(ctx, otpCodeHeader); value != "" {
+		return value
+	}
+
+	if code == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(int(code))
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// statusError gives errors the client has to react to their own gRPC status code,
+// other errors are returned as is
+func statusError(err error) error {
+	if errors.Is(err, utils.ErrTooManyCodeAttempts) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	var retryErr *utils.RetryAfterError
+	if errors.As(err, &retryErr) {
+		st, detailsErr := status.New(codes.ResourceExhausted, err.Error()).WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(time.Duration(retryAfterSeconds(retryErr)) * time.Second),
+		})
+		if detailsErr != nil {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return st.Err()
+	}
+
+	return err
+}
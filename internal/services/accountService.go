@@ -1,43 +1,93 @@
 package services
 
 import (
+	"authSAS/internal/models"
 	"authSAS/internal/utils"
-	emailsender "authSAS/internal/utils/emailSender"
+	utils_client "authSAS/internal/utils/clientInfo"
 	utils_random "authSAS/internal/utils/randomCode"
 	"context"
+	"errors"
 	"log/slog"
+	"regexp"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// phonePattern is E.164: plus, country code and up to 15 digits in total
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// TokenValidator authenticates account settings calls, SessionService implements it
+type TokenValidator interface {
+	ValidateToken(ctx context.Context, tokenString string) (uid int64, email string, isAdmin bool, err error)
+}
+
+// OtherSessionsRevoker ends all sessions of the token owner but the one of the token, SessionService implements it
+type OtherSessionsRevoker interface {
+	RevokeOtherSessions(ctx context.Context, tokenString string) (msg string, err error)
+}
+
 type AccountService struct {
 	logger *slog.Logger
 	tokenTTL time.Duration
-	emailSender *emailsender.EmailSender
+	tokenValidator TokenValidator
+	otherSessionsRevoker OtherSessionsRevoker
+	totpAuthenticator *TOTPAuthenticator
+	recoveryCodes *RecoveryCodes
+	codeAttemptsLimiter *CodeAttemptsLimiter
+	codeSendLimiter *CodeSendLimiter
+	codeFormats CodeFormats
+	codeDeliverer CodeDeliverer
+	securityNotifier SecurityNotifier
 	userGetter UserGetter
 	userCreator UserCreator
 	emailVerificator 	EmailVerificator
 	passChanger 	PassChanger
+	emailChanger 	EmailChanger
+	tokenVersionBumper 	TokenVersionBumper
+	twoFASetter 	TwoFASetter
+	codeChannelSetter 	CodeChannelSetter
+	trustedDevicesGetter 	TrustedDevicesGetter
+	trustedDeviceRevoker 	TrustedDeviceRevoker
 	emailVerifyCodeKeeper 	EmailVerifyCodeKeeper
-	emailVerifyCodeGetter 	EmailVerifyCodeGetter
 	passRecoverCodeKeeper 	PassRecoverCodeKeeper
-	passRecoverCodeGetter 	PassRecoverCodeGetter
+	twoFASettingsCodeKeeper 	TwoFASettingsCodeKeeper
+	changeEmailCodeKeeper 	ChangeEmailCodeKeeper
+	confirmPhoneCodeKeeper 	ConfirmPhoneCodeKeeper
+	codeConsumer 	CodeConsumer
+	codeDropper 	CodeDropper
 }
 
-func NewAccountService(logger *slog.Logger, tokenTTL time.Duration, emailSender *emailsender.EmailSender, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *AccountService {
+func NewAccountService(logger *slog.Logger, tokenTTL time.Duration, tokenValidator TokenValidator, otherSessionsRevoker OtherSessionsRevoker, tokenVersionBumper TokenVersionBumper, totpAuthenticator *TOTPAuthenticator, recoveryCodes *RecoveryCodes, codeAttemptsLimiter *CodeAttemptsLimiter, codeSendLimiter *CodeSendLimiter, codeFormats CodeFormats, codeDeliverer CodeDeliverer, securityNotifier SecurityNotifier, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *AccountService {
 	return &AccountService{
 		logger: logger,
 		tokenTTL: tokenTTL,
-		emailSender: emailSender,
+		tokenValidator: tokenValidator,
+		otherSessionsRevoker: otherSessionsRevoker,
+		totpAuthenticator: totpAuthenticator,
+		recoveryCodes: recoveryCodes,
+		codeAttemptsLimiter: codeAttemptsLimiter,
+		codeSendLimiter: codeSendLimiter,
+		codeFormats: codeFormats,
+		codeDeliverer: codeDeliverer,
+		securityNotifier: securityNotifier,
 		userGetter: permanentStorage,
 		userCreator: permanentStorage,
 		emailVerificator: permanentStorage,
 		passChanger: permanentStorage,
+		emailChanger: permanentStorage,
+		tokenVersionBumper: tokenVersionBumper,
+		twoFASetter: permanentStorage,
+		codeChannelSetter: permanentStorage,
+		trustedDevicesGetter: permanentStorage,
+		trustedDeviceRevoker: permanentStorage,
 		emailVerifyCodeKeeper: temporaryStorage,
-		emailVerifyCodeGetter: temporaryStorage,
 		passRecoverCodeKeeper: temporaryStorage,
-		passRecoverCodeGetter: temporaryStorage,
+		twoFASettingsCodeKeeper: temporaryStorage,
+		changeEmailCodeKeeper: temporaryStorage,
+		confirmPhoneCodeKeeper: temporaryStorage,
+		codeConsumer: temporaryStorage,
+		codeDropper: temporaryStorage,
 	}
 }
 
@@ -98,46 +148,48 @@ func (a *AccountService) EmailVerifySendCode(ctx context.Context, email string)
 		return "Error", utils.ErrUserEmailAlreadyVerified
 	}
 
-	randCode := utils_random.RandRange(1000, 9999)
-	
-	a.emailSender.SendEmail(email, randCode)
+	if err := a.codeSendLimiter.Reserve(ctx, models.CodePurposeEmailVerify, email); err != nil {
+		a.logger.Debug("Sending email verify code user error", "email", email, "err", err.Error())
+		return "Error", err
+	}
 
-	if err := a.emailVerifyCodeKeeper.KeepEmailVerifyCode(ctx, email, randCode); err != nil {
+	code, formattedCode, err := utils_random.NewOTP(a.codeFormats.EmailVerify)
+	if err != nil {
 		a.logger.Debug("Sending email verify code user error", "email", email, "err", err.Error())
 		return "Error", utils.ErrInternalServer
 	}
 
-	a.logger.Debug("Email verify code sended", "email", email, "code", randCode)
+	a.codeDeliverer.DeliverCode(ctx, user, models.CodeMessage{Purpose: models.CodePurposeEmailVerify, Code: formattedCode})
+
+	if err := a.emailVerifyCodeKeeper.KeepEmailVerifyCode(ctx, email, code); err != nil {
+		a.logger.Debug("Sending email verify code user error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("Email verify code sended", "email", email)
 
 	return "Code sended", nil
 }
 
-func (a *AccountService) EmailVerify(ctx context.Context, email string, code int) (msg string, err error) {
+func (a *AccountService) EmailVerify(ctx context.Context, email string, code string) (msg string, err error) {
+
+	a.logger.Debug("Trying to verify user's email", "email", email)
 
-	a.logger.Debug("Trying to verify user's email", "email", email, "code", code)
+	code = utils_random.NormalizeOTP(code)
 
 	if email == "" {
 		a.logger.Debug("Verifying user's email error", "email", email, "err", utils.ErrEmptyEmail)
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	if code == 0 {
+	if code == "" {
 		a.logger.Debug("Verifying user's email error", "email", email, "err", utils.ErrWrongVerificationCode)
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	sendedCode, err := a.emailVerifyCodeGetter.GetEmailVerifyCode(ctx, email)
-	if err != nil {
+	if err := a.consumeCode(ctx, models.CodePurposeEmailVerify, email, code); err != nil {
 		a.logger.Debug("Verifying user's email error", "email", email, "err", err.Error())
-		if err == utils.ErrEmailVerifyCodeNotFound {
-			return "Error", utils.ErrInvalidCredentials
-		}
-		return "Error", utils.ErrInternalServer
-	}
-
-	if sendedCode != code {
-		a.logger.Debug("Verifying user's email error", "email", email, "err", utils.ErrWrongVerificationCode)
-		return "Error", utils.ErrInvalidCredentials
+		return "Error", err
 	}
 
 	if err := a.emailVerificator.VerifyEmail(ctx, email); err != nil {
@@ -162,7 +214,7 @@ func (a *AccountService) PasswordRecoverSendCode(ctx context.Context, email stri
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	_, err = a.userGetter.GetUserByEmail(ctx, email)
+	user, err := a.userGetter.GetUserByEmail(ctx, email)
 	if err != nil {
 		a.logger.Debug("Sending pass recover code error", "email", email, "err", err.Error())
 		if err == utils.ErrUserNotFound {
@@ -171,23 +223,34 @@ func (a *AccountService) PasswordRecoverSendCode(ctx context.Context, email stri
 		return "Error", utils.ErrInternalServer
 	}
 
-	randCode := utils_random.RandRange(1000, 9999)
+	if err := a.codeSendLimiter.Reserve(ctx, models.CodePurposePassRecover, email); err != nil {
+		a.logger.Debug("Sending pass recover code error", "email", email, "err", err.Error())
+		return "Error", err
+	}
 
-	a.emailSender.SendEmail(email, randCode)
+	code, formattedCode, err := utils_random.NewOTP(a.codeFormats.PassRecover)
+	if err != nil {
+		a.logger.Debug("Sending pass recover code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.codeDeliverer.DeliverCode(ctx, user, models.CodeMessage{Purpose: models.CodePurposePassRecover, Code: formattedCode})
 
-	if err := a.passRecoverCodeKeeper.KeepPassRecoverCode(ctx, email, randCode); err != nil {
+	if err := a.passRecoverCodeKeeper.KeepPassRecoverCode(ctx, email, code); err != nil {
 		a.logger.Debug("Sending pass recover code error", "email", email, "err", err.Error())
 		return "Error", utils.ErrInternalServer
 	}
 
-	a.logger.Debug("Pass recover code sended", "email", email, "code", randCode)
+	a.logger.Debug("Pass recover code sended", "email", email)
 
 	return "Code sended", nil
 }
 
-func (a *AccountService) PasswordRecover(ctx context.Context, email string, newPassword string, code int) (msg string, err error) {
+func (a *AccountService) PasswordRecover(ctx context.Context, email string, newPassword string, code string) (msg string, err error) {
+
+	a.logger.Debug("Trying to change user's password", "email", email)
 
-	a.logger.Debug("Trying to change user's password", "email", email, "code", code)
+	code = utils_random.NormalizeOTP(code)
 
 	if email == "" {
 		a.logger.Debug("Changing user's password error", "email", email, "err", utils.ErrEmptyEmail)
@@ -199,22 +262,73 @@ func (a *AccountService) PasswordRecover(ctx context.Context, email string, newP
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	if code == 0 {
+	if code == "" {
 		a.logger.Debug("Changing user's password error", "email", email, "err", utils.ErrWrongPasswordRecoverCode)
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	sendedCode, err := a.passRecoverCodeGetter.GetPassRecoverCode(ctx, email)
+	if err := a.consumeCode(ctx, models.CodePurposePassRecover, email, code); err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+		return "Error", err
+	}
+
+	newPassHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
-		if err == utils.ErrPassRecoverCodeNotFound {
-			return "Error", utils.ErrInvalidCredentials
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := a.passChanger.ChangePassword(ctx, email, newPassHash); err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+		if err == utils.ErrUserNotFound {
+			return "Error", err
 		}
 		return "Error", utils.ErrInternalServer
 	}
 
-	if sendedCode != code {
-		a.logger.Debug("Changing user's password error", "email", email, "err", utils.ErrWrongPasswordRecoverCode)
+	user, err := a.userGetter.GetUserByEmail(ctx, email)
+	if err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	// tokens issued with the old password must stop working
+	if err := a.tokenVersionBumper.BumpTokenVersion(ctx, user.Id); err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("User's password changed succsefully", "email", email)
+
+	return "Success", nil
+}
+
+// ChangePassword replaces the password of the token owner, the current password is checked in place of
+// an emailed code. revokeOthers ends all other sessions of the user and forgets the trusted devices,
+// the user is notified by email
+func (a *AccountService) ChangePassword(ctx context.Context, tokenString string, currentPassword string, newPassword string, revokeOthers bool) (msg string, err error) {
+
+	a.logger.Debug("Trying to change user's password by token")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Changing user's password error", "err", err.Error())
+		return "Error", err
+	}
+
+	if currentPassword == "" || newPassword == "" {
+		a.logger.Debug("Changing user's password error", "email", email, "err", utils.ErrEmptyPassword)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(currentPassword)); err != nil {
+		a.logger.Debug("Changing user's password error", "email", email, "err", "invalid password (not null)")
 		return "Error", utils.ErrInvalidCredentials
 	}
 
@@ -224,15 +338,577 @@ func (a *AccountService) PasswordRecover(ctx context.Context, email string, newP
 		return "Error", utils.ErrInternalServer
 	}
 
-	if err := a.passChanger.ChangePassword(ctx, email, newPassHash); err != nil {
+	if err := a.passChanger.ChangePassword(ctx, user.Email, newPassHash); err != nil {
 		a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
-		if err == utils.ErrUserNotFound {
+		return "Error", utils.ErrInternalServer
+	}
+
+	// a recover code sent before the change would set the password back
+	if err := a.codeDropper.DropCode(ctx, models.CodePurposePassRecover, user.Email); err != nil {
+		a.logger.Warn("Dropping pass recover code error", "uid", uid, "err", err.Error())
+	}
+
+	if revokeOthers {
+		if _, err := a.otherSessionsRevoker.RevokeOtherSessions(ctx, tokenString); err != nil {
+			a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+			return "Error", utils.ErrInternalServer
+		}
+
+		if err := a.forgetTrustedDevices(ctx, uid); err != nil {
+			a.logger.Debug("Changing user's password error", "email", email, "err", err.Error())
+			return "Error", utils.ErrInternalServer
+		}
+	}
+
+	a.notifySecurityEvent(ctx, user, models.SecurityEventPasswordChanged)
+
+	a.logger.Debug("User's password changed succsefully", "email", email, "revoke_others", revokeOthers)
+
+	return "Success", nil
+}
+
+// TwoFASettingsSendCode emails the code that confirms Enable2FA or Disable2FA
+func (a *AccountService) TwoFASettingsSendCode(ctx context.Context, tokenString string) (msg string, err error) {
+
+	a.logger.Debug("Trying to send 2FA settings code")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Sending 2FA settings code error", "err", err.Error())
+		return "Error", err
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Sending 2FA settings code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := a.codeSendLimiter.Reserve(ctx, models.CodePurposeTwoFASettings, email); err != nil {
+		a.logger.Debug("Sending 2FA settings code error", "email", email, "err", err.Error())
+		return "Error", err
+	}
+
+	code, formattedCode, err := utils_random.NewOTP(a.codeFormats.TwoFA)
+	if err != nil {
+		a.logger.Debug("Sending 2FA settings code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.codeDeliverer.DeliverCode(ctx, user, models.CodeMessage{Purpose: models.CodePurposeTwoFASettings, Code: formattedCode})
+
+	if err := a.twoFASettingsCodeKeeper.KeepTwoFASettingsCode(ctx, email, code); err != nil {
+		a.logger.Debug("Sending 2FA settings code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("2FA settings code sended", "email", email)
+
+	return "Code sended", nil
+}
+
+// Enable2FA turns on emailed 2FA codes, code is the one sent by TwoFASettingsSendCode.
+// Recovery codes are returned (the only time they are shown) when it is the first second factor of the user
+func (a *AccountService) Enable2FA(ctx context.Context, tokenString string, code string) (msg string, recoveryCodes []string, err error) {
+
+	a.logger.Debug("Trying to enable 2FA")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Enabling 2FA error", "err", err.Error())
+		return "Error", nil, err
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Enabling 2FA error", "email", email, "err", err.Error())
+		return "Error", nil, utils.ErrInternalServer
+	}
+
+	if user.Use2FA {
+		a.logger.Debug("Enabling 2FA error", "email", email, "err", utils.ErrTwoFAAlreadyEnabled)
+		return "Error", nil, utils.ErrTwoFAAlreadyEnabled
+	}
+
+	if err := a.checkTwoFASettingsCode(ctx, email, code); err != nil {
+		a.logger.Debug("Enabling 2FA error", "email", email, "err", err.Error())
+		return "Error", nil, err
+	}
+
+	if err := a.twoFASetter.SetUse2FA(ctx, uid, true); err != nil {
+		a.logger.Debug("Enabling 2FA error", "email", email, "err", err.Error())
+		return "Error", nil, utils.ErrInternalServer
+	}
+
+	if !user.TOTPEnabled {
+		recoveryCodes, err = a.recoveryCodes.Generate(ctx, uid)
+		if err != nil {
+			a.logger.Debug("Enabling 2FA error", "email", email, "err", err.Error())
+			return "Error", nil, utils.ErrInternalServer
+		}
+	}
+
+	a.logger.Debug("2FA enabled", "email", email)
+
+	return "Success", recoveryCodes, nil
+}
+
+// Disable2FA turns off every second factor, it needs the password and a current second factor:
+// authenticator code when TOTP is enabled, code sent by TwoFASettingsSendCode otherwise
+func (a *AccountService) Disable2FA(ctx context.Context, tokenString string, password string, code string) (msg string, err error) {
+
+	a.logger.Debug("Trying to disable 2FA")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Disabling 2FA error", "err", err.Error())
+		return "Error", err
+	}
+
+	if password == "" {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", utils.ErrEmptyPassword)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if !user.Use2FA && !user.TOTPEnabled {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", utils.ErrTwoFANotEnabled)
+		return "Error", utils.ErrTwoFANotEnabled
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", "invalid password (not null)")
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if user.TOTPEnabled {
+		// authenticator codes are guessed like emailed ones, so their guesses are limited too
+		err = a.codeAttemptsLimiter.guess(ctx, models.CodePurposeTOTP, email)
+		if err == nil {
+			err = a.totpAuthenticator.Verify(ctx, user, utils_random.NormalizeOTP(code))
+			if err != nil && !errors.Is(err, utils.ErrWrong2FACode) && !errors.Is(err, utils.ErrTOTPCodeReused) {
+				a.logger.Debug("Disabling 2FA error", "email", email, "err", err.Error())
+				return "Error", utils.ErrInternalServer
+			}
+		}
+	} else {
+		err = a.checkTwoFASettingsCode(ctx, email, code)
+	}
+	if err != nil {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", err.Error())
+		if errors.Is(err, utils.ErrTooManyCodeAttempts) || errors.Is(err, utils.ErrInternalServer) {
 			return "Error", err
 		}
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if err := a.twoFASetter.SetUse2FA(ctx, uid, false); err != nil {
+		a.logger.Debug("Disabling 2FA error", "email", email, "err", err.Error())
 		return "Error", utils.ErrInternalServer
 	}
 
-	a.logger.Debug("User's password changed succsefully", "email", email)
+	a.logger.Debug("2FA disabled", "email", email)
+
+	return "Success", nil
+}
+
+// RegenerateRecoveryCodes replaces 2FA recovery codes of the token's user, old codes stop working
+func (a *AccountService) RegenerateRecoveryCodes(ctx context.Context, tokenString string, password string) (recoveryCodes []string, err error) {
+
+	a.logger.Debug("Trying to regenerate recovery codes")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Regenerating recovery codes error", "err", err.Error())
+		return nil, err
+	}
+
+	if password == "" {
+		a.logger.Debug("Regenerating recovery codes error", "email", email, "err", utils.ErrEmptyPassword)
+		return nil, utils.ErrInvalidCredentials
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Regenerating recovery codes error", "email", email, "err", err.Error())
+		return nil, utils.ErrInternalServer
+	}
+
+	if !user.Use2FA && !user.TOTPEnabled {
+		a.logger.Debug("Regenerating recovery codes error", "email", email, "err", utils.ErrTwoFANotEnabled)
+		return nil, utils.ErrTwoFANotEnabled
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		a.logger.Debug("Regenerating recovery codes error", "email", email, "err", "invalid password (not null)")
+		return nil, utils.ErrInvalidCredentials
+	}
+
+	recoveryCodes, err = a.recoveryCodes.Generate(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Regenerating recovery codes error", "email", email, "err", err.Error())
+		return nil, utils.ErrInternalServer
+	}
+
+	a.logger.Debug("Recovery codes regenerated", "email", email)
+
+	return recoveryCodes, nil
+}
+
+// SetCodeChannelSendCode sends the code confirming a new phone of SetCodeChannel to that phone by SMS,
+// the password is checked as codes of the second factor may be redirected there
+func (a *AccountService) SetCodeChannelSendCode(ctx context.Context, tokenString string, password string, phone string) (msg string, err error) {
+
+	a.logger.Debug("Trying to send confirm phone code")
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Sending confirm phone code error", "err", err.Error())
+		return "Error", err
+	}
+
+	if password == "" {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", utils.ErrEmptyPassword)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if phone == "" {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", utils.ErrPhoneRequired)
+		return "Error", utils.ErrPhoneRequired
+	}
+
+	if !phonePattern.MatchString(phone) {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", utils.ErrInvalidPhone)
+		return "Error", utils.ErrInvalidPhone
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", "invalid password (not null)")
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if phone == user.Phone {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", utils.ErrPhoneNotChanged)
+		return "Error", utils.ErrPhoneNotChanged
+	}
+
+	if err := a.codeSendLimiter.Reserve(ctx, models.CodePurposeConfirmPhone, phone); err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", err.Error())
+		return "Error", err
+	}
+
+	code, formattedCode, err := utils_random.NewOTP(a.codeFormats.TwoFA)
+	if err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	recipient := user
+	recipient.Phone = phone
+	if err := a.codeDeliverer.DeliverCode(ctx, recipient, models.CodeMessage{Purpose: models.CodePurposeConfirmPhone, Code: formattedCode}); err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", err.Error())
+		if err == utils.ErrSMSDisabled {
+			return "Error", err
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := a.confirmPhoneCodeKeeper.KeepConfirmPhoneCode(ctx, user.Email, confirmPhoneCode(phone, code)); err != nil {
+		a.logger.Debug("Sending confirm phone code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("Confirm phone code sended", "email", email)
+
+	return "Code sended", nil
+}
+
+// SetCodeChannel sets phone of the token's user and the channel one-time codes go to,
+// the password is asked as codes of the second factor may be redirected. A phone other than
+// the current one needs the code of SetCodeChannelSendCode, the code is ignored otherwise
+func (a *AccountService) SetCodeChannel(ctx context.Context, tokenString string, password string, phone string, channel models.DeliveryChannel, code string) (msg string, err error) {
+
+	a.logger.Debug("Trying to set code channel", "channel", channel)
+
+	code = utils_random.NormalizeOTP(code)
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Setting code channel error", "err", err.Error())
+		return "Error", err
+	}
+
+	if password == "" {
+		a.logger.Debug("Setting code channel error", "email", email, "err", utils.ErrEmptyPassword)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if phone != "" && !phonePattern.MatchString(phone) {
+		a.logger.Debug("Setting code channel error", "email", email, "err", utils.ErrInvalidPhone)
+		return "Error", utils.ErrInvalidPhone
+	}
+
+	switch channel {
+	case models.DeliveryChannelEmail, models.DeliveryChannelWebhook:
+	case models.DeliveryChannelSMS:
+		if phone == "" {
+			a.logger.Debug("Setting code channel error", "email", email, "err", utils.ErrPhoneRequired)
+			return "Error", utils.ErrPhoneRequired
+		}
+	default:
+		a.logger.Debug("Setting code channel error", "email", email, "err", utils.ErrUnknownDeliveryChannel)
+		return "Error", utils.ErrUnknownDeliveryChannel
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Setting code channel error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		a.logger.Debug("Setting code channel error", "email", email, "err", "invalid password (not null)")
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if phone != "" && phone != user.Phone {
+		if code == "" {
+			a.logger.Debug("Setting code channel error", "email", email, "err", utils.ErrWrongCode)
+			return "Error", utils.ErrInvalidCredentials
+		}
+
+		if err := a.consumeCode(ctx, models.CodePurposeConfirmPhone, user.Email, confirmPhoneCode(phone, code)); err != nil {
+			a.logger.Debug("Setting code channel error", "email", email, "err", err.Error())
+			return "Error", err
+		}
+	}
+
+	if err := a.codeChannelSetter.SetCodeChannel(ctx, uid, phone, channel); err != nil {
+		a.logger.Debug("Setting code channel error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("Code channel set", "email", email, "channel", channel)
 
 	return "Success", nil
-}
\ No newline at end of file
+}
+
+// ChangeEmailSendCode sends the code confirming ChangeEmail to the new address, the password is checked
+// as the email is the login identity
+func (a *AccountService) ChangeEmailSendCode(ctx context.Context, tokenString string, password string, newEmail string) (msg string, err error) {
+
+	a.logger.Debug("Trying to send change email code", "new_email", newEmail)
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Sending change email code error", "err", err.Error())
+		return "Error", err
+	}
+
+	if password == "" {
+		a.logger.Debug("Sending change email code error", "email", email, "err", utils.ErrEmptyPassword)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if newEmail == "" {
+		a.logger.Debug("Sending change email code error", "email", email, "err", utils.ErrEmptyEmail)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", "invalid password (not null)")
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if newEmail == user.Email {
+		a.logger.Debug("Sending change email code error", "email", email, "err", utils.ErrEmailNotChanged)
+		return "Error", utils.ErrEmailNotChanged
+	}
+
+	_, err = a.userGetter.GetUserByEmail(ctx, newEmail)
+	if err == nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", utils.ErrUserAlreadyExists)
+		return "Error", utils.ErrUserAlreadyExists
+	}
+	if err != utils.ErrUserNotFound {
+		a.logger.Debug("Sending change email code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := a.codeSendLimiter.Reserve(ctx, models.CodePurposeChangeEmail, newEmail); err != nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", err.Error())
+		return "Error", err
+	}
+
+	code, formattedCode, err := utils_random.NewOTP(a.codeFormats.EmailVerify)
+	if err != nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	recipient := user
+	recipient.Email = newEmail
+	a.codeDeliverer.DeliverCode(ctx, recipient, models.CodeMessage{Purpose: models.CodePurposeChangeEmail, Code: formattedCode})
+
+	if err := a.changeEmailCodeKeeper.KeepChangeEmailCode(ctx, user.Email, changeEmailCode(newEmail, code)); err != nil {
+		a.logger.Debug("Sending change email code error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.logger.Debug("Change email code sended", "email", email, "new_email", newEmail)
+
+	return "Code sended", nil
+}
+
+// ChangeEmail moves the account to newEmail confirmed by the code of ChangeEmailSendCode. Codes pending
+// for the old address are dropped, tokens carry the old email so all of them are revoked and the user
+// logs in again. The old address gets a notice
+func (a *AccountService) ChangeEmail(ctx context.Context, tokenString string, newEmail string, code string) (msg string, err error) {
+
+	a.logger.Debug("Trying to change user's email", "new_email", newEmail)
+
+	code = utils_random.NormalizeOTP(code)
+
+	uid, email, _, err := a.tokenValidator.ValidateToken(ctx, tokenString)
+	if err != nil {
+		a.logger.Debug("Changing user's email error", "err", err.Error())
+		return "Error", err
+	}
+
+	if newEmail == "" {
+		a.logger.Debug("Changing user's email error", "email", email, "err", utils.ErrEmptyEmail)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	if code == "" {
+		a.logger.Debug("Changing user's email error", "email", email, "err", utils.ErrWrongVerificationCode)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		a.logger.Debug("Changing user's email error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := a.consumeCode(ctx, models.CodePurposeChangeEmail, user.Email, changeEmailCode(newEmail, code)); err != nil {
+		a.logger.Debug("Changing user's email error", "email", email, "err", err.Error())
+		return "Error", err
+	}
+
+	if err := a.emailChanger.ChangeEmail(ctx, uid, user.Email, newEmail); err != nil {
+		a.logger.Debug("Changing user's email error", "email", email, "err", err.Error())
+		switch err {
+		case utils.ErrUserAlreadyExists:
+			return "Error", err
+		case utils.ErrUserNotFound:
+			return "Error", utils.ErrInvalidCredentials
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	// codes keyed by the old address must not work for whoever gets it next
+	for _, purpose := range []models.CodePurpose{models.CodePurposeEmailVerify, models.CodePurposePassRecover, models.CodePurposeTwoFASettings, models.CodePurposeConfirmPhone} {
+		if err := a.codeDropper.DropCode(ctx, purpose, user.Email); err != nil {
+			a.logger.Warn("Dropping old email code error", "uid", uid, "purpose", purpose, "err", err.Error())
+		}
+	}
+
+	if err := a.tokenVersionBumper.BumpTokenVersion(ctx, uid); err != nil {
+		a.logger.Debug("Changing user's email error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	a.notifySecurityEvent(ctx, user, models.SecurityEventEmailChanged)
+
+	a.logger.Debug("User's email changed succesfully", "email", email, "new_email", newEmail)
+
+	return "Success", nil
+}
+
+// Helpers
+
+func (a *AccountService) checkTwoFASettingsCode(ctx context.Context, email string, code string) (err error) {
+	code = utils_random.NormalizeOTP(code)
+	if code == "" {
+		return utils.ErrInvalidCredentials
+	}
+
+	return a.consumeCode(ctx, models.CodePurposeTwoFASettings, email, code)
+}
+
+// consumeCode burns the emailed code when it matches, wrong guesses are counted.
+// Returned error is ready for the caller: ErrInvalidCredentials, ErrTooManyCodeAttempts or ErrInternalServer
+func (a *AccountService) consumeCode(ctx context.Context, purpose models.CodePurpose, id string, code string) (err error) {
+	err = a.codeConsumer.ConsumeCode(ctx, purpose, id, code)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, utils.ErrWrongCode):
+		return a.codeAttemptsLimiter.wrongCode(ctx, purpose, id)
+	case errors.Is(err, utils.ErrCodeNotFound):
+		return utils.ErrInvalidCredentials
+	}
+
+	return utils.ErrInternalServer
+}
+
+// forgetTrustedDevices makes every remembered device of the user ask for the second factor again
+func (a *AccountService) forgetTrustedDevices(ctx context.Context, uid int64) (err error) {
+	devices, err := a.trustedDevicesGetter.GetUserTrustedDevices(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if err := a.trustedDeviceRevoker.RevokeTrustedDevice(ctx, uid, device.Id); err != nil && !errors.Is(err, utils.ErrTrustedDeviceNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changeEmailCode binds the code to the new address, so a code sent to one address can't confirm another
+func changeEmailCode(newEmail string, code string) string {
+	return newEmail + "\x00" + code
+}
+
+// confirmPhoneCode binds the code to the new phone, so a code sent to one phone can't confirm another
+func confirmPhoneCode(phone string, code string) string {
+	return phone + "\x00" + code
+}
+
+// notifySecurityEvent tells the user about the change made by the client of ctx,
+// the change is already done, so a failed notice is only logged
+func (a *AccountService) notifySecurityEvent(ctx context.Context, user models.User, event models.SecurityEvent) {
+	clientIP, userAgent := utils_client.FromContext(ctx)
+
+	notice := models.SecurityNotice{
+		Event: event,
+		At: time.Now(),
+		ClientIP: clientIP,
+		UserAgent: userAgent,
+	}
+
+	if err := a.securityNotifier.NotifySecurityEvent(ctx, user, notice); err != nil {
+		a.logger.Warn("Security notice error", "uid", user.Id, "event", event, "err", err.Error())
+	}
+}
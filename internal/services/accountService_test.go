@@ -1,9 +1,15 @@
 package services_test
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
+	"authSAS/internal/models"
+	"authSAS/internal/services"
 	"authSAS/internal/utils"
+	utils_random "authSAS/internal/utils/randomCode"
+	utils_totp "authSAS/internal/utils/totp"
 
 	"github.com/stretchr/testify/require"
 )
@@ -138,12 +144,12 @@ func TestEmailVerify(t *testing.T) {
 
 	// prepare for (case 1) test
 	tester.accService.Register(ctx, "test@mail.ru", "admin")
-	tester.tempStor.KeepEmailVerifyCode(ctx, "test@mail.ru", 1234)
+	tester.tempStor.KeepEmailVerifyCode(ctx, "test@mail.ru", "1234")
 
 	cases := []struct {
 		desc string
 		inEmail string
-		inCode int
+		inCode string
 		outMsg string
 		mustFail bool
 		fail error
@@ -151,14 +157,14 @@ func TestEmailVerify(t *testing.T) {
 		{
 			desc: "case 1 - right verification",
 			inEmail: "test@mail.ru",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Success",
 			mustFail: false,
 		},
 		{
 			desc: "case 2 - wrong email",
 			inEmail: "123@mail.ru",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -166,7 +172,7 @@ func TestEmailVerify(t *testing.T) {
 		{
 			desc: "case 3 - wrong code",
 			inEmail: "test@mail.ru",
-			inCode: 5555,
+			inCode: "5555",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -174,7 +180,7 @@ func TestEmailVerify(t *testing.T) {
 		{
 			desc: "case 4 - empty email",
 			inEmail: "",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -182,7 +188,15 @@ func TestEmailVerify(t *testing.T) {
 		{
 			desc: "case 5 - empty code",
 			inEmail: "test@mail.ru",
-			inCode: 0,
+			inCode: "",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 6 - code already used",
+			inEmail: "test@mail.ru",
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -262,13 +276,14 @@ func TestPasswordRecover(t *testing.T) {
 
 	// prepare for (case 1) test
 	tester.accService.Register(ctx, "test@mail.ru", "admin")
-	tester.tempStor.KeepPassRecoverCode(ctx, "test@mail.ru", 1234)
+	tester.tempStor.KeepPassRecoverCode(ctx, "test@mail.ru", "1234")
+	oldToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
 
 	cases := []struct {
 		desc string
 		inEmail string
 		inNewPassword string
-		inCode int
+		inCode string
 		outMsg string
 		mustFail bool
 		fail error
@@ -277,7 +292,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 1 - right verification",
 			inEmail: "test@mail.ru",
 			inNewPassword: "admin123",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Success",
 			mustFail: false,
 		},
@@ -285,7 +300,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 2 - wrong email",
 			inEmail: "123@mail.ru",
 			inNewPassword: "admin123",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -294,7 +309,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 2 - wrong code",
 			inEmail: "test@mail.ru",
 			inNewPassword: "admin123",
-			inCode: 5555,
+			inCode: "5555",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -303,7 +318,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 3 - empty email",
 			inEmail: "",
 			inNewPassword: "admin123",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -312,7 +327,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 3 - empty email",
 			inEmail: "test@mail.ru",
 			inNewPassword: "",
-			inCode: 1234,
+			inCode: "1234",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -321,7 +336,7 @@ func TestPasswordRecover(t *testing.T) {
 			desc: "case 4 - empty code",
 			inEmail: "test@mail.ru",
 			inNewPassword: "admin123",
-			inCode: 0,
+			inCode: "",
 			outMsg: "Error",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
@@ -339,4 +354,985 @@ func TestPasswordRecover(t *testing.T) {
 			require.Equal(t, tC.outMsg, msg)
 		}
 	}
-}
\ No newline at end of file
+
+	// tokens issued before password recovery are invalidated
+	_, _, _, err := tester.sesService.ValidateToken(ctx, oldToken)
+	require.ErrorIs(t, err, utils.ErrJWTRevoked)
+
+	// the code is burnt by the successful recovery
+	_, err = tester.accService.PasswordRecover(ctx, "test@mail.ru", "hacked", "1234")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+}
+
+func TestPasswordRecoverCodeFormat(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+
+	_, err := tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+	require.NoError(t, err)
+
+	format := tester.codeFormats.PassRecover
+
+	code, _ := tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+	require.Len(t, code, format.Length)
+	require.NotEqual(t, byte('0'), code[0], "numeric code must survive int32 proto fields")
+
+	_, err = strconv.Atoi(code)
+	require.NoError(t, err)
+
+	// code is accepted as the user saw it in the email: grouped, with spaces around
+	typed := " " + code[:format.GroupSize] + "-" + code[format.GroupSize:] + " "
+
+	msg, err := tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", typed)
+	require.NoError(t, err)
+	require.Equal(t, "Success", msg)
+}
+
+func TestPasswordRecoverAttemptsLimit(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	tester.tempStor.KeepPassRecoverCode(ctx, "test@mail.ru", "1234")
+
+	maxAttempts := tester.cfg.TempStorage.CodeMaxAttempts
+
+	for i := 1; i < maxAttempts; i++ {
+		_, err := tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", strconv.Itoa(1000 + i))
+		require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+	}
+
+	// the last allowed guess drops the code
+	_, err := tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", "5555")
+	require.ErrorIs(t, err, utils.ErrTooManyCodeAttempts)
+
+	_, err = tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", "1234")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// new code starts with no failed attempts
+	tester.tempStor.KeepPassRecoverCode(ctx, "test@mail.ru", "4321")
+
+	_, err = tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", "5555")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	msg, err := tester.accService.PasswordRecover(ctx, "test@mail.ru", "admin123", "4321")
+	require.NoError(t, err)
+	require.Equal(t, "Success", msg)
+}
+
+func TestChangePassword(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing sessions of two devices
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	laptopCtx := clientContext(ctx, "10.0.0.1", "laptop")
+	laptopToken,_,_,_,_ := tester.sesService.Login(laptopCtx, "test@mail.ru", "admin")
+	phoneToken,_,_,_,_ := tester.sesService.Login(clientContext(ctx, "10.0.0.2", "phone"), "test@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		inToken string
+		inCurrentPassword string
+		inNewPassword string
+		inRevokeOthers bool
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - invalid token",
+			inToken: "invalid",
+			inCurrentPassword: "admin",
+			inNewPassword: "admin2",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - wrong current password",
+			inToken: laptopToken,
+			inCurrentPassword: "wrong",
+			inNewPassword: "admin2",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - empty new password",
+			inToken: laptopToken,
+			inCurrentPassword: "admin",
+			inNewPassword: "",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 4 - right change, other sessions kept",
+			inToken: laptopToken,
+			inCurrentPassword: "admin",
+			inNewPassword: "admin2",
+			inRevokeOthers: false,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 5 - right change, other sessions revoked",
+			inToken: laptopToken,
+			inCurrentPassword: "admin2",
+			inNewPassword: "admin3",
+			inRevokeOthers: true,
+			outMsg: "Success",
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		noticesBefore := len(tester.securityNotifier.Notices)
+		tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+
+		msg, err := tester.accService.ChangePassword(laptopCtx, tC.inToken, tC.inCurrentPassword, tC.inNewPassword, tC.inRevokeOthers)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+
+			_,_,_,_, err = tester.sesService.Login(ctx, "test@mail.ru", tC.inCurrentPassword)
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials, tC.desc)
+			_,_,_,_, err = tester.sesService.Login(ctx, "test@mail.ru", tC.inNewPassword)
+			require.NoError(t, err, tC.desc)
+
+			// the session that changed the password always stays
+			_,_,_, err = tester.sesService.ValidateToken(ctx, laptopToken)
+			require.NoError(t, err, tC.desc)
+			_,_,_, err = tester.sesService.ValidateToken(ctx, phoneToken)
+			if tC.inRevokeOthers {
+				require.ErrorIs(t, err, utils.ErrJWTRevoked, tC.desc)
+			} else {
+				require.NoError(t, err, tC.desc)
+			}
+
+			// recover code sent before the change can't set the password back
+			_, err = tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+			require.ErrorIs(t, err, utils.ErrCodeNotFound, tC.desc)
+
+			require.Len(t, tester.securityNotifier.Notices, noticesBefore + 1, tC.desc)
+			sent := tester.securityNotifier.Notices[noticesBefore]
+			require.Equal(t, "test@mail.ru", sent.User.Email)
+			require.Equal(t, models.SecurityEventPasswordChanged, sent.Notice.Event)
+			require.Equal(t, "10.0.0.1", sent.Notice.ClientIP)
+			require.Equal(t, "laptop", sent.Notice.UserAgent)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+			require.Len(t, tester.securityNotifier.Notices, noticesBefore, tC.desc)
+
+			_, err = tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+			require.NoError(t, err, tC.desc)
+		}
+	}
+}
+
+func TestTrustedDeviceAfterChangePassword(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	cases := []struct {
+		desc string
+		inEmail string
+		inRevokeOthers bool
+		outMsg string
+	}{
+		{
+			desc: "case 1 - other sessions kept, device stays trusted",
+			inEmail: "test@mail.ru",
+			inRevokeOthers: false,
+			outMsg: "Authorized",
+		},
+		{
+			desc: "case 2 - other sessions revoked, device is forgotten",
+			inEmail: "test2@mail.ru",
+			inRevokeOthers: true,
+			outMsg: "2FA code sended",
+		},
+	}
+
+	for _, tC := range cases {
+		tester.accService.Register(ctx, tC.inEmail, "admin")
+		user := tester.permStor.UsersStorage[tC.inEmail]
+		user.Use2FA = true
+		tester.permStor.UsersStorage[tC.inEmail] = user
+
+		_, _, challengeId, _, _ := tester.sesService.Login(ctx, tC.inEmail, "admin")
+		code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+		accessToken, _, deviceTrustToken, err := tester.sesService.LoginWith2FACode(ctx, challengeId, code, true)
+		require.NoError(t, err, tC.desc)
+
+		_, err = tester.accService.ChangePassword(ctx, accessToken, "admin", "admin2", tC.inRevokeOthers)
+		require.NoError(t, err, tC.desc)
+
+		_, _, _, msg, err := tester.sesService.Login(trustedContext(ctx, deviceTrustToken), tC.inEmail, "admin2")
+		require.NoError(t, err, tC.desc)
+		require.Equal(t, tC.outMsg, msg, tC.desc)
+	}
+}
+
+func TestEnable2FA(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// prepare for (case 1) test
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	msg, err := tester.accService.TwoFASettingsSendCode(ctx, token)
+	require.NoError(t, err)
+	require.Equal(t, "Code sended", msg)
+	code, _ := tester.tempStor.GetTwoFASettingsCode(ctx, "test@mail.ru")
+
+	cases := []struct {
+		desc string
+		inToken string
+		inCode string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - wrong code",
+			inToken: token,
+			inCode: wrongCodeOf(code),
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - invalid token",
+			inToken: "invalid",
+			inCode: code,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - right code",
+			inToken: token,
+			inCode: code,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - enable again",
+			inToken: token,
+			inCode: code,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrTwoFAAlreadyEnabled,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, recoveryCodes, err := tester.accService.Enable2FA(ctx, tC.inToken, tC.inCode)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Len(t, recoveryCodes, 10)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Empty(t, recoveryCodes)
+		}
+		require.Equal(t, tC.outMsg, msg)
+	}
+
+	user, _ := tester.permStor.GetUserByEmail(ctx, "test@mail.ru")
+	require.True(t, user.Use2FA)
+
+	_, _, _, msg, err = tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+	require.Equal(t, "2FA code sended", msg)
+}
+
+func TestDisable2FA(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// prepare for emailed 2FA cases
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	tester.tempStor.KeepTwoFASettingsCode(ctx, "test@mail.ru", "1234")
+	tester.accService.Enable2FA(ctx, token, "1234")
+	tester.tempStor.KeepTwoFASettingsCode(ctx, "test@mail.ru", "4321")
+
+	// prepare for TOTP cases
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	totpToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+	secret, _, _, _ := tester.sesService.EnrollTOTP(ctx, totpToken, false)
+	waitForFreshTOTPStep()
+	step := utils_totp.Step(time.Now())
+	confirmCode, _ := utils_totp.Code(secret, step - 1)
+	tester.sesService.ConfirmTOTP(ctx, totpToken, confirmCode)
+	totpCode, _ := utils_totp.Code(secret, step)
+
+	// prepare for (case 7) test
+	tester.accService.Register(ctx, "test3@mail.ru", "admin")
+	no2FAToken,_,_,_,_ := tester.sesService.Login(ctx, "test3@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		inToken string
+		inPassword string
+		inCode string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - wrong password",
+			inToken: token,
+			inPassword: "wrong",
+			inCode: "4321",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - wrong code",
+			inToken: token,
+			inPassword: "admin",
+			inCode: "5555",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - right password and emailed code",
+			inToken: token,
+			inPassword: "admin",
+			inCode: "4321",
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - replayed TOTP code of confirmation",
+			inToken: totpToken,
+			inPassword: "admin",
+			inCode: confirmCode,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 5 - emailed code instead of TOTP one",
+			inToken: totpToken,
+			inPassword: "admin",
+			inCode: "4321",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 6 - right password and TOTP code",
+			inToken: totpToken,
+			inPassword: "admin",
+			inCode: totpCode,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 7 - 2FA is not enabled",
+			inToken: no2FAToken,
+			inPassword: "admin",
+			inCode: "4321",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrTwoFANotEnabled,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.accService.Disable2FA(ctx, tC.inToken, tC.inPassword, tC.inCode)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+		}
+		require.Equal(t, tC.outMsg, msg)
+	}
+
+	user, _ := tester.permStor.GetUserByEmail(ctx, "test@mail.ru")
+	require.False(t, user.Use2FA)
+
+	totpUser, _ := tester.permStor.GetUserByEmail(ctx, "test2@mail.ru")
+	require.False(t, totpUser.TOTPEnabled)
+	require.Empty(t, totpUser.TOTPSecret)
+
+	_, _, _, msg, _ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+	require.Equal(t, "Authorized", msg)
+}
+
+func TestDisable2FATOTPAttempts(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	secret, _, _, _ := tester.sesService.EnrollTOTP(ctx, token, false)
+	waitForFreshTOTPStep()
+	step := utils_totp.Step(time.Now())
+	confirmCode, _ := utils_totp.Code(secret, step - 1)
+	_, _, err := tester.sesService.ConfirmTOTP(ctx, token, confirmCode)
+	require.NoError(t, err)
+	totpCode, _ := utils_totp.Code(secret, step)
+
+	for i := 0; i < tester.cfg.TempStorage.CodeMaxAttempts; i++ {
+		_, err = tester.accService.Disable2FA(ctx, token, "admin", wrongCodeOf(totpCode))
+		require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+	}
+
+	// guesses are used up, even the right code is refused
+	msg, err := tester.accService.Disable2FA(ctx, token, "admin", totpCode)
+	require.ErrorIs(t, err, utils.ErrTooManyCodeAttempts)
+	require.Equal(t, "Error", msg)
+
+	user, _ := tester.permStor.GetUserByEmail(ctx, "test@mail.ru")
+	require.True(t, user.TOTPEnabled)
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// prepare for (case 1) test
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	tester.tempStor.KeepTwoFASettingsCode(ctx, "test@mail.ru", "1234")
+	_, oldCodes, _ := tester.accService.Enable2FA(ctx, token, "1234")
+
+	// prepare for (case 3) test
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	no2FAToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		inToken string
+		inPassword string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - right password",
+			inToken: token,
+			inPassword: "admin",
+			mustFail: false,
+		},
+		{
+			desc: "case 2 - wrong password",
+			inToken: token,
+			inPassword: "wrong",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - 2FA is not enabled",
+			inToken: no2FAToken,
+			inPassword: "admin",
+			mustFail: true,
+			fail: utils.ErrTwoFANotEnabled,
+		},
+	}
+
+	for _, tC := range cases {
+		recoveryCodes, err := tester.accService.RegenerateRecoveryCodes(ctx, tC.inToken, tC.inPassword)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Len(t, recoveryCodes, 10)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Empty(t, recoveryCodes)
+		}
+	}
+
+	// old codes stop working
+	_, _, challengeId, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	_, _, _, err := tester.sesService.LoginWith2FACode(ctx, challengeId, oldCodes[0], false)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+}
+
+func TestSetCodeChannel(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	sendCases := []struct {
+		desc string
+		inPassword string
+		inPhone string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "send case 1 - wrong password",
+			inPassword: "wrong",
+			inPhone: "+79991234567",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "send case 2 - empty phone",
+			inPassword: "admin",
+			inPhone: "",
+			mustFail: true,
+			fail: utils.ErrPhoneRequired,
+		},
+		{
+			desc: "send case 3 - phone is not E.164",
+			inPassword: "admin",
+			inPhone: "8 999 123-45-67",
+			mustFail: true,
+			fail: utils.ErrInvalidPhone,
+		},
+		{
+			desc: "send case 4 - right phone",
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range sendCases {
+		msg, err := tester.accService.SetCodeChannelSendCode(ctx, token, tC.inPassword, tC.inPhone)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, "Code sended", msg)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, "Error", msg)
+		}
+	}
+
+	// the code proves the phone, so it goes there by sms only
+	code, ok := tester.smsChannel.LastCode("test@mail.ru", models.CodePurposeConfirmPhone)
+	require.True(t, ok)
+	require.Equal(t, "+79991234567", tester.smsChannel.Sent[len(tester.smsChannel.Sent) - 1].User.Phone)
+	_, ok = tester.emailChannel.LastCode("test@mail.ru", models.CodePurposeConfirmPhone)
+	require.False(t, ok)
+
+	cases := []struct {
+		desc string
+		inToken string
+		inPassword string
+		inPhone string
+		inChannel models.DeliveryChannel
+		inCode string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - invalid token",
+			inToken: "invalid",
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - wrong password",
+			inToken: token,
+			inPassword: "wrong",
+			inPhone: "+79991234567",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - phone is not E.164",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "8 999 123-45-67",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidPhone,
+		},
+		{
+			desc: "case 4 - unknown channel",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			inChannel: "pigeon",
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrUnknownDeliveryChannel,
+		},
+		{
+			desc: "case 5 - sms without phone",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "",
+			inChannel: models.DeliveryChannelSMS,
+			mustFail: true,
+			fail: utils.ErrPhoneRequired,
+		},
+		{
+			desc: "case 6 - new phone without code",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: "",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 7 - code of another phone",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "+79997654321",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 8 - right sms channel",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			inChannel: models.DeliveryChannelSMS,
+			inCode: code,
+			mustFail: false,
+		},
+		{
+			desc: "case 9 - confirmed phone needs no code",
+			inToken: token,
+			inPassword: "admin",
+			inPhone: "+79991234567",
+			inChannel: models.DeliveryChannelWebhook,
+			inCode: "",
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.accService.SetCodeChannel(ctx, tC.inToken, tC.inPassword, tC.inPhone, tC.inChannel, tC.inCode)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, "Success", msg)
+
+			user := tester.permStor.UsersStorage["test@mail.ru"]
+			require.Equal(t, tC.inPhone, user.Phone)
+			require.Equal(t, tC.inChannel, user.PreferredChannel)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, "Error", msg)
+		}
+	}
+
+	// the code is used once
+	_, err := tester.accService.SetCodeChannel(ctx, token, "admin", "", models.DeliveryChannelEmail, "")
+	require.NoError(t, err)
+	_, err = tester.accService.SetCodeChannel(ctx, token, "admin", "+79991234567", models.DeliveryChannelSMS, code)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+}
+
+func TestCodeDelivery(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	// email is the default channel
+	tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+	sent, ok := tester.emailChannel.LastCode("test@mail.ru", models.CodePurposePassRecover)
+	require.True(t, ok)
+	kept, _ := tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+	require.Equal(t, kept, utils_random.NormalizeOTP(sent))
+
+	_, err := tester.accService.SetCodeChannelSendCode(ctx, token, "admin", "+79991234567")
+	require.NoError(t, err)
+	code, _ := tester.smsChannel.LastCode("test@mail.ru", models.CodePurposeConfirmPhone)
+	_, err = tester.accService.SetCodeChannel(ctx, token, "admin", "+79991234567", models.DeliveryChannelSMS, code)
+	require.NoError(t, err)
+
+	tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+	sent, ok = tester.smsChannel.LastCode("test@mail.ru", models.CodePurposePassRecover)
+	require.True(t, ok)
+	kept, _ = tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+	require.Equal(t, kept, utils_random.NormalizeOTP(sent))
+	require.Equal(t, "+79991234567", tester.smsChannel.Sent[len(tester.smsChannel.Sent) - 1].User.Phone)
+
+	// email verify code proves the address, it never goes by sms
+	tester.accService.EmailVerifySendCode(ctx, "test@mail.ru")
+	_, ok = tester.emailChannel.LastCode("test@mail.ru", models.CodePurposeEmailVerify)
+	require.True(t, ok)
+	_, ok = tester.smsChannel.LastCode("test@mail.ru", models.CodePurposeEmailVerify)
+	require.False(t, ok)
+
+	// channel that is not configured falls back to email
+	_, err = tester.accService.SetCodeChannel(ctx, token, "admin", "", models.DeliveryChannelWebhook, "")
+	require.NoError(t, err)
+
+	emailsSent := len(tester.emailChannel.Sent)
+	tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+	require.Len(t, tester.emailChannel.Sent, emailsSent + 1)
+}
+
+func TestCodeSendLimits(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	limit := services.SendLimit{Cooldown: time.Minute, DailyQuota: 2}
+	codeSendLimiter := services.NewCodeSendLimiter(tester.logger, services.CodeSendLimits{EmailVerify: limit, PassRecover: limit}, tester.tempStor)
+	accService := services.NewAccountService(tester.logger, tester.cfg.JWTTokenTTL, tester.sesService, tester.sesService, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.codeAttemptsLimiter, codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.securityNotifier, tester.permStor, tester.tempStor)
+
+	accService.Register(ctx, "test@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		send func() (string, error)
+		skipCooldown bool
+		mustFail bool
+		fail error
+		maxRetryAfter time.Duration
+	}{
+		{
+			desc: "case 1 - first code",
+			send: func() (string, error) { return accService.EmailVerifySendCode(ctx, "test@mail.ru") },
+			mustFail: false,
+		},
+		{
+			desc: "case 2 - resend within cooldown",
+			send: func() (string, error) { return accService.EmailVerifySendCode(ctx, "test@mail.ru") },
+			mustFail: true,
+			fail: utils.ErrCodeSendCooldown,
+			maxRetryAfter: time.Minute,
+		},
+		{
+			desc: "case 3 - another purpose has its own limits",
+			send: func() (string, error) { return accService.PasswordRecoverSendCode(ctx, "test@mail.ru") },
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - resend after cooldown",
+			send: func() (string, error) { return accService.EmailVerifySendCode(ctx, "test@mail.ru") },
+			skipCooldown: true,
+			mustFail: false,
+		},
+		{
+			desc: "case 5 - daily quota used up",
+			send: func() (string, error) { return accService.EmailVerifySendCode(ctx, "test@mail.ru") },
+			skipCooldown: true,
+			mustFail: true,
+			fail: utils.ErrCodeSendQuotaExceeded,
+			maxRetryAfter: 24 * time.Hour,
+		},
+	}
+
+	for _, tC := range cases {
+		if tC.skipCooldown {
+			skipCodeSendCooldowns(tester)
+		}
+
+		sentBefore := len(tester.emailChannel.Sent)
+
+		msg, err := tC.send()
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, "Code sended", msg)
+			require.Len(t, tester.emailChannel.Sent, sentBefore + 1, tC.desc)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, "Error", msg)
+			require.Len(t, tester.emailChannel.Sent, sentBefore, tC.desc)
+
+			var retryErr *utils.RetryAfterError
+			require.ErrorAs(t, err, &retryErr, tC.desc)
+			require.Greater(t, retryErr.RetryAfter, tC.maxRetryAfter - time.Minute, tC.desc)
+			require.LessOrEqual(t, retryErr.RetryAfter, tC.maxRetryAfter, tC.desc)
+		}
+	}
+}
+
+// skipCodeSendCooldowns ends cooldowns of all recipients as if they had waited
+func skipCodeSendCooldowns(tester *Tester) {
+	tester.tempStor.Lock()
+	defer tester.tempStor.Unlock()
+
+	for _, sends := range tester.tempStor.CodeSendStorage {
+		sends.CooldownUntil = time.Now()
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	tester.accService.Register(ctx, "taken@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	// codes pending for the old address
+	tester.accService.EmailVerifySendCode(ctx, "test@mail.ru")
+	tester.accService.PasswordRecoverSendCode(ctx, "test@mail.ru")
+
+	sendCases := []struct {
+		desc string
+		inToken string
+		inPassword string
+		inNewEmail string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - invalid token",
+			inToken: "invalid",
+			inPassword: "admin",
+			inNewEmail: "new@mail.ru",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - wrong password",
+			inToken: token,
+			inPassword: "wrong",
+			inNewEmail: "new@mail.ru",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - the current email",
+			inToken: token,
+			inPassword: "admin",
+			inNewEmail: "test@mail.ru",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrEmailNotChanged,
+		},
+		{
+			desc: "case 4 - email of another user",
+			inToken: token,
+			inPassword: "admin",
+			inNewEmail: "taken@mail.ru",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrUserAlreadyExists,
+		},
+		{
+			desc: "case 5 - right sending",
+			inToken: token,
+			inPassword: "admin",
+			inNewEmail: "new@mail.ru",
+			outMsg: "Code sended",
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range sendCases {
+		msg, err := tester.accService.ChangeEmailSendCode(ctx, tC.inToken, tC.inPassword, tC.inNewEmail)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+
+			// the code goes to the new address only
+			_, ok := tester.emailChannel.LastCode(tC.inNewEmail, models.CodePurposeChangeEmail)
+			require.True(t, ok, tC.desc)
+			_, ok = tester.emailChannel.LastCode("test@mail.ru", models.CodePurposeChangeEmail)
+			require.False(t, ok, tC.desc)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+		}
+	}
+
+	code, _ := tester.emailChannel.LastCode("new@mail.ru", models.CodePurposeChangeEmail)
+
+	cases := []struct {
+		desc string
+		inNewEmail string
+		inCode string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - code of another address",
+			inNewEmail: "other@mail.ru",
+			inCode: code,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - wrong code",
+			inNewEmail: "new@mail.ru",
+			inCode: wrongCodeOf(code),
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - right change",
+			inNewEmail: "new@mail.ru",
+			inCode: code,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - token issued for the old email",
+			inNewEmail: "new@mail.ru",
+			inCode: code,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrJWTRevoked,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.accService.ChangeEmail(ctx, token, tC.inNewEmail, tC.inCode)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+
+			_, ok := tester.permStor.UsersStorage["test@mail.ru"]
+			require.False(t, ok)
+			user, ok := tester.permStor.UsersStorage[tC.inNewEmail]
+			require.True(t, ok)
+			require.True(t, user.IsVerified)
+
+			_,_,_,_, err = tester.sesService.Login(ctx, "test@mail.ru", "admin")
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+			_,_,_,_, err = tester.sesService.Login(ctx, tC.inNewEmail, "admin")
+			require.NoError(t, err)
+
+			_, err = tester.tempStor.GetEmailVerifyCode(ctx, "test@mail.ru")
+			require.ErrorIs(t, err, utils.ErrCodeNotFound)
+			_, err = tester.tempStor.GetPassRecoverCode(ctx, "test@mail.ru")
+			require.ErrorIs(t, err, utils.ErrCodeNotFound)
+
+			// the notice goes to the old address
+			require.Len(t, tester.securityNotifier.Notices, 1)
+			require.Equal(t, "test@mail.ru", tester.securityNotifier.Notices[0].User.Email)
+			require.Equal(t, models.SecurityEventEmailChanged, tester.securityNotifier.Notices[0].Notice.Event)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Equal(t, tC.outMsg, msg)
+		}
+	}
+}
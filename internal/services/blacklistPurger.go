@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// BlacklistPurger periodically removes logged out tokens which are already expired
+type BlacklistPurger struct {
+	logger *slog.Logger
+	interval time.Duration
+	logoutJWTPurger LogoutJWTPurger
+}
+
+func NewBlacklistPurger(logger *slog.Logger, interval time.Duration, permanentStorage PermanentStorage) *BlacklistPurger {
+	return &BlacklistPurger{
+		logger: logger,
+		interval: interval,
+		logoutJWTPurger: permanentStorage,
+	}
+}
+
+// Run purges blacklist every interval until ctx is canceled
+func (p *BlacklistPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Purge(ctx)
+		}
+	}
+}
+
+func (p *BlacklistPurger) Purge(ctx context.Context) (purged int64, err error) {
+
+	start := time.Now()
+
+	purged, err = p.logoutJWTPurger.PurgeExpiredLogoutJWTs(ctx)
+	if err != nil {
+		p.logger.Error("Blacklist purge error", "err", err.Error())
+		return 0, err
+	}
+
+	p.logger.Debug("Blacklist purged", "purged", purged, "op_time", time.Since(start).Milliseconds())
+
+	return purged, nil
+}
@@ -0,0 +1,38 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"authSAS/internal/services"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlacklistPurge(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing logouted tokens, one of them is already expired
+	tester.permStor.KeepLogoutJWT(ctx, 1, "expired", time.Now().Add(-time.Minute))
+	tester.permStor.KeepLogoutJWT(ctx, 1, "alive", time.Now().Add(time.Minute))
+
+	purger := services.NewBlacklistPurger(tester.logger, time.Hour, tester.permStor)
+
+	purged, err := purger.Purge(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), purged)
+
+	loggedOut, err := tester.permStor.IsJWTLoggedOut(ctx, "expired")
+	require.NoError(t, err)
+	require.False(t, loggedOut)
+
+	loggedOut, err = tester.permStor.IsJWTLoggedOut(ctx, "alive")
+	require.NoError(t, err)
+	require.True(t, loggedOut)
+
+	// nothing left to purge
+	purged, err = purger.Purge(ctx)
+	require.NoError(t, err)
+	require.Zero(t, purged)
+}
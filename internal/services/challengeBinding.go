@@ -0,0 +1,40 @@
+package services
+
+import (
+	"errors"
+
+	"authSAS/internal/models"
+)
+
+// ChallengeBinding tells what of the client that passed the password step has to match
+// when its login challenge is used. The challenge id is a secret anyway, the binding only
+// keeps a leaked id from being used elsewhere; clients switching networks (mobile) need user_agent
+type ChallengeBinding string
+
+const (
+	ChallengeBindingIPAndUserAgent ChallengeBinding = "ip_user_agent"
+	ChallengeBindingUserAgent ChallengeBinding = "user_agent"
+	ChallengeBindingNone ChallengeBinding = "none"
+)
+
+var ErrUnknownChallengeBinding = errors.New("unknown login challenge binding")
+
+func (b ChallengeBinding) Validate() error {
+	switch b {
+	case ChallengeBindingIPAndUserAgent, ChallengeBindingUserAgent, ChallengeBindingNone:
+		return nil
+	}
+
+	return ErrUnknownChallengeBinding
+}
+
+func (b ChallengeBinding) matches(challenge models.LoginChallenge, clientIP string, userAgent string) bool {
+	switch b {
+	case ChallengeBindingNone:
+		return true
+	case ChallengeBindingUserAgent:
+		return challenge.UserAgent == userAgent
+	}
+
+	return challenge.ClientIP == clientIP && challenge.UserAgent == userAgent
+}
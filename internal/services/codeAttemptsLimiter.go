@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+)
+
+// CodeAttemptsLimiter drops an emailed code after maxAttempts wrong guesses,
+// so short codes can't be walked through within code_ttl
+type CodeAttemptsLimiter struct {
+	logger *slog.Logger
+	maxAttempts int64
+	codeAttemptsCounter CodeAttemptsCounter
+	codeDropper CodeDropper
+}
+
+func NewCodeAttemptsLimiter(logger *slog.Logger, maxAttempts int, temporaryStorage TemporaryStorage) *CodeAttemptsLimiter {
+	return &CodeAttemptsLimiter{
+		logger: logger,
+		maxAttempts: int64(maxAttempts),
+		codeAttemptsCounter: temporaryStorage,
+		codeDropper: temporaryStorage,
+	}
+}
+
+// Fail counts a wrong guess of the code. On the last allowed guess the code is dropped
+// and ErrTooManyCodeAttempts is returned, a new code has to be requested then
+func (l *CodeAttemptsLimiter) Fail(ctx context.Context, purpose models.CodePurpose, id string) (err error) {
+	attempts, err := l.codeAttemptsCounter.CountFailedCodeAttempt(ctx, purpose, id)
+	if err != nil {
+		return err
+	}
+
+	if attempts < l.maxAttempts {
+		return nil
+	}
+
+	if err := l.codeDropper.DropCode(ctx, purpose, id); err != nil {
+		return err
+	}
+
+	l.logger.Warn("Code attempts limit reached, code dropped", "purpose", purpose, "attempts", attempts)
+
+	return utils.ErrTooManyCodeAttempts
+}
+
+// wrongCode counts the guess and returns what the service answers to it: ErrInvalidCredentials,
+// ErrTooManyCodeAttempts on the last allowed guess or ErrInternalServer
+func (l *CodeAttemptsLimiter) wrongCode(ctx context.Context, purpose models.CodePurpose, id string) (err error) {
+	err = l.Fail(ctx, purpose, id)
+	switch {
+	case err == nil:
+		return utils.ErrInvalidCredentials
+	case errors.Is(err, utils.ErrTooManyCodeAttempts):
+		return err
+	}
+
+	l.logger.Debug("Counting code attempt error", "purpose", purpose, "err", err.Error())
+
+	return utils.ErrInternalServer
+}
+
+// guess counts a guess of a code that is not kept, like an authenticator app code, before it is checked.
+// There is no code to drop, so guesses past maxAttempts are refused with ErrTooManyCodeAttempts until
+// the count expires
+func (l *CodeAttemptsLimiter) guess(ctx context.Context, purpose models.CodePurpose, id string) (err error) {
+	attempts, err := l.codeAttemptsCounter.CountFailedCodeAttempt(ctx, purpose, id)
+	if err != nil {
+		l.logger.Debug("Counting code attempt error", "purpose", purpose, "err", err.Error())
+		return utils.ErrInternalServer
+	}
+
+	if attempts > l.maxAttempts {
+		l.logger.Warn("Code attempts limit reached", "purpose", purpose, "attempts", attempts)
+		return utils.ErrTooManyCodeAttempts
+	}
+
+	return nil
+}
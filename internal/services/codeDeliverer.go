@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+)
+
+// CodeDeliverer sends one-time codes to the user over one channel (email, SMS, webhook etc.)
+type CodeDeliverer interface {
+	DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) (err error)
+}
+
+// ChannelRouter delivers codes over the user's preferred channel, email is used while that
+// channel is not configured. Email verify and change email codes always go by email as they prove
+// the address, magic links too as they are meant to be opened from the mailbox. Phone confirm codes
+// always go by SMS and never fall back to email, they prove the phone
+type ChannelRouter struct {
+	logger *slog.Logger
+	channels map[models.DeliveryChannel]CodeDeliverer
+}
+
+// NewChannelRouter creates router of the configured channels, the email channel is required
+func NewChannelRouter(logger *slog.Logger, channels map[models.DeliveryChannel]CodeDeliverer) *ChannelRouter {
+	return &ChannelRouter{
+		logger: logger,
+		channels: channels,
+	}
+}
+
+func (r *ChannelRouter) DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) (err error) {
+	channel := user.PreferredChannel
+	switch message.Purpose {
+	case models.CodePurposeEmailVerify, models.CodePurposeChangeEmail, models.CodePurposeMagicLink:
+		channel = models.DeliveryChannelEmail
+	case models.CodePurposeConfirmPhone:
+		channel = models.DeliveryChannelSMS
+	}
+
+	deliverer, ok := r.channels[channel]
+	if !ok && message.Purpose == models.CodePurposeConfirmPhone {
+		return utils.ErrSMSDisabled
+	}
+	if !ok {
+		channel = models.DeliveryChannelEmail
+		deliverer = r.channels[channel]
+	}
+
+	if err := deliverer.DeliverCode(ctx, user, message); err != nil {
+		r.logger.Warn("Code delivery error", "uid", user.Id, "channel", channel, "purpose", message.Purpose, "err", err.Error())
+		return err
+	}
+
+	return nil
+}
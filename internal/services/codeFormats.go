@@ -0,0 +1,10 @@
+package services
+
+import utils_random "authSAS/internal/utils/randomCode"
+
+// CodeFormats of emailed one-time codes per purpose, TwoFA is for login and 2FA settings codes
+type CodeFormats struct {
+	TwoFA utils_random.OTPFormat
+	EmailVerify utils_random.OTPFormat
+	PassRecover utils_random.OTPFormat
+}
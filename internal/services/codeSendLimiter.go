@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+)
+
+// SendLimit of one code purpose
+type SendLimit struct {
+	Cooldown time.Duration
+	DailyQuota int
+}
+
+// CodeSendLimits per purpose, TwoFA is for login codes
+type CodeSendLimits struct {
+	TwoFA SendLimit
+	TwoFASettings SendLimit
+	EmailVerify SendLimit
+	PassRecover SendLimit
+	ChangeEmail SendLimit
+	ConfirmPhone SendLimit
+	MagicLink SendLimit
+}
+
+func (l CodeSendLimits) of(purpose models.CodePurpose) SendLimit {
+	switch purpose {
+	case models.CodePurposeTwoFA:
+		return l.TwoFA
+	case models.CodePurposeTwoFASettings:
+		return l.TwoFASettings
+	case models.CodePurposeEmailVerify:
+		return l.EmailVerify
+	case models.CodePurposePassRecover:
+		return l.PassRecover
+	case models.CodePurposeChangeEmail:
+		return l.ChangeEmail
+	case models.CodePurposeConfirmPhone:
+		return l.ConfirmPhone
+	case models.CodePurposeMagicLink:
+		return l.MagicLink
+	}
+
+	return SendLimit{}
+}
+
+// CodeSendLimiter keeps a recipient from being flooded with codes: after a send the next one waits
+// for the cooldown, and only daily quota of sends is allowed within 24h
+type CodeSendLimiter struct {
+	logger *slog.Logger
+	limits CodeSendLimits
+	codeSendReserver CodeSendReserver
+}
+
+func NewCodeSendLimiter(logger *slog.Logger, limits CodeSendLimits, temporaryStorage TemporaryStorage) *CodeSendLimiter {
+	return &CodeSendLimiter{
+		logger: logger,
+		limits: limits,
+		codeSendReserver: temporaryStorage,
+	}
+}
+
+// Reserve counts a send of the purpose's code to the recipient (the email). Over the limits it is
+// *utils.RetryAfterError with ErrCodeSendCooldown or ErrCodeSendQuotaExceeded, otherwise ErrInternalServer
+func (l *CodeSendLimiter) Reserve(ctx context.Context, purpose models.CodePurpose, recipient string) (err error) {
+	limit := l.limits.of(purpose)
+
+	retryAfter, err := l.codeSendReserver.ReserveCodeSend(ctx, purpose, recipient, limit.Cooldown, limit.DailyQuota)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, utils.ErrCodeSendCooldown) || errors.Is(err, utils.ErrCodeSendQuotaExceeded) {
+		l.logger.Debug("Code send limited", "purpose", purpose, "retry_after", retryAfter, "err", err.Error())
+		return &utils.RetryAfterError{Err: err, RetryAfter: retryAfter}
+	}
+
+	l.logger.Debug("Reserving code send error", "purpose", purpose, "err", err.Error())
+
+	return utils.ErrInternalServer
+}
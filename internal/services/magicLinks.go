@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_jwt "authSAS/internal/utils/jwt"
+)
+
+// MagicLinkTokenPlaceholder is replaced by the link token in the url template
+const MagicLinkTokenPlaceholder = "{token}"
+
+// MagicLinks issues passwordless login links. The link token is signed by the JWT key ring,
+// its copy is kept in the temporary storage, so a link works once and only within code TTL
+type MagicLinks struct {
+	logger *slog.Logger
+	urlTemplate string
+	ttl time.Duration
+	keyRing *utils_jwt.KeyRing
+	tokenOptions utils_jwt.Options
+	magicLinkKeeper MagicLinkKeeper
+	codeConsumer CodeConsumer
+}
+
+// NewMagicLinks creates links, magic links are disabled while urlTemplate is empty
+func NewMagicLinks(logger *slog.Logger, urlTemplate string, ttl time.Duration, keyRing *utils_jwt.KeyRing, tokenOptions utils_jwt.Options, temporaryStorage TemporaryStorage) *MagicLinks {
+	return &MagicLinks{
+		logger: logger,
+		urlTemplate: urlTemplate,
+		ttl: ttl,
+		keyRing: keyRing,
+		tokenOptions: tokenOptions,
+		magicLinkKeeper: temporaryStorage,
+		codeConsumer: temporaryStorage,
+	}
+}
+
+// Enabled is false while url template is not configured
+func (m *MagicLinks) Enabled() bool {
+	return m.urlTemplate != ""
+}
+
+// Issue keeps a new link token of the user and returns the link to email
+func (m *MagicLinks) Issue(ctx context.Context, user models.User) (link string, err error) {
+	if m.urlTemplate == "" {
+		return "", utils.ErrMagicLinkDisabled
+	}
+
+	token, jti, err := utils_jwt.NewMagicLinkToken(user, m.ttl, m.keyRing.Active(), m.tokenOptions)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.magicLinkKeeper.KeepMagicLink(ctx, jti, token); err != nil {
+		return "", err
+	}
+
+	return strings.ReplaceAll(m.urlTemplate, MagicLinkTokenPlaceholder, url.QueryEscape(token)), nil
+}
+
+// Redeem checks the signature of the link token and uses it up, a replayed token is ErrMagicLinkUsed
+func (m *MagicLinks) Redeem(ctx context.Context, token string) (uid int64, email string, err error) {
+	if m.urlTemplate == "" {
+		return 0, "", utils.ErrMagicLinkDisabled
+	}
+
+	claims, err := utils_jwt.ParseMagicLinkToken(token, m.keyRing, m.tokenOptions)
+	if err != nil {
+		return 0, "", utils.ErrInvalidCredentials
+	}
+
+	err = m.codeConsumer.ConsumeCode(ctx, models.CodePurposeMagicLink, claims.ID, token)
+	if err != nil {
+		if errors.Is(err, utils.ErrCodeNotFound) || errors.Is(err, utils.ErrWrongCode) {
+			return 0, "", utils.ErrMagicLinkUsed
+		}
+		return 0, "", err
+	}
+
+	// checked by ParseMagicLinkToken
+	uid, _ = strconv.ParseInt(claims.Subject, 10, 64)
+
+	return uid, claims.Email, nil
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_random "authSAS/internal/utils/randomCode"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyAuthenticator runs WebAuthn registration and assertion ceremonies.
+// Ceremony state is kept in the temporary storage under a random challenge id,
+// credentials are kept in the permanent storage.
+type PasskeyAuthenticator struct {
+	logger *slog.Logger
+	webAuthn *webauthn.WebAuthn
+	userGetter UserGetter
+	webAuthnCredentialKeeper WebAuthnCredentialKeeper
+	webAuthnCredentialsGetter WebAuthnCredentialsGetter
+	webAuthnCredentialUpdater WebAuthnCredentialUpdater
+	webAuthnSessionKeeper WebAuthnSessionKeeper
+	webAuthnSessionTaker WebAuthnSessionTaker
+}
+
+// NewPasskeyAuthenticator creates authenticator, passkeys are disabled while webAuthn is nil
+func NewPasskeyAuthenticator(logger *slog.Logger, webAuthn *webauthn.WebAuthn, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *PasskeyAuthenticator {
+	return &PasskeyAuthenticator{
+		logger: logger,
+		webAuthn: webAuthn,
+		userGetter: permanentStorage,
+		webAuthnCredentialKeeper: permanentStorage,
+		webAuthnCredentialsGetter: permanentStorage,
+		webAuthnCredentialUpdater: permanentStorage,
+		webAuthnSessionKeeper: temporaryStorage,
+		webAuthnSessionTaker: temporaryStorage,
+	}
+}
+
+// BeginRegistration returns PublicKeyCredentialCreationOptions (JSON) for navigator.credentials.create()
+func (a *PasskeyAuthenticator) BeginRegistration(ctx context.Context, user models.User) (options []byte, challengeId string, err error) {
+	if a.webAuthn == nil {
+		return nil, "", utils.ErrWebAuthnDisabled
+	}
+
+	passkeyUser, err := a.loadUser(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	creation, session, err := a.webAuthn.BeginRegistration(passkeyUser,
+		webauthn.WithExclusions(webauthn.Credentials(passkeyUser.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return a.keepCeremony(ctx, creation, session)
+}
+
+// FinishRegistration checks the attestation answered to BeginRegistration and stores the credential
+func (a *PasskeyAuthenticator) FinishRegistration(ctx context.Context, user models.User, challengeId string, response []byte) (err error) {
+	if a.webAuthn == nil {
+		return utils.ErrWebAuthnDisabled
+	}
+
+	session, err := a.takeSession(ctx, challengeId)
+	if err != nil {
+		return err
+	}
+
+	// challenge of another user's ceremony
+	if !bytes.Equal(session.UserID, passkeyUserHandle(user.Id)) {
+		return utils.ErrWebAuthnSessionNotFound
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		a.logger.Debug("Parsing webauthn attestation error", "uid", user.Id, "err", err.Error())
+		return utils.ErrInvalidCredentials
+	}
+
+	passkeyUser, err := a.loadUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	credential, err := a.webAuthn.CreateCredential(passkeyUser, *session, parsed)
+	if err != nil {
+		a.logger.Debug("Webauthn attestation error", "uid", user.Id, "err", err.Error())
+		return utils.ErrInvalidCredentials
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	return a.webAuthnCredentialKeeper.KeepWebAuthnCredential(ctx, models.WebAuthnCredential{
+		Id: credential.ID,
+		UserId: user.Id,
+		PublicKey: credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports: transports,
+		SignCount: credential.Authenticator.SignCount,
+		AAGUID: credential.Authenticator.AAGUID,
+		BackupEligible: credential.Flags.BackupEligible,
+		BackupState: credential.Flags.BackupState,
+	})
+}
+
+// BeginLogin returns PublicKeyCredentialRequestOptions (JSON) for navigator.credentials.get().
+// Nil user starts passwordless login with a discoverable credential, user verification is required then
+func (a *PasskeyAuthenticator) BeginLogin(ctx context.Context, user *models.User) (options []byte, challengeId string, err error) {
+	if a.webAuthn == nil {
+		return nil, "", utils.ErrWebAuthnDisabled
+	}
+
+	if user == nil {
+		assertion, session, err := a.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return nil, "", err
+		}
+
+		return a.keepCeremony(ctx, assertion, session)
+	}
+
+	passkeyUser, err := a.loadUser(ctx, *user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(passkeyUser.credentials) == 0 {
+		return nil, "", utils.ErrPasskeyNotFound
+	}
+
+	assertion, session, err := a.webAuthn.BeginLogin(passkeyUser)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return a.keepCeremony(ctx, assertion, session)
+}
+
+// FinishLogin checks the assertion answered to BeginLogin and returns the credential's owner
+func (a *PasskeyAuthenticator) FinishLogin(ctx context.Context, challengeId string, response []byte) (user models.User, err error) {
+	if a.webAuthn == nil {
+		return models.User{}, utils.ErrWebAuthnDisabled
+	}
+
+	session, err := a.takeSession(ctx, challengeId)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		a.logger.Debug("Parsing webauthn assertion error", "err", err.Error())
+		return models.User{}, utils.ErrInvalidCredentials
+	}
+
+	var passkeyUser *passkeyUser
+	var credential *webauthn.Credential
+
+	if len(session.UserID) == 0 {
+		credential, err = a.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			passkeyUser, err = a.loadUserByHandle(ctx, userHandle)
+			return passkeyUser, err
+		}, *session, parsed)
+	} else {
+		passkeyUser, err = a.loadUserByHandle(ctx, session.UserID)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		credential, err = a.webAuthn.ValidateLogin(passkeyUser, *session, parsed)
+	}
+	if err != nil {
+		if errors.Is(err, utils.ErrInternalServer) {
+			return models.User{}, err
+		}
+		a.logger.Debug("Webauthn assertion error", "err", err.Error())
+		return models.User{}, utils.ErrInvalidCredentials
+	}
+
+	// sign count went backwards, two copies of the private key may exist
+	if credential.Authenticator.CloneWarning {
+		a.logger.Warn("Webauthn credential clone detected", "uid", passkeyUser.user.Id)
+		return models.User{}, utils.ErrInvalidCredentials
+	}
+
+	if err := a.webAuthnCredentialUpdater.UpdateWebAuthnCredential(ctx, credential.ID, credential.Authenticator.SignCount, credential.Flags.BackupState); err != nil {
+		return models.User{}, err
+	}
+
+	return passkeyUser.user, nil
+}
+
+// Helpers
+
+func (a *PasskeyAuthenticator) keepCeremony(ctx context.Context, options any, session *webauthn.SessionData) (optionsJSON []byte, challengeId string, err error) {
+	optionsJSON, err = json.Marshal(options)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	challengeId, err = utils_random.RandToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := a.webAuthnSessionKeeper.KeepWebAuthnSession(ctx, challengeId, sessionJSON); err != nil {
+		return nil, "", err
+	}
+
+	return optionsJSON, challengeId, nil
+}
+
+func (a *PasskeyAuthenticator) takeSession(ctx context.Context, challengeId string) (session *webauthn.SessionData, err error) {
+	if challengeId == "" {
+		return nil, utils.ErrWebAuthnSessionNotFound
+	}
+
+	sessionJSON, err := a.webAuthnSessionTaker.TakeWebAuthnSession(ctx, challengeId)
+	if err != nil {
+		return nil, err
+	}
+
+	session = &webauthn.SessionData{}
+	if err := json.Unmarshal(sessionJSON, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (a *PasskeyAuthenticator) loadUser(ctx context.Context, user models.User) (*passkeyUser, error) {
+	credentials, err := a.webAuthnCredentialsGetter.GetUserWebAuthnCredentials(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeyUser := &passkeyUser{user: user}
+
+	for _, credential := range credentials {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(credential.Transports))
+		for _, transport := range credential.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+
+		passkeyUser.credentials = append(passkeyUser.credentials, webauthn.Credential{
+			ID: credential.Id,
+			PublicKey: credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport: transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState: credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID: credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		})
+	}
+
+	return passkeyUser, nil
+}
+
+func (a *PasskeyAuthenticator) loadUserByHandle(ctx context.Context, userHandle []byte) (*passkeyUser, error) {
+	if len(userHandle) != 8 {
+		return nil, utils.ErrUserNotFound
+	}
+
+	user, err := a.userGetter.GetUserById(ctx, int64(binary.BigEndian.Uint64(userHandle)))
+	if err != nil {
+		if errors.Is(err, utils.ErrUserNotFound) {
+			return nil, err
+		}
+		return nil, utils.ErrInternalServer
+	}
+
+	passkeyUser, err := a.loadUser(ctx, user)
+	if err != nil {
+		return nil, utils.ErrInternalServer
+	}
+
+	return passkeyUser, nil
+}
+
+// passkeyUser adapts models.User to webauthn.User
+type passkeyUser struct {
+	user models.User
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.user.Id)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// passkeyUserHandle is the opaque user handle, it carries no email
+func passkeyUserHandle(uid int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(uid))
+	return handle
+}
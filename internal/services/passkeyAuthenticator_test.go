@@ -0,0 +1,330 @@
+package services_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"authSAS/internal/utils"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// softAuthenticator is an in-memory platform authenticator with "none" attestation
+type softAuthenticator struct {
+	t *testing.T
+	origin string
+	key *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+
+	return &softAuthenticator{t: t, origin: origin, key: key, credentialId: credentialId}
+}
+
+// create answers PublicKeyCredentialCreationOptions like navigator.credentials.create()
+func (a *softAuthenticator) create(options []byte) []byte {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	require.NoError(a.t, json.Unmarshal(options, &creation))
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(creation.PublicKey.User.ID)
+	require.NoError(a.t, err)
+	a.userHandle = userHandle
+
+	coseKey, err := cbor.Marshal(map[int]any{
+		1: 2, // kty: EC2
+		3: -7, // alg: ES256
+		-1: 1, // crv: P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(a.t, err)
+
+	// flags UP, UV, AT
+	authData := a.authData(creation.PublicKey.RP.ID, 0x01|0x04|0x40)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+	authData = append(authData, coseKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]any{
+		"fmt": "none",
+		"attStmt": map[string]any{},
+		"authData": authData,
+	})
+	require.NoError(a.t, err)
+
+	return a.credential(map[string]any{
+		"clientDataJSON": a.clientData("webauthn.create", creation.PublicKey.Challenge),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+		"transports": []string{"internal"},
+	})
+}
+
+// get answers PublicKeyCredentialRequestOptions like navigator.credentials.get()
+func (a *softAuthenticator) get(options []byte) []byte {
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID string `json:"rpId"`
+		} `json:"publicKey"`
+	}
+	require.NoError(a.t, json.Unmarshal(options, &assertion))
+
+	a.signCount++
+
+	// flags UP, UV
+	authData := a.authData(assertion.PublicKey.RPID, 0x01|0x04)
+	clientData := a.clientData("webauthn.get", assertion.PublicKey.Challenge)
+
+	rawClientData, _ := base64.RawURLEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(rawClientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(a.t, err)
+
+	return a.credential(map[string]any{
+		"clientDataJSON": clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle": base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) authData(rpId string, flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+
+	authData := append(rpIdHash[:], flags)
+	return binary.BigEndian.AppendUint32(authData, a.signCount)
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) string {
+	clientData, err := json.Marshal(map[string]any{
+		"type": ceremony,
+		"challenge": challenge,
+		"origin": a.origin,
+		"crossOrigin": false,
+	})
+	require.NoError(a.t, err)
+
+	return base64.RawURLEncoding.EncodeToString(clientData)
+}
+
+func (a *softAuthenticator) credential(response map[string]any) []byte {
+	credential, err := json.Marshal(map[string]any{
+		"id": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type": "public-key",
+		"response": response,
+	})
+	require.NoError(a.t, err)
+
+	return credential
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	otherToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+
+	authenticator := newSoftAuthenticator(t, tester.cfg.WebAuthn.RPOrigins[0])
+
+	options, challengeId, err := tester.sesService.BeginPasskeyRegistration(ctx, token)
+	require.NoError(t, err)
+	response := authenticator.create(options)
+
+	otherOptions, otherChallengeId, err := tester.sesService.BeginPasskeyRegistration(ctx, otherToken)
+	require.NoError(t, err)
+	otherResponse := newSoftAuthenticator(t, "https://evil.example.com").create(otherOptions)
+
+	_, invalidTokenChallengeId, err := tester.sesService.BeginPasskeyRegistration(ctx, token)
+	require.NoError(t, err)
+
+	cases := []struct {
+		desc string
+		inToken string
+		inChallengeId string
+		inResponse []byte
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - challenge of another user",
+			inToken: token,
+			inChallengeId: otherChallengeId,
+			inResponse: response,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - invalid token",
+			inToken: "invalid",
+			inChallengeId: invalidTokenChallengeId,
+			inResponse: response,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - right registration",
+			inToken: token,
+			inChallengeId: challengeId,
+			inResponse: response,
+			outMsg: "Passkey registered",
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - replayed challenge",
+			inToken: token,
+			inChallengeId: challengeId,
+			inResponse: response,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 5 - origin is not allowed",
+			inToken: otherToken,
+			inChallengeId: otherChallengeId,
+			inResponse: otherResponse,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.sesService.FinishPasskeyRegistration(ctx, tC.inToken, tC.inChallengeId, tC.inResponse)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+		}
+		require.Equal(t, tC.outMsg, msg, tC.desc)
+	}
+
+	credentials, _ := tester.permStor.GetUserWebAuthnCredentials(ctx, 0)
+	require.Len(t, credentials, 1)
+	require.Equal(t, authenticator.credentialId, credentials[0].Id)
+	require.Equal(t, []string{"internal"}, credentials[0].Transports)
+
+	// registered passkey is excluded from the next registration
+	options, _, err = tester.sesService.BeginPasskeyRegistration(ctx, token)
+	require.NoError(t, err)
+	require.Contains(t, string(options), base64.RawURLEncoding.EncodeToString(authenticator.credentialId))
+}
+
+func TestPasskeyLogin(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	authenticator := newSoftAuthenticator(t, tester.cfg.WebAuthn.RPOrigins[0])
+
+	options, challengeId, _ := tester.sesService.BeginPasskeyRegistration(ctx, token)
+	_, err := tester.sesService.FinishPasskeyRegistration(ctx, token, challengeId, authenticator.create(options))
+	require.NoError(t, err)
+
+	// passwordless login
+	options, challengeId, err = tester.sesService.BeginPasskeyLogin(ctx, "")
+	require.NoError(t, err)
+	response := authenticator.get(options)
+
+	passkeyToken, refreshToken, err := tester.sesService.FinishPasskeyLogin(ctx, challengeId, response)
+	require.NoError(t, err)
+	require.NotEmpty(t, refreshToken)
+
+	_, email, _, err := tester.sesService.ValidateToken(ctx, passkeyToken)
+	require.NoError(t, err)
+	require.Equal(t, "test@mail.ru", email)
+
+	// replayed assertion
+	_, _, err = tester.sesService.FinishPasskeyLogin(ctx, challengeId, response)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// assertion signed for another challenge
+	_, otherChallengeId, _ := tester.sesService.BeginPasskeyLogin(ctx, "")
+	_, _, err = tester.sesService.FinishPasskeyLogin(ctx, otherChallengeId, response)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// second factor needs the password step
+	_, _, err = tester.sesService.BeginPasskeyLogin(ctx, "unknown")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	tester.tempStor.KeepTwoFASettingsCode(ctx, "test@mail.ru", "1234")
+	tester.accService.Enable2FA(ctx, token, "1234")
+
+	_, _, loginChallengeId, msg, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	require.Equal(t, "2FA code sended", msg)
+
+	options, challengeId, err = tester.sesService.BeginPasskeyLogin(ctx, loginChallengeId)
+	require.NoError(t, err)
+	require.Contains(t, string(options), base64.RawURLEncoding.EncodeToString(authenticator.credentialId))
+
+	// login challenge is exchanged for the passkey one
+	_, _, err = tester.sesService.BeginPasskeyLogin(ctx, loginChallengeId)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	_, _, err = tester.sesService.FinishPasskeyLogin(ctx, challengeId, authenticator.get(options))
+	require.NoError(t, err)
+
+	credentials, _ := tester.permStor.GetUserWebAuthnCredentials(ctx, 0)
+	require.Equal(t, authenticator.signCount, credentials[0].SignCount)
+
+	// cloned authenticator: sign count goes backwards
+	authenticator.signCount = 0
+
+	options, challengeId, _ = tester.sesService.BeginPasskeyLogin(ctx, "")
+	_, _, err = tester.sesService.FinishPasskeyLogin(ctx, challengeId, authenticator.get(options))
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// user without passkeys keeps the login challenge for another second factor
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test2@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test2@mail.ru"] = user
+
+	_, _, loginChallengeId, _, _ = tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+	_, _, err = tester.sesService.BeginPasskeyLogin(ctx, loginChallengeId)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	code, _ := tester.tempStor.GetTwoFACode(ctx, loginChallengeId)
+	token, _, _, err = tester.sesService.LoginWith2FACode(ctx, loginChallengeId, code, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+}
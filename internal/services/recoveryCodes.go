@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+
+	"authSAS/internal/utils"
+	utils_random "authSAS/internal/utils/randomCode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Recovery codes are 8 digits, so LoginWith2FACode tells them from
+// 6 digit TOTP codes (emailed code of the login is checked before both)
+const (
+	recoveryCodesCount = 10
+	recoveryCodeMin = 10000000
+	recoveryCodeMax = 99999999
+)
+
+// RecoveryCodes issues and consumes single-use 2FA backup codes,
+// the codes are shown once and stored bcrypt-hashed
+type RecoveryCodes struct {
+	logger *slog.Logger
+	recoveryCodesKeeper RecoveryCodesKeeper
+	recoveryCodesGetter RecoveryCodesGetter
+	recoveryCodeUser RecoveryCodeUser
+}
+
+func NewRecoveryCodes(logger *slog.Logger, permanentStorage PermanentStorage) *RecoveryCodes {
+	return &RecoveryCodes{
+		logger: logger,
+		recoveryCodesKeeper: permanentStorage,
+		recoveryCodesGetter: permanentStorage,
+		recoveryCodeUser: permanentStorage,
+	}
+}
+
+// Generate replaces codes of the user, previous codes stop working
+func (r *RecoveryCodes) Generate(ctx context.Context, uid int64) (codes []string, err error) {
+	codes = make([]string, 0, recoveryCodesCount)
+	codeHashes := make([][]byte, 0, recoveryCodesCount)
+
+	for len(codes) < recoveryCodesCount {
+		n, err := utils_random.RandSecureRange(recoveryCodeMin, recoveryCodeMax + 1)
+		if err != nil {
+			return nil, err
+		}
+		code := strconv.Itoa(n)
+
+		codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+		codeHashes = append(codeHashes, codeHash)
+	}
+
+	if err := r.recoveryCodesKeeper.ReplaceRecoveryCodes(ctx, uid, codeHashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Use consumes matching unused code of the user
+func (r *RecoveryCodes) Use(ctx context.Context, uid int64, code string) (err error) {
+	codes, err := r.recoveryCodesGetter.GetUnusedRecoveryCodes(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	for _, recoveryCode := range codes {
+		if bcrypt.CompareHashAndPassword(recoveryCode.CodeHash, []byte(code)) != nil {
+			continue
+		}
+
+		// concurrent login with the same code loses here
+		return r.recoveryCodeUser.UseRecoveryCode(ctx, recoveryCode.Id)
+	}
+
+	return utils.ErrRecoveryCodeNotFound
+}
+
+func isRecoveryCode(code string) bool {
+	n, err := strconv.Atoi(code)
+	return err == nil && len(code) == len(strconv.Itoa(recoveryCodeMax)) && n >= recoveryCodeMin && n <= recoveryCodeMax
+}
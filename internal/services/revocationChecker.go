@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"authSAS/internal/utils"
+)
+
+// RevocationChecker answers whether a token (jti) or its session (sid) is revoked.
+// Lookups go through an in-process cache, then the temporary storage and
+// fall back to the permanent storage only when both have no answer.
+// Token versions of users are cached in the temporary storage only, every instance sees a bump at once.
+type RevocationChecker struct {
+	logger *slog.Logger
+	cacheTTL time.Duration
+	negativeCacheTTL time.Duration
+	cacheSize int
+	cache map[string]revocationEntry
+	mu sync.Mutex
+	revocationCacheKeeper RevocationCacheKeeper
+	revocationCacheChecker RevocationCacheChecker
+	tokenVersionCacheKeeper TokenVersionCacheKeeper
+	tokenVersionCacheGetter TokenVersionCacheGetter
+	logoutJWTChecker LogoutJWTChecker
+	sessionChecker SessionChecker
+	userGetter UserGetter
+	tokenVersionBumper TokenVersionBumper
+}
+
+type revocationEntry struct {
+	revoked bool
+	expiresAt time.Time
+}
+
+// NewRevocationChecker creates checker, in-process cache is disabled while cacheSize is 0.
+// Revoked answers are cached for cacheTTL, not revoked ones (negative) for negativeCacheTTL
+func NewRevocationChecker(logger *slog.Logger, cacheTTL time.Duration, negativeCacheTTL time.Duration, cacheSize int, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *RevocationChecker {
+	return &RevocationChecker{
+		logger: logger,
+		cacheTTL: cacheTTL,
+		negativeCacheTTL: negativeCacheTTL,
+		cacheSize: cacheSize,
+		cache: make(map[string]revocationEntry),
+		revocationCacheKeeper: temporaryStorage,
+		revocationCacheChecker: temporaryStorage,
+		tokenVersionCacheKeeper: temporaryStorage,
+		tokenVersionCacheGetter: temporaryStorage,
+		logoutJWTChecker: permanentStorage,
+		sessionChecker: permanentStorage,
+		userGetter: permanentStorage,
+		tokenVersionBumper: permanentStorage,
+	}
+}
+
+func (c *RevocationChecker) IsRevoked(ctx context.Context, jti string, sid string, tokenExpiresAt time.Time) (revoked bool, err error) {
+	// revoked session is cached by sid, so it wins over negative answer cached for jti
+	if revoked, ok := c.fromCache(sid); ok && revoked {
+		return true, nil
+	}
+
+	if revoked, ok := c.fromCache(jti); ok {
+		return revoked, nil
+	}
+
+	revoked, err = c.revocationCacheChecker.IsRevocationCached(ctx, jti, sid)
+	if err != nil {
+		// temporary storage is only a cache, the permanent one still knows the answer
+		c.logger.Warn("Revocation cache lookup error", "err", err.Error())
+	}
+
+	if !revoked {
+		revoked, err = c.checkPermanent(ctx, jti, sid)
+		if err != nil {
+			return false, err
+		}
+
+		if revoked {
+			if err := c.revocationCacheKeeper.KeepRevocation(ctx, jti, time.Until(tokenExpiresAt)); err != nil {
+				c.logger.Warn("Revocation cache keep error", "err", err.Error())
+			}
+		}
+	}
+
+	c.toCache(jti, revoked)
+
+	return revoked, nil
+}
+
+// MarkRevoked puts already stored revocation of jti or sid into caches for ttl
+func (c *RevocationChecker) MarkRevoked(ctx context.Context, id string, ttl time.Duration) (err error) {
+	if ttl <= 0 {
+		return nil
+	}
+
+	c.toCache(id, true)
+
+	return c.revocationCacheKeeper.KeepRevocation(ctx, id, ttl)
+}
+
+// IsVersionRevoked is true when the user's tokens were revoked (token version bumped) after the token was issued,
+// ErrUserNotFound when the user is gone
+func (c *RevocationChecker) IsVersionRevoked(ctx context.Context, uid int64, tokenVersion int64) (revoked bool, err error) {
+	version, found, err := c.tokenVersionCacheGetter.GetCachedTokenVersion(ctx, uid)
+	if err != nil {
+		c.logger.Warn("Token version cache lookup error", "uid", uid, "err", err.Error())
+	}
+
+	if !found {
+		user, err := c.userGetter.GetUserById(ctx, uid)
+		if err != nil {
+			return false, err
+		}
+
+		version = user.TokenVersion
+
+		if err := c.tokenVersionCacheKeeper.KeepTokenVersion(ctx, uid, version, c.cacheTTL); err != nil {
+			c.logger.Warn("Token version cache keep error", "uid", uid, "err", err.Error())
+		}
+	}
+
+	return tokenVersion < version, nil
+}
+
+// BumpTokenVersion bumps the version in the permanent storage and puts the new one into the cache,
+// so tokens issued before stop working without waiting for the cached version to expire
+func (c *RevocationChecker) BumpTokenVersion(ctx context.Context, uid int64) (err error) {
+	if err := c.tokenVersionBumper.BumpTokenVersion(ctx, uid); err != nil {
+		return err
+	}
+
+	user, err := c.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		c.logger.Warn("Token version cache keep error", "uid", uid, "err", err.Error())
+		return nil
+	}
+
+	if err := c.tokenVersionCacheKeeper.KeepTokenVersion(ctx, uid, user.TokenVersion, c.cacheTTL); err != nil {
+		c.logger.Warn("Token version cache keep error", "uid", uid, "err", err.Error())
+	}
+
+	return nil
+}
+
+func (c *RevocationChecker) checkPermanent(ctx context.Context, jti string, sid string) (revoked bool, err error) {
+	loggedOut, err := c.logoutJWTChecker.IsJWTLoggedOut(ctx, jti)
+	if err != nil {
+		return false, err
+	}
+
+	if loggedOut {
+		return true, nil
+	}
+
+	revoked, err = c.sessionChecker.IsSessionRevoked(ctx, sid)
+	if err != nil {
+		if errors.Is(err, utils.ErrSessionNotFound) {
+			return false, utils.ErrSessionNotFound
+		}
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (c *RevocationChecker) fromCache(id string) (revoked bool, ok bool) {
+	if c.cacheSize == 0 {
+		return false, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.cache[id]
+	if !ok {
+		return false, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.cache, id)
+		return false, false
+	}
+
+	return entry.revoked, true
+}
+
+func (c *RevocationChecker) toCache(id string, revoked bool) {
+	if c.cacheSize == 0 {
+		return
+	}
+
+	ttl := c.negativeCacheTTL
+	if revoked {
+		ttl = c.cacheTTL
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) >= c.cacheSize {
+		for key, entry := range c.cache {
+			if now.After(entry.expiresAt) {
+				delete(c.cache, key)
+			}
+		}
+	}
+
+	// still full of live entries - start over rather than grow without bound
+	if len(c.cache) >= c.cacheSize {
+		c.cache = make(map[string]revocationEntry)
+	}
+
+	c.cache[id] = revocationEntry{revoked: revoked, expiresAt: now.Add(ttl)}
+}
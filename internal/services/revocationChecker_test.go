@@ -0,0 +1,113 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"authSAS/internal/models"
+	"authSAS/internal/services"
+	"authSAS/internal/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationChecker(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	expiresAt := time.Now().Add(time.Hour)
+	for _, sid := range []string{"sid1", "sid2", "sid3"} {
+		tester.permStor.KeepSession(ctx, models.Session{Id: sid, UserId: 1, ExpiresAt: expiresAt})
+	}
+
+	checker := services.NewRevocationChecker(tester.logger, time.Hour, time.Hour, 100, tester.permStor, tester.tempStor)
+	uncachedChecker := services.NewRevocationChecker(tester.logger, time.Hour, time.Hour, 0, tester.permStor, tester.tempStor)
+
+	// token logouted in postgres only is found and written back to redis
+	tester.permStor.KeepLogoutJWT(ctx, 1, "jti1", expiresAt)
+
+	revoked, err := checker.IsRevoked(ctx, "jti1", "sid1", expiresAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	revoked, err = tester.tempStor.IsRevocationCached(ctx, "jti1")
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// not revoked answer is cached in process
+	revoked, err = checker.IsRevoked(ctx, "jti2", "sid2", expiresAt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	tester.permStor.RevokeSession(ctx, 1, "sid2")
+
+	revoked, err = checker.IsRevoked(ctx, "jti2", "sid2", expiresAt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	revoked, err = uncachedChecker.IsRevoked(ctx, "jti2", "sid2", expiresAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// marked session revocation wins over cached negative answer
+	revoked, err = checker.IsRevoked(ctx, "jti3", "sid3", expiresAt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	err = checker.MarkRevoked(ctx, "sid3", time.Hour)
+	require.NoError(t, err)
+
+	revoked, err = checker.IsRevoked(ctx, "jti3", "sid3", expiresAt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// unknown session
+	_, err = checker.IsRevoked(ctx, "jti4", "unknown", expiresAt)
+	require.ErrorIs(t, err, utils.ErrSessionNotFound)
+}
+
+func TestRevocationCheckerTokenVersion(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.permStor.CreateUser(ctx, "test@mail.ru", []byte("hash"))
+	user, err := tester.permStor.GetUserByEmail(ctx, "test@mail.ru")
+	require.NoError(t, err)
+	uid := user.Id
+
+	checker := services.NewRevocationChecker(tester.logger, time.Hour, time.Hour, 100, tester.permStor, tester.tempStor)
+
+	// version read from postgres is written to redis
+	revoked, err := checker.IsVersionRevoked(ctx, uid, 0)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	version, found, err := tester.tempStor.GetCachedTokenVersion(ctx, uid)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Zero(t, version)
+
+	// bump through the checker updates the cached version at once
+	err = checker.BumpTokenVersion(ctx, uid)
+	require.NoError(t, err)
+
+	revoked, err = checker.IsVersionRevoked(ctx, uid, 0)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	revoked, err = checker.IsVersionRevoked(ctx, uid, 1)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	// late write of a stale version doesn't hide the bump
+	err = tester.tempStor.KeepTokenVersion(ctx, uid, 0, time.Hour)
+	require.NoError(t, err)
+
+	revoked, err = checker.IsVersionRevoked(ctx, uid, 0)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// unknown user
+	_, err = checker.IsVersionRevoked(ctx, uid+100, 0)
+	require.ErrorIs(t, err, utils.ErrUserNotFound)
+}
@@ -0,0 +1,12 @@
+package services
+
+import (
+	"context"
+
+	"authSAS/internal/models"
+)
+
+// SecurityNotifier tells the user about changes of the account, notices always go by email
+type SecurityNotifier interface {
+	NotifySecurityEvent(ctx context.Context, user models.User, notice models.SecurityNotice) (err error)
+}
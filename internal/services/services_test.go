@@ -5,11 +5,18 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 
 	"authSAS/internal/config"
+	"authSAS/internal/models"
 	"authSAS/internal/services"
 	"authSAS/internal/storages/mockups"
-	emailsender "authSAS/internal/utils/emailSender"
+	utils_jwt "authSAS/internal/utils/jwt"
+	utils_random "authSAS/internal/utils/randomCode"
+	utils_secretbox "authSAS/internal/utils/secretBox"
+	utils_totp "authSAS/internal/utils/totp"
+
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type Tester struct {
@@ -20,23 +27,90 @@ type Tester struct {
 	tempStor *mockups.TempStorMockup
 	accService *services.AccountService
 	sesService *services.SessionService
-	emailSender *emailsender.EmailSender
+	codeDeliverer *services.ChannelRouter
+	emailChannel *mockups.CodeDelivererMockup
+	smsChannel *mockups.CodeDelivererMockup
+	securityNotifier *mockups.CodeDelivererMockup
+	keyRing *utils_jwt.KeyRing
+	tokenOptions utils_jwt.Options
+	challengeBinding services.ChallengeBinding
+	revocationChecker *services.RevocationChecker
+	totpAuthenticator *services.TOTPAuthenticator
+	recoveryCodes *services.RecoveryCodes
+	passkeyAuthenticator *services.PasskeyAuthenticator
+	magicLinks *services.MagicLinks
+	trustedDevices *services.TrustedDevices
+	codeAttemptsLimiter *services.CodeAttemptsLimiter
+	codeSendLimiter *services.CodeSendLimiter
+	codeFormats services.CodeFormats
 }
 
 func NewTester(t *testing.T) (context.Context, *Tester) {
 	t.Helper()
 	t.Parallel()
 
-	cfg := config.MustLoadByPath("../../config/config.yaml")
+	cfg := config.MustLoadByPath("testdata/config.yaml")
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	emailSender := emailsender.NewEmailSender(logger, cfg.EmailSender.Email, cfg.EmailSender.Password)
+	// webhook channel is not configured, its users get codes by email
+	emailChannel := mockups.NewCodeDelivererMokup()
+	smsChannel := mockups.NewCodeDelivererMokup()
+	securityNotifier := mockups.NewCodeDelivererMokup()
+	codeDeliverer := services.NewChannelRouter(logger, map[models.DeliveryChannel]services.CodeDeliverer{
+		models.DeliveryChannelEmail: emailChannel,
+		models.DeliveryChannelSMS: smsChannel,
+	})
 
 	ctx, cancelCtx := context.WithTimeout(context.Background(), cfg.Grpc.RequestTimeout)
 
+	var keySpecs []utils_jwt.KeySpec
+	for _, key := range cfg.JWTKeys.Keys {
+		keySpecs = append(keySpecs, utils_jwt.KeySpec{Kid: key.Kid, Algorithm: key.Algorithm, PrivateKeyPath: key.PrivateKeyPath, Secret: key.Secret})
+	}
+	keyRing, err := utils_jwt.LoadKeyRing(cfg.JWTKeys.ActiveKid, keySpecs, cfg.JWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	permStor := mockups.NewPermStorMokup()
 	tempStor := mockups.NewTempStorMokup()
-	accService := services.NewAccountService(logger, cfg.JWTTokenTTL, emailSender, permStor, tempStor)
-	sesService := services.NewSessionService(logger, cfg.JWTTokenTTL, cfg.JWTSecret, emailSender, permStor, tempStor)
+	tokenOptions := utils_jwt.Options{Issuer: cfg.JWTIssuer, Audience: cfg.JWTAudience, Leeway: cfg.JWTLeeway}
+	challengeBinding := services.ChallengeBinding(cfg.LoginChallengeBinding)
+	revocationChecker := services.NewRevocationChecker(logger, cfg.RevocationCache.TTL, cfg.RevocationCache.NegativeTTL, cfg.RevocationCache.Size, permStor, tempStor)
+	totpSecretBox, err := utils_secretbox.NewSecretBox(cfg.TOTP.EncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totpAuthenticator := services.NewTOTPAuthenticator(logger, cfg.TOTP.Issuer, totpSecretBox, permStor)
+	recoveryCodes := services.NewRecoveryCodes(logger, permStor)
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID: cfg.WebAuthn.RPID,
+		RPDisplayName: cfg.WebAuthn.RPDisplayName,
+		RPOrigins: cfg.WebAuthn.RPOrigins,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	passkeyAuthenticator := services.NewPasskeyAuthenticator(logger, webAuthn, permStor, tempStor)
+	magicLinks := services.NewMagicLinks(logger, cfg.MagicLink.URLTemplate, cfg.TempStorage.CodeTTL, keyRing, tokenOptions, tempStor)
+	trustedDevices := services.NewTrustedDevices(logger, cfg.DeviceTrustTTL, keyRing, tokenOptions, permStor)
+	codeAttemptsLimiter := services.NewCodeAttemptsLimiter(logger, cfg.TempStorage.CodeMaxAttempts, tempStor)
+	codeSendLimiter := services.NewCodeSendLimiter(logger, services.CodeSendLimits{
+		TwoFA: services.SendLimit{Cooldown: cfg.CodeSending.TwoFA.Cooldown, DailyQuota: cfg.CodeSending.TwoFA.DailyQuota},
+		TwoFASettings: services.SendLimit{Cooldown: cfg.CodeSending.TwoFASettings.Cooldown, DailyQuota: cfg.CodeSending.TwoFASettings.DailyQuota},
+		EmailVerify: services.SendLimit{Cooldown: cfg.CodeSending.EmailVerify.Cooldown, DailyQuota: cfg.CodeSending.EmailVerify.DailyQuota},
+		PassRecover: services.SendLimit{Cooldown: cfg.CodeSending.PassRecover.Cooldown, DailyQuota: cfg.CodeSending.PassRecover.DailyQuota},
+		ChangeEmail: services.SendLimit{Cooldown: cfg.CodeSending.ChangeEmail.Cooldown, DailyQuota: cfg.CodeSending.ChangeEmail.DailyQuota},
+		ConfirmPhone: services.SendLimit{Cooldown: cfg.CodeSending.ConfirmPhone.Cooldown, DailyQuota: cfg.CodeSending.ConfirmPhone.DailyQuota},
+		MagicLink: services.SendLimit{Cooldown: cfg.CodeSending.MagicLink.Cooldown, DailyQuota: cfg.CodeSending.MagicLink.DailyQuota},
+	}, tempStor)
+	codeFormats := services.CodeFormats{
+		TwoFA: utils_random.OTPFormat{Length: cfg.Codes.TwoFA.Length, Alphabet: cfg.Codes.TwoFA.Alphabet, GroupSize: cfg.Codes.TwoFA.GroupSize},
+		EmailVerify: utils_random.OTPFormat{Length: cfg.Codes.EmailVerify.Length, Alphabet: cfg.Codes.EmailVerify.Alphabet, GroupSize: cfg.Codes.EmailVerify.GroupSize},
+		PassRecover: utils_random.OTPFormat{Length: cfg.Codes.PassRecover.Length, Alphabet: cfg.Codes.PassRecover.Alphabet, GroupSize: cfg.Codes.PassRecover.GroupSize},
+	}
+	sesService := services.NewSessionService(logger, cfg.JWTTokenTTL, cfg.RefreshTokenTTL, keyRing, tokenOptions, challengeBinding, revocationChecker, totpAuthenticator, recoveryCodes, passkeyAuthenticator, magicLinks, trustedDevices, codeAttemptsLimiter, codeSendLimiter, codeFormats, codeDeliverer, permStor, tempStor)
+
+	accService := services.NewAccountService(logger, cfg.JWTTokenTTL, sesService, sesService, revocationChecker, totpAuthenticator, recoveryCodes, codeAttemptsLimiter, codeSendLimiter, codeFormats, codeDeliverer, securityNotifier, permStor, tempStor)
 
 	t.Cleanup(func() {
 		t.Helper()
@@ -51,6 +125,39 @@ func NewTester(t *testing.T) (context.Context, *Tester) {
 		tempStor: tempStor,
 		accService: accService,
 		sesService: sesService,
-		emailSender: emailSender,
+		codeDeliverer: codeDeliverer,
+		emailChannel: emailChannel,
+		smsChannel: smsChannel,
+		securityNotifier: securityNotifier,
+		keyRing: keyRing,
+		tokenOptions: tokenOptions,
+		challengeBinding: challengeBinding,
+		revocationChecker: revocationChecker,
+		totpAuthenticator: totpAuthenticator,
+		recoveryCodes: recoveryCodes,
+		passkeyAuthenticator: passkeyAuthenticator,
+		magicLinks: magicLinks,
+		trustedDevices: trustedDevices,
+		codeAttemptsLimiter: codeAttemptsLimiter,
+		codeSendLimiter: codeSendLimiter,
+		codeFormats: codeFormats,
+	}
+}
+
+// wrongCodeOf returns a code of the same length and alphabet that differs from code
+func wrongCodeOf(code string) string {
+	last := code[len(code) - 1]
+	if last == '2' {
+		return code[:len(code) - 1] + "3"
 	}
-}
\ No newline at end of file
+	return code[:len(code) - 1] + "2"
+}
+
+// waitForFreshTOTPStep sleeps into the next time step when the current one is about to end,
+// TOTP codes the test takes from the step must not shift while it runs
+func waitForFreshTOTPStep() {
+	left := utils_totp.Period - time.Duration(time.Now().UnixNano() % int64(utils_totp.Period))
+	if left < 10 * time.Second {
+		time.Sleep(left)
+	}
+}
@@ -1,187 +1,1088 @@
 package services
 
 import (
+	"authSAS/internal/models"
 	"authSAS/internal/utils"
-	emailsender "authSAS/internal/utils/emailSender"
 	"authSAS/internal/utils/jwt"
 	"context"
 	"errors"
 	"log/slog"
 	"time"
 
+	utils_client "authSAS/internal/utils/clientInfo"
+	utils_hash "authSAS/internal/utils/hash"
 	utils_random "authSAS/internal/utils/randomCode"
+	utils_totp "authSAS/internal/utils/totp"
 
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type SessionService struct {
 	logger *slog.Logger
 	tokenTTL time.Duration
-	jwtSecret string
-	emailSender *emailsender.EmailSender
+	refreshTokenTTL time.Duration
+	keyRing *utils_jwt.KeyRing
+	tokenOptions utils_jwt.Options
+	challengeBinding ChallengeBinding
+	codeDeliverer CodeDeliverer
 	userGetter UserGetter
 	logoutJWTKeeper LogoutJWTKeeper
+	refreshTokenKeeper RefreshTokenKeeper
+	refreshTokenUser RefreshTokenUser
+	sessionKeeper SessionKeeper
+	sessionsGetter SessionsGetter
+	revocationChecker *RevocationChecker
+	totpAuthenticator *TOTPAuthenticator
+	recoveryCodes *RecoveryCodes
+	passkeyAuthenticator *PasskeyAuthenticator
+	magicLinks *MagicLinks
+	trustedDevices *TrustedDevices
+	trustedDevicesGetter TrustedDevicesGetter
+	trustedDeviceRevoker TrustedDeviceRevoker
+	codeAttemptsLimiter *CodeAttemptsLimiter
+	codeSendLimiter *CodeSendLimiter
+	codeFormats CodeFormats
+	sessionRevoker SessionRevoker
+	tokenVersionBumper TokenVersionBumper
+	loginChallengeKeeper LoginChallengeKeeper
+	loginChallengeGetter LoginChallengeGetter
+	loginChallengeDeleter LoginChallengeDeleter
 	twoFACodeKeeper TwoFACodeKeeper
-	twoFACodeGetter TwoFACodeGetter
+	codeConsumer CodeConsumer
 }
 
-func NewSessionService(logger *slog.Logger, tokenTTL time.Duration, secret string, emailSender *emailsender.EmailSender, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *SessionService {
+func NewSessionService(logger *slog.Logger, tokenTTL time.Duration, refreshTokenTTL time.Duration, keyRing *utils_jwt.KeyRing, tokenOptions utils_jwt.Options, challengeBinding ChallengeBinding, revocationChecker *RevocationChecker, totpAuthenticator *TOTPAuthenticator, recoveryCodes *RecoveryCodes, passkeyAuthenticator *PasskeyAuthenticator, magicLinks *MagicLinks, trustedDevices *TrustedDevices, codeAttemptsLimiter *CodeAttemptsLimiter, codeSendLimiter *CodeSendLimiter, codeFormats CodeFormats, codeDeliverer CodeDeliverer, permanentStorage PermanentStorage, temporaryStorage TemporaryStorage) *SessionService {
 	return &SessionService{
 		logger: logger,
 		tokenTTL: tokenTTL,
-		jwtSecret: secret, 
-		emailSender: emailSender,
+		refreshTokenTTL: refreshTokenTTL,
+		keyRing: keyRing,
+		tokenOptions: tokenOptions,
+		challengeBinding: challengeBinding,
+		codeDeliverer: codeDeliverer,
 		userGetter: permanentStorage,
 		logoutJWTKeeper: permanentStorage,
+		refreshTokenKeeper: permanentStorage,
+		refreshTokenUser: permanentStorage,
+		sessionKeeper: permanentStorage,
+		sessionsGetter: permanentStorage,
+		revocationChecker: revocationChecker,
+		totpAuthenticator: totpAuthenticator,
+		recoveryCodes: recoveryCodes,
+		passkeyAuthenticator: passkeyAuthenticator,
+		magicLinks: magicLinks,
+		trustedDevices: trustedDevices,
+		trustedDevicesGetter: permanentStorage,
+		trustedDeviceRevoker: permanentStorage,
+		codeAttemptsLimiter: codeAttemptsLimiter,
+		codeSendLimiter: codeSendLimiter,
+		codeFormats: codeFormats,
+		sessionRevoker: permanentStorage,
+		tokenVersionBumper: revocationChecker,
+		loginChallengeKeeper: temporaryStorage,
+		loginChallengeGetter: temporaryStorage,
+		loginChallengeDeleter: temporaryStorage,
 		twoFACodeKeeper: temporaryStorage,
-		twoFACodeGetter: temporaryStorage,
+		codeConsumer: temporaryStorage,
 	}
 }
 
 
-func (s *SessionService) Login(ctx context.Context, email string, password string) (token string, msg string, err error) {
+// Login checks the password. When the user has a second factor no tokens are issued,
+// challengeId of the pending login goes to LoginWith2FACode or BeginPasskeyLogin instead
+func (s *SessionService) Login(ctx context.Context, email string, password string) (token string, refreshToken string, challengeId string, msg string, err error) {
 
 	s.logger.Debug("Trying to login user", "email", email)
 
 	if email == "" {
 		s.logger.Debug("User login error", "email", email, "err", utils.ErrEmptyEmail)
-		return "", "Error", utils.ErrInvalidCredentials
+		return "", "", "", "Error", utils.ErrInvalidCredentials
 	}
 
 	if password == "" {
 		s.logger.Debug("User login error", "email", email, "err", utils.ErrEmptyPassword)
-		return "", "Error", utils.ErrInvalidCredentials
+		return "", "", "", "Error", utils.ErrInvalidCredentials
 	}
 
 	user, err := s.userGetter.GetUserByEmail(ctx, email)
 	if err != nil {
 		s.logger.Debug("User login error", "email", email, "err", err.Error())
 		if err == utils.ErrUserNotFound {
-			return "", "Error", utils.ErrInvalidCredentials
+			return "", "", "", "Error", utils.ErrInvalidCredentials
 		}
-		return "", "Error", utils.ErrInternalServer
+		return "", "", "", "Error", utils.ErrInternalServer
 	}
 
 	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
 		s.logger.Debug("User login error", "email", email, "err", "invalid password (not null)")
-		return "", "Error", utils.ErrInvalidCredentials
+		return "", "", "", "Error", utils.ErrInvalidCredentials
 	}
 
-	if user.Use2FA {
-		s.logger.Debug("Trying to send 2FA code", "email", email)
+	return s.continueLogin(ctx, user)
+}
 
-		randCode := utils_random.RandRange(1000, 9999)
+// RequestMagicLink emails a single-use passwordless login link to the user
+func (s *SessionService) RequestMagicLink(ctx context.Context, email string) (msg string, err error) {
 
-		s.emailSender.SendEmail(email, randCode)
+	s.logger.Debug("Trying to send magic link", "email", email)
 
-		if err = s.twoFACodeKeeper.KeepTwoFACode(ctx, email, randCode); err != nil {
-			s.logger.Debug("Sending 2FA code error", "email", email, "err", err.Error())
-			return "", "Error", utils.ErrInternalServer
+	if email == "" {
+		s.logger.Debug("Sending magic link error", "email", email, "err", utils.ErrEmptyEmail)
+		return "Error", utils.ErrInvalidCredentials
+	}
+
+	user, err := s.userGetter.GetUserByEmail(ctx, email)
+	if err != nil {
+		s.logger.Debug("Sending magic link error", "email", email, "err", err.Error())
+		if err == utils.ErrUserNotFound {
+			return "Error", utils.ErrInvalidCredentials
 		}
+		return "Error", utils.ErrInternalServer
+	}
 
-		s.logger.Debug("2FA code sended", "email", email, "code", randCode)
+	if !s.magicLinks.Enabled() {
+		s.logger.Debug("Sending magic link error", "email", email, "err", utils.ErrMagicLinkDisabled)
+		return "Error", utils.ErrMagicLinkDisabled
+	}
 
-		return "", "2FA code sended", nil
+	// a limited request must not leave a usable link behind
+	if err := s.codeSendLimiter.Reserve(ctx, models.CodePurposeMagicLink, user.Email); err != nil {
+		s.logger.Debug("Sending magic link error", "email", email, "err", err.Error())
+		return "Error", err
 	}
 
-	token, err = utils_jwt.NewToken(user, s.tokenTTL, s.jwtSecret)
+	link, err := s.magicLinks.Issue(ctx, user)
 	if err != nil {
-		s.logger.Debug("User login error", "email", email, "err", err.Error())
-		return "", "Error", utils.ErrInternalServer
+		s.logger.Debug("Sending magic link error", "email", email, "err", err.Error())
+		return "Error", utils.ErrInternalServer
 	}
 
-	s.logger.Debug("User logined succesfully", "email", email)
+	s.codeDeliverer.DeliverCode(ctx, user, models.CodeMessage{Purpose: models.CodePurposeMagicLink, Code: link})
 
-	return token, "Authorized", nil
+	s.logger.Debug("Magic link sended", "email", email)
+
+	return "Link sended", nil
 }
 
-func (s *SessionService) Logout(ctx context.Context, tokenString string) (msg string, err error) {
+// ConsumeMagicLink logs in by the link token in place of the password, the rest goes like Login,
+// so a user with a second factor gets challengeId instead of tokens
+func (s *SessionService) ConsumeMagicLink(ctx context.Context, linkToken string) (token string, refreshToken string, challengeId string, msg string, err error) {
 
-	s.logger.Debug("Trying to logout user", "token", tokenString)
+	s.logger.Debug("Trying to login user by magic link")
 
-	if tokenString == "" {
-		s.logger.Debug("Logout user error", "token", tokenString, "err", utils.ErrEmptyJWT)
-		return "Error", utils.ErrInvalidCredentials
+	if linkToken == "" {
+		s.logger.Debug("Magic link login error", "err", "null link token")
+		return "", "", "", "Error", utils.ErrInvalidCredentials
+	}
+
+	uid, email, err := s.magicLinks.Redeem(ctx, linkToken)
+	if err != nil {
+		s.logger.Debug("Magic link login error", "err", err.Error())
+		if errors.Is(err, utils.ErrMagicLinkDisabled) || errors.Is(err, utils.ErrInvalidCredentials) {
+			return "", "", "", "Error", err
+		}
+		if errors.Is(err, utils.ErrMagicLinkUsed) {
+			return "", "", "", "Error", utils.ErrInvalidCredentials
+		}
+		return "", "", "", "Error", utils.ErrInternalServer
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, uid)
+	if err != nil {
+		s.logger.Debug("Magic link login error", "uid", uid, "err", err.Error())
+		if err == utils.ErrUserNotFound {
+			return "", "", "", "Error", utils.ErrInvalidCredentials
+		}
+		return "", "", "", "Error", utils.ErrInternalServer
+	}
+
+	// the link was sent to another address
+	if user.Email != email {
+		s.logger.Debug("Magic link login error", "uid", uid, "err", "email changed since the link was sent")
+		return "", "", "", "Error", utils.ErrInvalidCredentials
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
+	return s.continueLogin(ctx, user)
+}
+
+// continueLogin follows the first factor of the user: starts the second factor or issues tokens,
+// the second factor is skipped on a trusted device
+func (s *SessionService) continueLogin(ctx context.Context, user models.User) (token string, refreshToken string, challengeId string, msg string, err error) {
+
+	trusted := false
+	if user.TOTPEnabled || user.Use2FA {
+		trusted, err = s.trustedDevices.IsTrusted(ctx, user)
+		if err != nil {
+			s.logger.Debug("User login error", "email", user.Email, "err", err.Error())
+			return "", "", "", "Error", utils.ErrInternalServer
 		}
-		return []byte(s.jwtSecret), nil
-	})
+	}
+
+	// authenticator app replaces emailed codes
+	if user.TOTPEnabled && !trusted {
+		challengeId, err = s.startLoginChallenge(ctx, user, "")
+		if err != nil {
+			s.logger.Debug("User login error", "email", user.Email, "err", err.Error())
+			return "", "", "", "Error", utils.ErrInternalServer
+		}
+
+		s.logger.Debug("TOTP code required", "email", user.Email)
+
+		return "", "", challengeId, "TOTP code required", nil
+	}
 
-	if err != nil || !token.Valid {
-		s.logger.Debug("Trying to logout user", "token", tokenString, "err", "invalid token")
+	if user.Use2FA && !trusted {
+		s.logger.Debug("Trying to send 2FA code", "email", user.Email)
+
+		if err := s.codeSendLimiter.Reserve(ctx, models.CodePurposeTwoFA, user.Email); err != nil {
+			s.logger.Debug("Sending 2FA code error", "email", user.Email, "err", err.Error())
+			return "", "", "", "Error", err
+		}
+
+		code, formattedCode, err := utils_random.NewOTP(s.codeFormats.TwoFA)
+		if err != nil {
+			s.logger.Debug("Sending 2FA code error", "email", user.Email, "err", err.Error())
+			return "", "", "", "Error", utils.ErrInternalServer
+		}
+
+		s.codeDeliverer.DeliverCode(ctx, user, models.CodeMessage{Purpose: models.CodePurposeTwoFA, Code: formattedCode})
+
+		challengeId, err = s.startLoginChallenge(ctx, user, code)
+		if err != nil {
+			s.logger.Debug("Sending 2FA code error", "email", user.Email, "err", err.Error())
+			return "", "", "", "Error", utils.ErrInternalServer
+		}
+
+		s.logger.Debug("2FA code sended", "email", user.Email)
+
+		return "", "", challengeId, "2FA code sended", nil
+	}
+
+	token, refreshToken, err = s.issueTokens(ctx, user, "", time.Time{})
+	if err != nil {
+		s.logger.Debug("User login error", "email", user.Email, "err", err.Error())
+		return "", "", "", "Error", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User logined succesfully", "email", user.Email)
+
+	return token, refreshToken, "", "Authorized", nil
+}
+
+func (s *SessionService) Logout(ctx context.Context, tokenString string) (msg string, err error) {
+
+	s.logger.Debug("Trying to logout user")
+
+	if tokenString == "" {
+		s.logger.Debug("Logout user error", "err", utils.ErrEmptyJWT)
 		return "Error", utils.ErrInvalidCredentials
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		s.logger.Debug("Trying to logout user", "token", tokenString, "err", "invalid claims in token")
+	claims, err := utils_jwt.ParseToken(tokenString, s.keyRing, s.tokenOptions)
+	if err != nil {
+		s.logger.Debug("Trying to logout user", "err", "invalid token")
 		return "Error", utils.ErrInvalidCredentials
 	}
-	uid := int64(claims["uid"].(float64))
 
-	if err := s.logoutJWTKeeper.KeepLogoutJWT(ctx, uid, tokenString); err != nil {
-		s.logger.Debug("Trying to logout user", "token", tokenString, "err", err.Error())
+	uid := claims.UID
+	expiresAt := claims.ExpiresAt.Time
+
+	if err := s.logoutJWTKeeper.KeepLogoutJWT(ctx, uid, claims.ID, expiresAt); err != nil {
+		s.logger.Debug("Trying to logout user", "jti", claims.ID, "uid", uid, "err", err.Error())
 		if errors.Is(err, utils.ErrJWTAlreadyAdded) {
 			return "Error", utils.ErrJWTAlreadyAdded
 		}
 		return "Error", utils.ErrInternalServer
 	}
 
-	s.logger.Debug("User logouted succesfully", "token", tokenString, "uid", uid)
+	// logout ends the session, so its refresh token can't bring it back
+	if err := s.sessionRevoker.RevokeSession(ctx, uid, claims.SessionId); err != nil && !errors.Is(err, utils.ErrSessionNotFound) {
+		s.logger.Debug("Trying to logout user", "jti", claims.ID, "uid", uid, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := s.revocationChecker.MarkRevoked(ctx, claims.ID, time.Until(expiresAt)); err != nil {
+		s.logger.Warn("Revocation cache keep error", "uid", uid, "err", err.Error())
+	}
+
+	s.logger.Debug("User logouted succesfully", "jti", claims.ID, "uid", uid)
 
 	return "Success", nil
 }
 
-func (s *SessionService) LoginWith2FACode(ctx context.Context, email string, code int) (token string, err error) {
+func (s *SessionService) ValidateToken(ctx context.Context, tokenString string) (uid int64, email string, isAdmin bool, err error) {
 
-	s.logger.Debug("Trying to 2FA login user", "email", email, "code", code)
+	s.logger.Debug("Trying to validate token")
 
-	if email == "" {
-		s.logger.Debug("User 2FA login error", "email", email, "err", utils.ErrEmptyEmail)
-		return "", utils.ErrInvalidCredentials
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Validating token error", "err", err.Error())
+		return 0, "", false, err
 	}
 
-	if code == 0 {
-		s.logger.Debug("User 2FA login error", "email", email, "err", "null 2FA code")
-		return "", utils.ErrInvalidCredentials
+	uid = claims.UID
+	email = claims.Email
+	isAdmin = claims.IsAdmin
+
+	s.logger.Debug("Token validated succesfully", "jti", claims.ID, "uid", uid)
+
+	return uid, email, isAdmin, nil
+}
+
+// IntrospectToken runs the same checks as ValidateToken, invalid, expired or revoked token is just not active (RFC 7662)
+func (s *SessionService) IntrospectToken(ctx context.Context, tokenString string) (claims *utils_jwt.Claims, active bool, err error) {
+
+	s.logger.Debug("Trying to introspect token")
+
+	claims, err = s.checkToken(ctx, tokenString)
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidCredentials) || errors.Is(err, utils.ErrJWTRevoked) {
+			s.logger.Debug("Token is not active", "err", err.Error())
+			return nil, false, nil
+		}
+		s.logger.Debug("Introspecting token error", "err", err.Error())
+		return nil, false, err
+	}
+
+	s.logger.Debug("Token is active", "jti", claims.ID, "uid", claims.UID)
+
+	return claims, true, nil
+}
+
+// LoginWith2FACode finishes the login started by Login, the code may be emailed one,
+// authenticator app one or a recovery code. It works only from the client that passed the password step.
+// With rememberDevice the client gets deviceTrustToken, Login skips the second factor while it is sent
+func (s *SessionService) LoginWith2FACode(ctx context.Context, challengeId string, code string, rememberDevice bool) (token string, refreshToken string, deviceTrustToken string, err error) {
+
+	s.logger.Debug("Trying to 2FA login user", "challenge", challengeId)
+
+	code = utils_random.NormalizeOTP(code)
+
+	if code == "" {
+		s.logger.Debug("User 2FA login error", "challenge", challengeId, "err", "null 2FA code")
+		return "", "", "", utils.ErrInvalidCredentials
+	}
+
+	challenge, err := s.getLoginChallenge(ctx, challengeId)
+	if err != nil {
+		s.logger.Debug("User 2FA login error", "challenge", challengeId, "err", err.Error())
+		if errors.Is(err, utils.ErrInternalServer) {
+			return "", "", "", utils.ErrInternalServer
+		}
+		return "", "", "", utils.ErrInvalidCredentials
 	}
 
-	sendedCode, err := s.twoFACodeGetter.GetTwoFACode(ctx, email)
+	user, err := s.userGetter.GetUserById(ctx, challenge.UserId)
 	if err != nil {
-		s.logger.Debug("User 2FA login error", "email", email, "err", err.Error())
-		if err == utils.Err2FACodeNotFound {
-			return "", utils.ErrInvalidCredentials
+		s.logger.Debug("User 2FA login error", "uid", challenge.UserId, "err", err.Error())
+		if err == utils.ErrUserNotFound {
+			return "", "", "", utils.ErrInvalidCredentials
 		}
-		return "", utils.ErrInternalServer
+		return "", "", "", utils.ErrInternalServer
 	}
 
-	if sendedCode != code {
-		s.logger.Debug("User 2FA login error", "email", email, "err", "invalid 2FA code")
-		return "", utils.ErrInvalidCredentials
+	// emailed code goes first, its format may look like a recovery or TOTP code
+	emailed, err := s.consumeEmailed2FACode(ctx, challengeId, code)
+	switch {
+	case err != nil || emailed:
+	case isRecoveryCode(code):
+		err = s.checkRecoveryCodeLogin(ctx, user, code)
+	case user.TOTPEnabled:
+		err = s.checkTOTPLogin(ctx, user, code)
+	default:
+		err = utils.ErrWrong2FACode
+	}
+	if err != nil {
+		s.logger.Debug("User 2FA login error", "uid", user.Id, "err", err.Error())
+		if errors.Is(err, utils.ErrInternalServer) {
+			return "", "", "", utils.ErrInternalServer
+		}
+		// every wrong guess counts against the challenge, whatever kind of code it was
+		return "", "", "", s.codeAttemptsLimiter.wrongCode(ctx, models.CodePurposeLogin, challengeId)
 	}
 
-	user, err := s.userGetter.GetUserByEmail(ctx, email)
+	// the challenge is burnt right away, a concurrent call with the same code loses here
+	if err := s.loginChallengeDeleter.DeleteLoginChallenge(ctx, challengeId); err != nil {
+		s.logger.Debug("User 2FA login error", "uid", user.Id, "err", err.Error())
+		if errors.Is(err, utils.ErrLoginChallengeNotFound) {
+			return "", "", "", utils.ErrInvalidCredentials
+		}
+		return "", "", "", utils.ErrInternalServer
+	}
+
+	token, refreshToken, err = s.issueTokens(ctx, user, "", time.Time{})
 	if err != nil {
-		s.logger.Debug("User 2FA login error", "email", email, "err", err.Error())
+		s.logger.Debug("User 2FA login error", "uid", user.Id, "err", err.Error())
+		return "", "", "", utils.ErrInternalServer
+	}
+
+	// the login succeeded anyway, the client is asked for the second factor next time
+	if rememberDevice {
+		deviceTrustToken, err = s.trustedDevices.Trust(ctx, user)
+		if err != nil {
+			s.logger.Warn("Device trust error", "uid", user.Id, "err", err.Error())
+			deviceTrustToken = ""
+		}
+	}
+
+	s.logger.Debug("User logined with 2FA succesfully", "email", user.Email)
+
+	return token, refreshToken, deviceTrustToken, nil
+
+}
+
+// EnrollTOTP creates authenticator app secret of the token's user, qrCode is PNG of uri when withQRCode
+func (s *SessionService) EnrollTOTP(ctx context.Context, tokenString string, withQRCode bool) (secret string, uri string, qrCode []byte, err error) {
+
+	s.logger.Debug("Trying to enroll TOTP")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("TOTP enrollment error", "err", err.Error())
+		return "", "", nil, err
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, claims.UID)
+	if err != nil {
+		s.logger.Debug("TOTP enrollment error", "uid", claims.UID, "err", err.Error())
+		return "", "", nil, utils.ErrInternalServer
+	}
+
+	secret, uri, err = s.totpAuthenticator.Enroll(ctx, user)
+	if err != nil {
+		s.logger.Debug("TOTP enrollment error", "uid", claims.UID, "err", err.Error())
+		if errors.Is(err, utils.ErrTOTPAlreadyEnabled) || errors.Is(err, utils.ErrTOTPDisabled) {
+			return "", "", nil, err
+		}
+		return "", "", nil, utils.ErrInternalServer
+	}
+
+	if withQRCode {
+		qrCode, err = utils_totp.QRCode(uri)
+		if err != nil {
+			s.logger.Debug("TOTP enrollment error", "uid", claims.UID, "err", err.Error())
+			return "", "", nil, utils.ErrInternalServer
+		}
+	}
+
+	s.logger.Debug("TOTP enrolled, waiting for confirmation", "uid", claims.UID)
+
+	return secret, uri, qrCode, nil
+}
+
+// ConfirmTOTP enables enrolled TOTP by the first code from the app. Recovery codes are
+// returned (the only time they are shown) when it is the first second factor of the user
+func (s *SessionService) ConfirmTOTP(ctx context.Context, tokenString string, code string) (msg string, recoveryCodes []string, err error) {
+
+	s.logger.Debug("Trying to confirm TOTP")
+
+	code = utils_random.NormalizeOTP(code)
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("TOTP confirmation error", "err", err.Error())
+		return "Error", nil, err
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, claims.UID)
+	if err != nil {
+		s.logger.Debug("TOTP confirmation error", "uid", claims.UID, "err", err.Error())
+		return "Error", nil, utils.ErrInternalServer
+	}
+
+	if err := s.totpAuthenticator.Confirm(ctx, user, code); err != nil {
+		s.logger.Debug("TOTP confirmation error", "uid", claims.UID, "err", err.Error())
+		switch {
+		case errors.Is(err, utils.ErrWrong2FACode), errors.Is(err, utils.ErrTOTPCodeReused):
+			return "Error", nil, utils.ErrWrong2FACode
+		case errors.Is(err, utils.ErrTOTPNotEnrolled), errors.Is(err, utils.ErrTOTPAlreadyEnabled), errors.Is(err, utils.ErrTOTPDisabled):
+			return "Error", nil, err
+		}
+		return "Error", nil, utils.ErrInternalServer
+	}
+
+	if !user.Use2FA {
+		recoveryCodes, err = s.recoveryCodes.Generate(ctx, user.Id)
+		if err != nil {
+			s.logger.Debug("TOTP confirmation error", "uid", claims.UID, "err", err.Error())
+			return "Error", nil, utils.ErrInternalServer
+		}
+	}
+
+	s.logger.Debug("TOTP enabled", "uid", claims.UID)
+
+	return "TOTP enabled", recoveryCodes, nil
+}
+
+// BeginPasskeyRegistration starts WebAuthn registration for the token's user,
+// options are PublicKeyCredentialCreationOptions JSON, challengeId goes back to FinishPasskeyRegistration
+func (s *SessionService) BeginPasskeyRegistration(ctx context.Context, tokenString string) (options []byte, challengeId string, err error) {
+
+	s.logger.Debug("Trying to begin passkey registration")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Passkey registration error", "err", err.Error())
+		return nil, "", err
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, claims.UID)
+	if err != nil {
+		s.logger.Debug("Passkey registration error", "uid", claims.UID, "err", err.Error())
+		return nil, "", utils.ErrInternalServer
+	}
+
+	options, challengeId, err = s.passkeyAuthenticator.BeginRegistration(ctx, user)
+	if err != nil {
+		s.logger.Debug("Passkey registration error", "uid", claims.UID, "err", err.Error())
+		if errors.Is(err, utils.ErrWebAuthnDisabled) {
+			return nil, "", err
+		}
+		return nil, "", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("Passkey registration started", "uid", claims.UID)
+
+	return options, challengeId, nil
+}
+
+// FinishPasskeyRegistration stores the passkey, response is the JSON of navigator.credentials.create() result
+func (s *SessionService) FinishPasskeyRegistration(ctx context.Context, tokenString string, challengeId string, response []byte) (msg string, err error) {
+
+	s.logger.Debug("Trying to finish passkey registration")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Passkey registration error", "err", err.Error())
+		return "Error", err
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, claims.UID)
+	if err != nil {
+		s.logger.Debug("Passkey registration error", "uid", claims.UID, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := s.passkeyAuthenticator.FinishRegistration(ctx, user, challengeId, response); err != nil {
+		s.logger.Debug("Passkey registration error", "uid", claims.UID, "err", err.Error())
+		switch {
+		case errors.Is(err, utils.ErrWebAuthnSessionNotFound), errors.Is(err, utils.ErrInvalidCredentials):
+			return "Error", utils.ErrInvalidCredentials
+		case errors.Is(err, utils.ErrWebAuthnDisabled), errors.Is(err, utils.ErrWebAuthnCredentialAlreadyExists):
+			return "Error", err
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("Passkey registered", "uid", claims.UID)
+
+	return "Passkey registered", nil
+}
+
+// BeginPasskeyLogin starts WebAuthn assertion. With challengeId of Login it is the second factor
+// and the login challenge is exchanged for the passkey one, empty challengeId starts passwordless login
+func (s *SessionService) BeginPasskeyLogin(ctx context.Context, loginChallengeId string) (options []byte, challengeId string, err error) {
+
+	s.logger.Debug("Trying to begin passkey login", "challenge", loginChallengeId)
+
+	var user *models.User
+
+	if loginChallengeId != "" {
+		challenge, err := s.getLoginChallenge(ctx, loginChallengeId)
+		if err != nil {
+			s.logger.Debug("Passkey login error", "challenge", loginChallengeId, "err", err.Error())
+			if errors.Is(err, utils.ErrInternalServer) {
+				return nil, "", utils.ErrInternalServer
+			}
+			return nil, "", utils.ErrInvalidCredentials
+		}
+
+		found, err := s.userGetter.GetUserById(ctx, challenge.UserId)
+		if err != nil {
+			s.logger.Debug("Passkey login error", "uid", challenge.UserId, "err", err.Error())
+			if err == utils.ErrUserNotFound {
+				return nil, "", utils.ErrInvalidCredentials
+			}
+			return nil, "", utils.ErrInternalServer
+		}
+
+		user = &found
+	}
+
+	options, challengeId, err = s.passkeyAuthenticator.BeginLogin(ctx, user)
+	if err != nil {
+		s.logger.Debug("Passkey login error", "challenge", loginChallengeId, "err", err.Error())
+		switch {
+		case errors.Is(err, utils.ErrPasskeyNotFound):
+			return nil, "", utils.ErrInvalidCredentials
+		case errors.Is(err, utils.ErrWebAuthnDisabled):
+			return nil, "", err
+		}
+		return nil, "", utils.ErrInternalServer
+	}
+
+	// the login challenge is dropped only once the passkey one exists, so a user without passkeys
+	// can still finish the login with another second factor
+	if user != nil {
+		if err := s.loginChallengeDeleter.DeleteLoginChallenge(ctx, loginChallengeId); err != nil {
+			s.logger.Debug("Passkey login error", "uid", user.Id, "err", err.Error())
+			if errors.Is(err, utils.ErrLoginChallengeNotFound) {
+				return nil, "", utils.ErrInvalidCredentials
+			}
+			return nil, "", utils.ErrInternalServer
+		}
+	}
+
+	s.logger.Debug("Passkey login started", "challenge", loginChallengeId)
+
+	return options, challengeId, nil
+}
+
+// FinishPasskeyLogin checks the JSON of navigator.credentials.get() result and issues tokens
+func (s *SessionService) FinishPasskeyLogin(ctx context.Context, challengeId string, response []byte) (token string, refreshToken string, err error) {
+
+	s.logger.Debug("Trying to finish passkey login")
+
+	user, err := s.passkeyAuthenticator.FinishLogin(ctx, challengeId, response)
+	if err != nil {
+		s.logger.Debug("Passkey login error", "err", err.Error())
+		switch {
+		case errors.Is(err, utils.ErrWebAuthnSessionNotFound), errors.Is(err, utils.ErrInvalidCredentials):
+			return "", "", utils.ErrInvalidCredentials
+		case errors.Is(err, utils.ErrWebAuthnDisabled):
+			return "", "", err
+		}
+		return "", "", utils.ErrInternalServer
+	}
+
+	token, refreshToken, err = s.issueTokens(ctx, user, "", time.Time{})
+	if err != nil {
+		s.logger.Debug("Passkey login error", "uid", user.Id, "err", err.Error())
+		return "", "", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User logined with passkey succesfully", "email", user.Email)
+
+	return token, refreshToken, nil
+}
+
+func (s *SessionService) Refresh(ctx context.Context, refreshToken string) (token string, newRefreshToken string, err error) {
+
+	s.logger.Debug("Trying to refresh tokens")
+
+	if refreshToken == "" {
+		s.logger.Debug("Refreshing tokens error", "err", utils.ErrEmptyJWT)
+		return "", "", utils.ErrInvalidCredentials
+	}
+
+	oldToken, err := s.refreshTokenUser.UseRefreshToken(ctx, utils_hash.SHA256(refreshToken))
+	if err != nil {
+		s.logger.Debug("Refreshing tokens error", "err", err.Error())
+		switch {
+		case errors.Is(err, utils.ErrRefreshTokenReused):
+			// rotated token was presented again, so the whole family (session) is considered stolen
+			if err := s.sessionRevoker.RevokeSession(ctx, oldToken.UserId, oldToken.FamilyId); err != nil {
+				s.logger.Debug("Refreshing tokens error", "uid", oldToken.UserId, "err", err.Error())
+				return "", "", utils.ErrInternalServer
+			}
+			s.markSessionRevoked(ctx, oldToken.FamilyId)
+			s.logger.Warn("Refresh token reuse detected, session revoked", "uid", oldToken.UserId, "sid", oldToken.FamilyId)
+			return "", "", utils.ErrRefreshTokenReused
+		case errors.Is(err, utils.ErrRefreshTokenNotFound), errors.Is(err, utils.ErrRefreshTokenRevoked):
+			return "", "", utils.ErrInvalidCredentials
+		}
+		return "", "", utils.ErrInternalServer
+	}
+
+	if time.Now().After(oldToken.ExpiresAt) {
+		s.logger.Debug("Refreshing tokens error", "uid", oldToken.UserId, "err", "refresh token expired")
+		return "", "", utils.ErrInvalidCredentials
+	}
+
+	user, err := s.userGetter.GetUserById(ctx, oldToken.UserId)
+	if err != nil {
+		s.logger.Debug("Refreshing tokens error", "uid", oldToken.UserId, "err", err.Error())
 		if err == utils.ErrUserNotFound {
-			return "", utils.ErrInvalidCredentials
+			return "", "", utils.ErrInvalidCredentials
+		}
+		return "", "", utils.ErrInternalServer
+	}
+
+	token, newRefreshToken, err = s.issueTokens(ctx, user, oldToken.FamilyId, oldToken.ExpiresAt)
+	if err != nil {
+		s.logger.Debug("Refreshing tokens error", "uid", oldToken.UserId, "err", err.Error())
+		return "", "", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("Tokens refreshed succesfully", "uid", oldToken.UserId)
+
+	return token, newRefreshToken, nil
+}
+
+// ListSessions returns active sessions of the token owner and id of the token's session
+func (s *SessionService) ListSessions(ctx context.Context, tokenString string) (sessions []models.Session, currentSessionId string, err error) {
+
+	s.logger.Debug("Trying to list user's sessions")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Listing user's sessions error", "err", err.Error())
+		return nil, "", err
+	}
+
+	uid := claims.UID
+
+	sessions, err = s.sessionsGetter.GetUserSessions(ctx, uid)
+	if err != nil {
+		s.logger.Debug("Listing user's sessions error", "uid", uid, "err", err.Error())
+		return nil, "", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User's sessions listed", "uid", uid, "count", len(sessions))
+
+	return sessions, claims.SessionId, nil
+}
+
+func (s *SessionService) RevokeSession(ctx context.Context, tokenString string, sessionId string) (msg string, err error) {
+
+	s.logger.Debug("Trying to revoke user's session", "sid", sessionId)
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Revoking user's session error", "sid", sessionId, "err", err.Error())
+		return "Error", err
+	}
+
+	uid := claims.UID
+
+	if sessionId == "" {
+		s.logger.Debug("Revoking user's session error", "uid", uid, "err", utils.ErrSessionNotFound)
+		return "Error", utils.ErrSessionNotFound
+	}
+
+	if err := s.sessionRevoker.RevokeSession(ctx, uid, sessionId); err != nil {
+		s.logger.Debug("Revoking user's session error", "uid", uid, "sid", sessionId, "err", err.Error())
+		if errors.Is(err, utils.ErrSessionNotFound) {
+			return "Error", utils.ErrSessionNotFound
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	s.markSessionRevoked(ctx, sessionId)
+
+	s.logger.Debug("User's session revoked", "uid", uid, "sid", sessionId)
+
+	return "Success", nil
+}
+
+func (s *SessionService) RevokeOtherSessions(ctx context.Context, tokenString string) (msg string, err error) {
+
+	s.logger.Debug("Trying to revoke user's other sessions")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Revoking user's other sessions error", "err", err.Error())
+		return "Error", err
+	}
+
+	uid := claims.UID
+	currentSessionId := claims.SessionId
+
+	sessions, err := s.sessionsGetter.GetUserSessions(ctx, uid)
+	if err != nil {
+		s.logger.Debug("Revoking user's other sessions error", "uid", uid, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	if err := s.sessionRevoker.RevokeOtherSessions(ctx, uid, currentSessionId); err != nil {
+		s.logger.Debug("Revoking user's other sessions error", "uid", uid, "err", err.Error())
+		return "Error", utils.ErrInternalServer
+	}
+
+	for _, session := range sessions {
+		if session.Id != currentSessionId {
+			s.markSessionRevoked(ctx, session.Id)
+		}
+	}
+
+	s.logger.Debug("User's other sessions revoked", "uid", uid)
+
+	return "Success", nil
+}
+
+// ListTrustedDevices returns devices of the token owner that skip the second factor
+func (s *SessionService) ListTrustedDevices(ctx context.Context, tokenString string) (devices []models.TrustedDevice, err error) {
+
+	s.logger.Debug("Trying to list user's trusted devices")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Listing user's trusted devices error", "err", err.Error())
+		return nil, err
+	}
+
+	uid := claims.UID
+
+	devices, err = s.trustedDevicesGetter.GetUserTrustedDevices(ctx, uid)
+	if err != nil {
+		s.logger.Debug("Listing user's trusted devices error", "uid", uid, "err", err.Error())
+		return nil, utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User's trusted devices listed", "uid", uid, "count", len(devices))
+
+	return devices, nil
+}
+
+// RevokeTrustedDevice makes the device ask for the second factor again
+func (s *SessionService) RevokeTrustedDevice(ctx context.Context, tokenString string, deviceId string) (msg string, err error) {
+
+	s.logger.Debug("Trying to revoke user's trusted device", "device", deviceId)
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Revoking user's trusted device error", "device", deviceId, "err", err.Error())
+		return "Error", err
+	}
+
+	uid := claims.UID
+
+	if deviceId == "" {
+		s.logger.Debug("Revoking user's trusted device error", "uid", uid, "err", utils.ErrTrustedDeviceNotFound)
+		return "Error", utils.ErrTrustedDeviceNotFound
+	}
+
+	if err := s.trustedDeviceRevoker.RevokeTrustedDevice(ctx, uid, deviceId); err != nil {
+		s.logger.Debug("Revoking user's trusted device error", "uid", uid, "device", deviceId, "err", err.Error())
+		if errors.Is(err, utils.ErrTrustedDeviceNotFound) {
+			return "Error", utils.ErrTrustedDeviceNotFound
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User's trusted device revoked", "uid", uid, "device", deviceId)
+
+	return "Success", nil
+}
+
+// LogoutAll invalidates every token and session of the token owner, the current one included
+func (s *SessionService) LogoutAll(ctx context.Context, tokenString string) (msg string, err error) {
+
+	s.logger.Debug("Trying to logout user everywhere")
+
+	claims, err := s.checkToken(ctx, tokenString)
+	if err != nil {
+		s.logger.Debug("Logout user everywhere error", "err", err.Error())
+		return "Error", err
+	}
+
+	uid := claims.UID
+
+	if err := s.tokenVersionBumper.BumpTokenVersion(ctx, uid); err != nil {
+		s.logger.Debug("Logout user everywhere error", "uid", uid, "err", err.Error())
+		if errors.Is(err, utils.ErrUserNotFound) {
+			return "Error", utils.ErrInvalidCredentials
+		}
+		return "Error", utils.ErrInternalServer
+	}
+
+	s.logger.Debug("User logouted everywhere succesfully", "uid", uid)
+
+	return "Success", nil
+}
+
+// GetJWKS returns public keys that verify issued tokens
+func (s *SessionService) GetJWKS(ctx context.Context) (jwks utils_jwt.JWKS, err error) {
+	return s.keyRing.JWKS(), nil
+}
+
+// startLoginChallenge keeps the pending login of the user with the client's ip and user agent,
+// code is the emailed one (empty for authenticator app), it is kept apart from the challenge
+func (s *SessionService) startLoginChallenge(ctx context.Context, user models.User, code string) (challengeId string, err error) {
+	challengeId, err = utils_random.RandToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	clientIP, userAgent := utils_client.FromContext(ctx)
+
+	challenge := models.LoginChallenge{
+		Id: challengeId,
+		UserId: user.Id,
+		ClientIP: clientIP,
+		UserAgent: userAgent,
+	}
+
+	if err := s.loginChallengeKeeper.KeepLoginChallenge(ctx, challenge); err != nil {
+		return "", err
+	}
+
+	if code != "" {
+		if err := s.twoFACodeKeeper.KeepTwoFACode(ctx, challengeId, code); err != nil {
+			return "", err
+		}
+	}
+
+	return challengeId, nil
+}
+
+// getLoginChallenge returns the pending login only to the client that started it, as far as challengeBinding checks
+func (s *SessionService) getLoginChallenge(ctx context.Context, challengeId string) (challenge models.LoginChallenge, err error) {
+	if challengeId == "" {
+		return models.LoginChallenge{}, utils.ErrLoginChallengeNotFound
+	}
+
+	challenge, err = s.loginChallengeGetter.GetLoginChallenge(ctx, challengeId)
+	if err != nil {
+		if errors.Is(err, utils.ErrLoginChallengeNotFound) {
+			return models.LoginChallenge{}, err
+		}
+		return models.LoginChallenge{}, utils.ErrInternalServer
+	}
+
+	clientIP, userAgent := utils_client.FromContext(ctx)
+	if !s.challengeBinding.matches(challenge, clientIP, userAgent) {
+		s.logger.Warn("Login challenge used by another client", "uid", challenge.UserId, "ip", clientIP)
+		return models.LoginChallenge{}, utils.ErrLoginChallengeClientMismatch
+	}
+
+	return challenge, nil
+}
+
+// consumeEmailed2FACode uses up the code sent by Login, not emailed is false without error
+func (s *SessionService) consumeEmailed2FACode(ctx context.Context, challengeId string, code string) (emailed bool, err error) {
+	err = s.codeConsumer.ConsumeCode(ctx, models.CodePurposeTwoFA, challengeId, code)
+	if err != nil {
+		if errors.Is(err, utils.ErrWrongCode) || errors.Is(err, utils.ErrCodeNotFound) {
+			return false, nil
+		}
+		return false, utils.ErrInternalServer
+	}
+
+	return true, nil
+}
+
+// checkRecoveryCodeLogin consumes backup code in place of the OTP
+func (s *SessionService) checkRecoveryCodeLogin(ctx context.Context, user models.User, code string) (err error) {
+	if !user.Use2FA && !user.TOTPEnabled {
+		return utils.ErrTwoFANotEnabled
+	}
+
+	err = s.recoveryCodes.Use(ctx, user.Id, code)
+	if err != nil {
+		if errors.Is(err, utils.ErrRecoveryCodeNotFound) || errors.Is(err, utils.ErrRecoveryCodeUsed) {
+			return err
 		}
-		return "", utils.ErrInternalServer
+		return utils.ErrInternalServer
 	}
 
-	token, err = utils_jwt.NewToken(user, s.tokenTTL, s.jwtSecret)
+	s.logger.Info("User logined with recovery code", "uid", user.Id)
+
+	return nil
+}
+
+// checkTOTPLogin checks authenticator code
+func (s *SessionService) checkTOTPLogin(ctx context.Context, user models.User, code string) (err error) {
+	err = s.totpAuthenticator.Verify(ctx, user, code)
 	if err != nil {
-		s.logger.Debug("User 2FA login error", "email", email, "err", err.Error())
-		return "", utils.ErrInternalServer
+		if errors.Is(err, utils.ErrWrong2FACode) || errors.Is(err, utils.ErrTOTPCodeReused) || errors.Is(err, utils.ErrTOTPNotEnrolled) {
+			return err
+		}
+		return utils.ErrInternalServer
 	}
 
-	s.logger.Debug("User logined with 2FA succesfully", "email", email)
+	return nil
+}
+
+// issueTokens creates access token and refresh token of the session,
+// new session is started if sessionId is empty
+func (s *SessionService) issueTokens(ctx context.Context, user models.User, sessionId string, sessionExpiresAt time.Time) (token string, refreshToken string, err error) {
+	if sessionId == "" {
+		sessionId, err = utils_random.RandToken(16)
+		if err != nil {
+			return "", "", err
+		}
+
+		clientIP, userAgent := utils_client.FromContext(ctx)
+		now := time.Now()
+		sessionExpiresAt = now.Add(s.refreshTokenTTL)
 
-	return token, nil
+		session := models.Session{
+			Id: sessionId,
+			UserId: user.Id,
+			IssuedAt: now,
+			ExpiresAt: sessionExpiresAt,
+			ClientIP: clientIP,
+			UserAgent: userAgent,
+		}
 
-}
\ No newline at end of file
+		if err := s.sessionKeeper.KeepSession(ctx, session); err != nil {
+			return "", "", err
+		}
+	}
+
+	token, err = utils_jwt.NewToken(user, sessionId, s.tokenTTL, s.keyRing.Active(), s.tokenOptions)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err = utils_random.RandToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	// refresh token family is the session, it never outlives the session
+	if err := s.refreshTokenKeeper.KeepRefreshToken(ctx, user.Id, sessionId, utils_hash.SHA256(refreshToken), sessionExpiresAt); err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// markSessionRevoked caches revocation of the session while its access tokens may still be alive
+func (s *SessionService) markSessionRevoked(ctx context.Context, sessionId string) {
+	if err := s.revocationChecker.MarkRevoked(ctx, sessionId, s.tokenTTL); err != nil {
+		s.logger.Warn("Revocation cache keep error", "sid", sessionId, "err", err.Error())
+	}
+}
+
+// checkToken parses the token and checks that neither the token nor its session is revoked
+func (s *SessionService) checkToken(ctx context.Context, tokenString string) (claims *utils_jwt.Claims, err error) {
+	if tokenString == "" {
+		return nil, utils.ErrInvalidCredentials
+	}
+
+	claims, err = utils_jwt.ParseToken(tokenString, s.keyRing, s.tokenOptions)
+	if err != nil {
+		return nil, utils.ErrInvalidCredentials
+	}
+
+	expiresAt := claims.ExpiresAt.Time
+
+	revoked, err := s.revocationChecker.IsRevoked(ctx, claims.ID, claims.SessionId, expiresAt)
+	if err != nil {
+		if errors.Is(err, utils.ErrSessionNotFound) {
+			return nil, utils.ErrInvalidCredentials
+		}
+		return nil, utils.ErrInternalServer
+	}
+
+	if revoked {
+		return nil, utils.ErrJWTRevoked
+	}
+
+	// token was issued before logout everywhere (password change etc.)
+	revoked, err = s.revocationChecker.IsVersionRevoked(ctx, claims.UID, claims.TokenVersion)
+	if err != nil {
+		if errors.Is(err, utils.ErrUserNotFound) {
+			return nil, utils.ErrInvalidCredentials
+		}
+		return nil, utils.ErrInternalServer
+	}
+
+	if revoked {
+		return nil, utils.ErrJWTRevoked
+	}
+
+	return claims, nil
+}
@@ -1,11 +1,32 @@
 package services_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	
+	"authSAS/internal/models"
+	"authSAS/internal/services"
 	"authSAS/internal/utils"
+	utils_client "authSAS/internal/utils/clientInfo"
+	utils_jwt "authSAS/internal/utils/jwt"
+	utils_totp "authSAS/internal/utils/totp"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 func TestLogin(t *testing.T) {
@@ -79,7 +100,7 @@ func TestLogin(t *testing.T) {
 	}
 
 	for _, tC := range cases {
-		token, msg, err := tester.sesService.Login(ctx, tC.inEmail, tC.inPassword)
+		token, refreshToken, challengeId, msg, err := tester.sesService.Login(ctx, tC.inEmail, tC.inPassword)
 
 		if !tC.mustFail {
 			require.NoError(t, err)
@@ -87,10 +108,16 @@ func TestLogin(t *testing.T) {
 			
 			if msg != "2FA code sended" {
 				require.NotEmpty(t, token)
+				require.NotEmpty(t, refreshToken)
+				require.Empty(t, challengeId)
 			} else {
 				require.Empty(t, token)
+				require.Empty(t, refreshToken)
 
-				code, err := tester.tempStor.GetTwoFACode(ctx, tC.inEmail)
+				_, err := tester.tempStor.GetLoginChallenge(ctx, challengeId)
+				require.NoError(t, err)
+
+				code, err := tester.tempStor.GetTwoFACode(ctx, challengeId)
 				require.NoError(t, err)
 				require.NotEmpty(t, code)
 			}
@@ -99,6 +126,7 @@ func TestLogin(t *testing.T) {
 			require.ErrorIs(t, err, tC.fail)
 			require.Equal(t, tC.outMsg, msg)
 			require.Empty(t, token)
+			require.Empty(t, refreshToken)
 		}
 	}
 }
@@ -109,7 +137,7 @@ func TestLogout(t *testing.T) {
 
 	// preparing for (case 1) test
 	tester.accService.Register(ctx, "test@mail.ru", "admin")
-	validToken,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	validToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
 
 	cases := []struct {
 		desc string
@@ -162,66 +190,1252 @@ func TestLogout(t *testing.T) {
 
 func TestLoginWith2FACode(t *testing.T) {
 
+	ctx, tester := NewTester(t)
+	laptopCtx := clientContext(ctx, "10.0.0.1", "laptop")
+
+	// preparing login challenge of the laptop for (case 1) test
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	_, _, challengeId, _, err := tester.sesService.Login(laptopCtx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+	require.NotEmpty(t, challengeId)
+
+	challenge, _ := tester.tempStor.GetLoginChallenge(ctx, challengeId)
+	require.Equal(t, "10.0.0.1", challenge.ClientIP)
+	require.Equal(t, "laptop", challenge.UserAgent)
+
+	code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+
+	cases := []struct {
+		desc string
+		inCtx context.Context
+		inChallengeId string
+		inCode string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - 2fa login with wrong challenge",
+			inCtx: laptopCtx,
+			inChallengeId: "unknown",
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 2 - 2fa login with wrong code",
+			inCtx: laptopCtx,
+			inChallengeId: challengeId,
+			inCode: wrongCodeOf(code),
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 3 - empty challenge",
+			inCtx: laptopCtx,
+			inChallengeId: "",
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 4 - empty code",
+			inCtx: laptopCtx,
+			inChallengeId: challengeId,
+			inCode: "",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 5 - challenge of another client",
+			inCtx: clientContext(ctx, "10.0.0.2", "phone"),
+			inChallengeId: challengeId,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+		{
+			desc: "case 6 - right 2FA login",
+			inCtx: laptopCtx,
+			inChallengeId: challengeId,
+			inCode: code,
+			mustFail: false,
+		},
+		{
+			desc: "case 7 - challenge already used",
+			inCtx: laptopCtx,
+			inChallengeId: challengeId,
+			inCode: code,
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+	}
+
+	for _, tC := range cases {
+		token, refreshToken, _, err := tester.sesService.LoginWith2FACode(tC.inCtx, tC.inChallengeId, tC.inCode, false)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.NotEmpty(t, token)
+			require.NotEmpty(t, refreshToken)
+		} else {
+			require.ErrorIs(t, err, tC.fail, tC.desc)
+			require.Empty(t, token)
+			require.Empty(t, refreshToken)
+		}
+	}
+}
+
+func TestLoginWith2FACodeAttemptsLimit(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	_, _, challengeId, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+	wrongCode := wrongCodeOf(code)
+
+	for i := 1; i < tester.cfg.TempStorage.CodeMaxAttempts; i++ {
+		_, _, _, err := tester.sesService.LoginWith2FACode(ctx, challengeId, wrongCode, false)
+		require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+	}
+
+	_, _, _, err := tester.sesService.LoginWith2FACode(ctx, challengeId, wrongCode, false)
+	require.ErrorIs(t, err, utils.ErrTooManyCodeAttempts)
+
+	// the challenge is dropped, even the right code doesn't work
+	_, _, _, err = tester.sesService.LoginWith2FACode(ctx, challengeId, code, false)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+}
+
+func TestConcurrentLoginChallenges(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	// second login must not overwrite code of the first one
+	_, _, firstChallengeId, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	_, _, secondChallengeId, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	require.NotEqual(t, firstChallengeId, secondChallengeId)
+
+	firstCode, err := tester.tempStor.GetTwoFACode(ctx, firstChallengeId)
+	require.NoError(t, err)
+	secondCode, err := tester.tempStor.GetTwoFACode(ctx, secondChallengeId)
+	require.NoError(t, err)
+
+	if firstCode != secondCode {
+		_, _, _, err = tester.sesService.LoginWith2FACode(ctx, firstChallengeId, secondCode, false)
+		require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+	}
+
+	_, _, _, err = tester.sesService.LoginWith2FACode(ctx, firstChallengeId, firstCode, false)
+	require.NoError(t, err)
+
+	_, _, _, err = tester.sesService.LoginWith2FACode(ctx, secondChallengeId, secondCode, false)
+	require.NoError(t, err)
+}
+
+func TestLoginChallengeBinding(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+	laptopCtx := clientContext(ctx, "10.0.0.1", "laptop")
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	cases := []struct {
+		desc string
+		inBinding services.ChallengeBinding
+		inCtx context.Context
+		mustFail bool
+	}{
+		{
+			desc: "case 1 - ip and user agent binding, another network",
+			inBinding: services.ChallengeBindingIPAndUserAgent,
+			inCtx: clientContext(ctx, "10.0.0.2", "laptop"),
+			mustFail: true,
+		},
+		{
+			desc: "case 2 - user agent binding, another network",
+			inBinding: services.ChallengeBindingUserAgent,
+			inCtx: clientContext(ctx, "10.0.0.2", "laptop"),
+			mustFail: false,
+		},
+		{
+			desc: "case 3 - user agent binding, another client",
+			inBinding: services.ChallengeBindingUserAgent,
+			inCtx: clientContext(ctx, "10.0.0.1", "phone"),
+			mustFail: true,
+		},
+		{
+			desc: "case 4 - no binding, another client",
+			inBinding: services.ChallengeBindingNone,
+			inCtx: clientContext(ctx, "10.0.0.2", "phone"),
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		sesService := services.NewSessionService(tester.logger, tester.cfg.JWTTokenTTL, tester.cfg.RefreshTokenTTL, tester.keyRing, tester.tokenOptions, tC.inBinding, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.passkeyAuthenticator, tester.magicLinks, tester.trustedDevices, tester.codeAttemptsLimiter, tester.codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.permStor, tester.tempStor)
+
+		_, _, challengeId, _, err := sesService.Login(laptopCtx, "test@mail.ru", "admin")
+		require.NoError(t, err, tC.desc)
+		code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+
+		token, _, _, err := sesService.LoginWith2FACode(tC.inCtx, challengeId, code, false)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.NotEmpty(t, token)
+		} else {
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials, tC.desc)
+			require.Empty(t, token)
+		}
+	}
+}
+
+func TestLogin2FACodeSendCooldown(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	codeSendLimiter := services.NewCodeSendLimiter(tester.logger, services.CodeSendLimits{TwoFA: services.SendLimit{Cooldown: time.Minute, DailyQuota: 10}}, tester.tempStor)
+	sesService := services.NewSessionService(tester.logger, tester.cfg.JWTTokenTTL, tester.cfg.RefreshTokenTTL, tester.keyRing, tester.tokenOptions, tester.challengeBinding, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.passkeyAuthenticator, tester.magicLinks, tester.trustedDevices, tester.codeAttemptsLimiter, codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.permStor, tester.tempStor)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	_, _, challengeId, msg, err := sesService.Login(ctx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+	require.Equal(t, "2FA code sended", msg)
+
+	// no new challenge and no new code, the sent one is still good
+	_, _, secondChallengeId, msg, err := sesService.Login(ctx, "test@mail.ru", "admin")
+	require.ErrorIs(t, err, utils.ErrCodeSendCooldown)
+	require.Equal(t, "Error", msg)
+	require.Empty(t, secondChallengeId)
+
+	var retryErr *utils.RetryAfterError
+	require.ErrorAs(t, err, &retryErr)
+	require.Greater(t, retryErr.RetryAfter, time.Duration(0))
+	require.LessOrEqual(t, retryErr.RetryAfter, time.Minute)
+
+	code, err := tester.tempStor.GetTwoFACode(ctx, challengeId)
+	require.NoError(t, err)
+	_, _, _, err = sesService.LoginWith2FACode(ctx, challengeId, code, false)
+	require.NoError(t, err)
+}
+
+func TestValidateToken(t *testing.T) {
+
 	ctx, tester := NewTester(t)
 
 	// preparing for (case 1) test
 	tester.accService.Register(ctx, "test@mail.ru", "admin")
-	tester.tempStor.KeepTwoFACode(ctx, "test@mail.ru", 1234)
-	
+	validToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	// preparing for (case 2) test
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	logoutedToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+	tester.sesService.Logout(ctx, logoutedToken)
 
 	cases := []struct {
 		desc string
-		inEmail string
-		inCode int
-		outToken string
+		inToken string
+		outEmail string
 		mustFail bool
 		fail error
 	}{
 		{
-			desc: "case 1 - right 2FA login",
-			inEmail: "test@mail.ru",
-			inCode: 1234,
+			desc: "case 1 - valid token",
+			inToken: validToken,
+			outEmail: "test@mail.ru",
 			mustFail: false,
 		},
 		{
-			desc: "case 2 - 2fa login with wrong email",
-			inEmail: "123@mail.ru",
-			inCode: 1234,
+			desc: "case 2 - logouted token",
+			inToken: logoutedToken,
+			mustFail: true,
+			fail: utils.ErrJWTRevoked,
+		},
+		{
+			desc: "case 3 - INVALID token",
+			inToken: "invalid",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
 		},
 		{
-			desc: "case 3 - 2fa login with wrong code",
-			inEmail: "test@mail.ru",
-			inCode: 5555,
+			desc: "case 4 - empty token string",
+			inToken: "",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
 		},
+	}
+
+	for _, tC := range cases {
+		_, email, isAdmin, err := tester.sesService.ValidateToken(ctx, tC.inToken)
+
+		if !tC.mustFail {
+			require.NoError(t, err)
+			require.Equal(t, tC.outEmail, email)
+			require.False(t, isAdmin)
+		} else {
+			require.ErrorIs(t, err, tC.fail)
+			require.Empty(t, email)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing for (case 1) test
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	_,firstRefreshToken,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		inRefreshToken string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - right refresh",
+			inRefreshToken: firstRefreshToken,
+			mustFail: false,
+		},
 		{
-			desc: "case 4 - empty email",
-			inEmail: "",
-			inCode: 5555,
+			desc: "case 2 - reuse of rotated refresh token",
+			inRefreshToken: firstRefreshToken,
+			mustFail: true,
+			fail: utils.ErrRefreshTokenReused,
+		},
+		{
+			desc: "case 3 - INVALID refresh token",
+			inRefreshToken: "invalid",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
 		},
 		{
-			desc: "case 5 - empty code",
-			inEmail: "test@mail.ru",
-			inCode: 0,
+			desc: "case 4 - empty refresh token",
+			inRefreshToken: "",
 			mustFail: true,
 			fail: utils.ErrInvalidCredentials,
 		},
 	}
 
+	var rotatedRefreshToken string
+
 	for _, tC := range cases {
-		token, err := tester.sesService.LoginWith2FACode(ctx, tC.inEmail, tC.inCode)
+		token, refreshToken, err := tester.sesService.Refresh(ctx, tC.inRefreshToken)
 
 		if !tC.mustFail {
 			require.NoError(t, err)
 			require.NotEmpty(t, token)
+			require.NotEmpty(t, refreshToken)
+			require.NotEqual(t, tC.inRefreshToken, refreshToken)
+			rotatedRefreshToken = refreshToken
 		} else {
 			require.ErrorIs(t, err, tC.fail)
 			require.Empty(t, token)
+			require.Empty(t, refreshToken)
+		}
+	}
+
+	// reuse detection must revoke the whole family
+	_, _, err := tester.sesService.Refresh(ctx, rotatedRefreshToken)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	cases := []struct {
+		desc string
+		inAlgorithm string
+		inPrivateKey any
+		outKty string
+	}{
+		{
+			desc: "case 1 - RS256",
+			inAlgorithm: "RS256",
+			inPrivateKey: rsaKey,
+			outKty: "RSA",
+		},
+		{
+			desc: "case 2 - ES256",
+			inAlgorithm: "ES256",
+			inPrivateKey: ecKey,
+			outKty: "EC",
+		},
+		{
+			desc: "case 3 - EdDSA",
+			inAlgorithm: "EdDSA",
+			inPrivateKey: edKey,
+			outKty: "OKP",
+		},
+	}
+
+	for _, tC := range cases {
+		der, err := x509.MarshalPKCS8PrivateKey(tC.inPrivateKey)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "key.pem")
+		err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		require.NoError(t, err)
+
+		key, err := utils_jwt.LoadKey(tC.inAlgorithm, tC.inAlgorithm, path, "")
+		require.NoError(t, err)
+
+		keyRing, err := utils_jwt.NewKeyRing(key.Kid, key)
+		require.NoError(t, err)
+
+		sesService := services.NewSessionService(tester.logger, tester.cfg.JWTTokenTTL, tester.cfg.RefreshTokenTTL, keyRing, tester.tokenOptions, tester.challengeBinding, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.passkeyAuthenticator, tester.magicLinks, tester.trustedDevices, tester.codeAttemptsLimiter, tester.codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.permStor, tester.tempStor)
+
+		token,_,_,_,err := sesService.Login(ctx, "test@mail.ru", "admin")
+		require.NoError(t, err)
+
+		_, email, _, err := sesService.ValidateToken(ctx, token)
+		require.NoError(t, err)
+		require.Equal(t, "test@mail.ru", email)
+
+		// token signed by another key must be rejected
+		_, _, _, err = tester.sesService.ValidateToken(ctx, token)
+		require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+		jwks, err := sesService.GetJWKS(ctx)
+		require.NoError(t, err)
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, tC.inAlgorithm, jwks.Keys[0].Kid)
+		require.Equal(t, tC.outKty, jwks.Keys[0].Kty)
+	}
+
+	// shared secret must never be published
+	jwks, err := tester.sesService.GetJWKS(ctx)
+	require.NoError(t, err)
+	require.Empty(t, jwks.Keys)
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+
+	oldKey, _ := utils_jwt.NewHMACKey("old", "old_secret")
+	newKey, _ := utils_jwt.NewHMACKey("new", "new_secret")
+
+	beforeRing, err := utils_jwt.NewKeyRing("old", oldKey)
+	require.NoError(t, err)
+	// new key is promoted, old one stays verify-only
+	rotatedRing, err := utils_jwt.NewKeyRing("new", oldKey, newKey)
+	require.NoError(t, err)
+	// old key is removed after all of its tokens expired
+	afterRing, err := utils_jwt.NewKeyRing("new", newKey)
+	require.NoError(t, err)
+
+	newSesService := func(keyRing *utils_jwt.KeyRing) *services.SessionService {
+		return services.NewSessionService(tester.logger, tester.cfg.JWTTokenTTL, tester.cfg.RefreshTokenTTL, keyRing, tester.tokenOptions, tester.challengeBinding, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.passkeyAuthenticator, tester.magicLinks, tester.trustedDevices, tester.codeAttemptsLimiter, tester.codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.permStor, tester.tempStor)
+	}
+
+	oldToken,_,_,_,err := newSesService(beforeRing).Login(ctx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+
+	rotatedSesService := newSesService(rotatedRing)
+
+	_, _, _, err = rotatedSesService.ValidateToken(ctx, oldToken)
+	require.NoError(t, err)
+
+	newToken,_,_,_,err := rotatedSesService.Login(ctx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+
+	afterSesService := newSesService(afterRing)
+
+	_, _, _, err = afterSesService.ValidateToken(ctx, newToken)
+	require.NoError(t, err)
+
+	_, _, _, err = afterSesService.ValidateToken(ctx, oldToken)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// ring can't sign with a key it doesn't hold
+	_, err = utils_jwt.NewKeyRing("missing", newKey)
+	require.Error(t, err)
+}
+
+func clientContext(ctx context.Context, ip string, userAgent string) context.Context {
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}})
+	return metadata.NewIncomingContext(ctx, metadata.Pairs("user-agent", userAgent))
+}
+
+func TestSessions(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing sessions of two devices and another user
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	laptopToken,_,_,_,_ := tester.sesService.Login(clientContext(ctx, "10.0.0.1", "laptop"), "test@mail.ru", "admin")
+	phoneToken,_,_,_,_ := tester.sesService.Login(clientContext(ctx, "10.0.0.2", "phone"), "test@mail.ru", "admin")
+	strangerToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+
+	sessions, laptopSessionId, err := tester.sesService.ListSessions(ctx, laptopToken)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	var phoneSessionId string
+	for _, session := range sessions {
+		if session.Id != laptopSessionId {
+			phoneSessionId = session.Id
+			require.Equal(t, "10.0.0.2", session.ClientIP)
+			require.Equal(t, "phone", session.UserAgent)
 		}
 	}
-}
\ No newline at end of file
+	require.NotEmpty(t, phoneSessionId)
+
+	cases := []struct {
+		desc string
+		inToken string
+		inSessionId string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - revoke another user's session",
+			inToken: strangerToken,
+			inSessionId: phoneSessionId,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrSessionNotFound,
+		},
+		{
+			desc: "case 2 - right revoke",
+			inToken: laptopToken,
+			inSessionId: phoneSessionId,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 3 - revoke with token of revoked session",
+			inToken: phoneToken,
+			inSessionId: laptopSessionId,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrJWTRevoked,
+		},
+		{
+			desc: "case 4 - unknown session",
+			inToken: laptopToken,
+			inSessionId: "unknown",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrSessionNotFound,
+		},
+		{
+			desc: "case 5 - INVALID token",
+			inToken: "invalid",
+			inSessionId: laptopSessionId,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.sesService.RevokeSession(ctx, tC.inToken, tC.inSessionId)
+
+		if !tC.mustFail {
+			require.NoError(t, err)
+			require.Equal(t, tC.outMsg, msg)
+		} else {
+			require.ErrorIs(t, err, tC.fail)
+			require.Equal(t, tC.outMsg, msg)
+		}
+	}
+
+	_, _, _, err = tester.sesService.ValidateToken(ctx, phoneToken)
+	require.ErrorIs(t, err, utils.ErrJWTRevoked)
+
+	// revoking others keeps only the current session
+	tabletToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	msg, err := tester.sesService.RevokeOtherSessions(ctx, laptopToken)
+	require.NoError(t, err)
+	require.Equal(t, "Success", msg)
+
+	_, _, _, err = tester.sesService.ValidateToken(ctx, tabletToken)
+	require.ErrorIs(t, err, utils.ErrJWTRevoked)
+
+	sessions, _, err = tester.sesService.ListSessions(ctx, laptopToken)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, laptopSessionId, sessions[0].Id)
+
+	_, _, _, err = tester.sesService.ValidateToken(ctx, strangerToken)
+	require.NoError(t, err)
+
+	// too long user agent is cut to the column size
+	longUAToken,_,_,_,err := tester.sesService.Login(clientContext(ctx, "10.0.0.3", strings.Repeat("ю", 2000)), "test2@mail.ru", "admin")
+	require.NoError(t, err)
+
+	sessions, longUASessionId, err := tester.sesService.ListSessions(ctx, longUAToken)
+	require.NoError(t, err)
+	for _, session := range sessions {
+		if session.Id == longUASessionId {
+			require.Equal(t, strings.Repeat("ю", utils_client.MaxUserAgentLength), session.UserAgent)
+		}
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing two sessions of the user
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	laptopToken,laptopRefreshToken,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	phoneToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	cases := []struct {
+		desc string
+		inToken string
+		outMsg string
+		mustFail bool
+		fail error
+	}{
+		{
+			desc: "case 1 - right logout everywhere",
+			inToken: laptopToken,
+			outMsg: "Success",
+			mustFail: false,
+		},
+		{
+			desc: "case 2 - token issued before logout everywhere",
+			inToken: phoneToken,
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrJWTRevoked,
+		},
+		{
+			desc: "case 3 - INVALID token",
+			inToken: "invalid",
+			outMsg: "Error",
+			mustFail: true,
+			fail: utils.ErrInvalidCredentials,
+		},
+	}
+
+	for _, tC := range cases {
+		msg, err := tester.sesService.LogoutAll(ctx, tC.inToken)
+
+		if !tC.mustFail {
+			require.NoError(t, err)
+			require.Equal(t, tC.outMsg, msg)
+		} else {
+			require.ErrorIs(t, err, tC.fail)
+			require.Equal(t, tC.outMsg, msg)
+		}
+	}
+
+	_, _, _, err := tester.sesService.ValidateToken(ctx, laptopToken)
+	require.ErrorIs(t, err, utils.ErrJWTRevoked)
+
+	// refresh tokens can't bring sessions back
+	_, _, err = tester.sesService.Refresh(ctx, laptopRefreshToken)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// tokens issued after logout everywhere work
+	newToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	_, _, _, err = tester.sesService.ValidateToken(ctx, newToken)
+	require.NoError(t, err)
+}
+
+func TestTokenClaims(t *testing.T) {
+
+	_, tester := NewTester(t)
+
+	user := models.User{Id: 7, Email: "test@mail.ru"}
+	options := utils_jwt.Options{Issuer: "authSAS", Audience: []string{"api", "gateway"}}
+
+	validToken, _ := utils_jwt.NewToken(user, "sid", time.Minute, tester.keyRing.Active(), options)
+	expiredToken, _ := utils_jwt.NewToken(user, "sid", -10*time.Second, tester.keyRing.Active(), options)
+
+	cases := []struct {
+		desc string
+		inToken string
+		inOptions utils_jwt.Options
+		mustFail bool
+	}{
+		{
+			desc: "case 1 - right claims",
+			inToken: validToken,
+			inOptions: options,
+			mustFail: false,
+		},
+		{
+			desc: "case 2 - one of allowed audiences",
+			inToken: validToken,
+			inOptions: utils_jwt.Options{Issuer: "authSAS", Audience: []string{"gateway", "other"}},
+			mustFail: false,
+		},
+		{
+			desc: "case 3 - wrong issuer",
+			inToken: validToken,
+			inOptions: utils_jwt.Options{Issuer: "other", Audience: options.Audience},
+			mustFail: true,
+		},
+		{
+			desc: "case 4 - wrong audience",
+			inToken: validToken,
+			inOptions: utils_jwt.Options{Issuer: "authSAS", Audience: []string{"other"}},
+			mustFail: true,
+		},
+		{
+			desc: "case 5 - expired token",
+			inToken: expiredToken,
+			inOptions: options,
+			mustFail: true,
+		},
+		{
+			desc: "case 6 - expired token within leeway",
+			inToken: expiredToken,
+			inOptions: utils_jwt.Options{Issuer: "authSAS", Audience: options.Audience, Leeway: 30 * time.Second},
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		claims, err := utils_jwt.ParseToken(tC.inToken, tester.keyRing, tC.inOptions)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.Equal(t, "7", claims.Subject)
+			require.Equal(t, "sid", claims.SessionId)
+			require.NotEmpty(t, claims.ID)
+			require.NotNil(t, claims.NotBefore)
+			require.NotNil(t, claims.IssuedAt)
+		} else {
+			require.Error(t, err, tC.desc)
+		}
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	// preparing for (case 1) test
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	validToken,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	// preparing for (case 2) test
+	tester.accService.Register(ctx, "test2@mail.ru", "admin")
+	logoutedToken,_,_,_,_ := tester.sesService.Login(ctx, "test2@mail.ru", "admin")
+	tester.sesService.Logout(ctx, logoutedToken)
+
+	cases := []struct {
+		desc string
+		inToken string
+		outEmail string
+		outActive bool
+	}{
+		{
+			desc: "case 1 - active token",
+			inToken: validToken,
+			outEmail: "test@mail.ru",
+			outActive: true,
+		},
+		{
+			desc: "case 2 - logouted token",
+			inToken: logoutedToken,
+			outActive: false,
+		},
+		{
+			desc: "case 3 - INVALID token",
+			inToken: "invalid",
+			outActive: false,
+		},
+	}
+
+	for _, tC := range cases {
+		claims, active, err := tester.sesService.IntrospectToken(ctx, tC.inToken)
+
+		require.NoError(t, err, tC.desc)
+		require.Equal(t, tC.outActive, active, tC.desc)
+
+		if tC.outActive {
+			require.Equal(t, tC.outEmail, claims.Email)
+			require.NotEmpty(t, claims.ID)
+		} else {
+			require.Nil(t, claims)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	// enrollment
+	secret, uri, qrCode, err := tester.sesService.EnrollTOTP(ctx, token, true)
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	require.True(t, strings.HasPrefix(uri, "otpauth://totp/"))
+	require.Contains(t, uri, "secret=" + secret)
+	require.Equal(t, []byte("\x89PNG"), qrCode[:4])
+
+	user, _ := tester.permStor.GetUserByEmail(ctx, "test@mail.ru")
+	require.NotEmpty(t, user.TOTPSecret)
+	require.NotContains(t, user.TOTPSecret, secret, "secret must be stored encrypted")
+	require.False(t, user.TOTPEnabled)
+
+	waitForFreshTOTPStep()
+	step := utils_totp.Step(time.Now())
+	code := func(step int64) string {
+		code, err := utils_totp.Code(secret, step)
+		require.NoError(t, err)
+		return code
+	}
+
+	// confirmation
+	_, _, err = tester.sesService.ConfirmTOTP(ctx, token, wrongCodeOf(code(step)))
+	require.ErrorIs(t, err, utils.ErrWrong2FACode)
+
+	msg, recoveryCodes, err := tester.sesService.ConfirmTOTP(ctx, token, code(step - 1))
+	require.NoError(t, err)
+	require.Equal(t, "TOTP enabled", msg)
+	require.Len(t, recoveryCodes, 10)
+
+	_, _, _, err = tester.sesService.EnrollTOTP(ctx, token, false)
+	require.ErrorIs(t, err, utils.ErrTOTPAlreadyEnabled)
+
+	// code without password step
+	_, _, _, err = tester.sesService.LoginWith2FACode(ctx, "", code(step), false)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	// login
+	loginToken, _, challengeId, msg, err := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	require.NoError(t, err)
+	require.Empty(t, loginToken)
+	require.NotEmpty(t, challengeId)
+	require.Equal(t, "TOTP code required", msg)
+
+	cases := []struct {
+		desc string
+		inCode string
+		mustFail bool
+	}{
+		{
+			desc: "case 1 - code of confirmation step replayed",
+			inCode: code(step - 1),
+			mustFail: true,
+		},
+		{
+			desc: "case 2 - code out of window",
+			inCode: code(step + 2),
+			mustFail: true,
+		},
+		{
+			desc: "case 3 - right code",
+			inCode: code(step),
+			mustFail: false,
+		},
+		{
+			desc: "case 4 - same code replayed",
+			inCode: code(step),
+			mustFail: true,
+		},
+		{
+			desc: "case 5 - code of next step (clock drift)",
+			inCode: code(step + 1),
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		token, refreshToken, _, err := tester.sesService.LoginWith2FACode(ctx, challengeId, tC.inCode, false)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.NotEmpty(t, token)
+			require.NotEmpty(t, refreshToken)
+
+			// successful login uses up the challenge
+			_, _, challengeId, _, _ = tester.sesService.Login(ctx, "test@mail.ru", "admin")
+		} else {
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials, tC.desc)
+			require.Empty(t, token)
+		}
+	}
+}
+
+func TestLoginWithRecoveryCode(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	token,_,_,_,_ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	tester.tempStor.KeepTwoFASettingsCode(ctx, "test@mail.ru", "1234")
+	_, recoveryCodes, err := tester.accService.Enable2FA(ctx, token, "1234")
+	require.NoError(t, err)
+	require.Len(t, recoveryCodes, 10)
+
+	for _, code := range recoveryCodes {
+		require.Regexp(t, `^[1-9][0-9]{7}$`, code)
+	}
+
+	// code without password step
+	_, _, _, err = tester.sesService.LoginWith2FACode(ctx, "", recoveryCodes[0], false)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	_, _, challengeId, msg, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	require.Equal(t, "2FA code sended", msg)
+
+	cases := []struct {
+		desc string
+		inCode string
+		mustFail bool
+	}{
+		{
+			desc: "case 1 - unknown recovery code",
+			inCode: wrongCodeOf(recoveryCodes[0]),
+			mustFail: true,
+		},
+		{
+			desc: "case 2 - right recovery code",
+			inCode: recoveryCodes[0],
+			mustFail: false,
+		},
+		{
+			desc: "case 3 - consumed recovery code",
+			inCode: recoveryCodes[0],
+			mustFail: true,
+		},
+		{
+			desc: "case 4 - another recovery code",
+			inCode: recoveryCodes[1],
+			mustFail: false,
+		},
+	}
+
+	for _, tC := range cases {
+		token, refreshToken, _, err := tester.sesService.LoginWith2FACode(ctx, challengeId, tC.inCode, false)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.NotEmpty(t, token)
+			require.NotEmpty(t, refreshToken)
+
+			_, _, challengeId, _, _ = tester.sesService.Login(ctx, "test@mail.ru", "admin")
+		} else {
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials, tC.desc)
+			require.Empty(t, token)
+		}
+	}
+
+	unused, _ := tester.permStor.GetUnusedRecoveryCodes(ctx, 0)
+	require.Len(t, unused, 8)
+}
+
+func TestMagicLink(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	accessToken, _, _, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+
+	_, err := tester.sesService.RequestMagicLink(ctx, "")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	_, err = tester.sesService.RequestMagicLink(ctx, "unknown@mail.ru")
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	msg, err := tester.sesService.RequestMagicLink(ctx, "test@mail.ru")
+	require.NoError(t, err)
+	require.Equal(t, "Link sended", msg)
+
+	links := tester.tempStor.GetMagicLinks(ctx)
+	require.Len(t, links, 1)
+
+	// link token is of its own kind, it never passes for an access token
+	_, _, _, err = tester.sesService.ValidateToken(ctx, links[0])
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	_, active, err := tester.sesService.IntrospectToken(ctx, links[0])
+	require.NoError(t, err)
+	require.False(t, active)
+
+	linkClaims, err := utils_jwt.ParseMagicLinkToken(links[0], tester.keyRing, tester.tokenOptions)
+	require.NoError(t, err)
+	require.NotContains(t, linkClaims.Audience, tester.tokenOptions.Audience[0])
+
+	cases := []struct {
+		desc string
+		inToken string
+		outMsg string
+		mustFail bool
+	}{
+		{
+			desc: "case 1 - empty link token",
+			inToken: "",
+			outMsg: "Error",
+			mustFail: true,
+		},
+		{
+			desc: "case 2 - forged link token",
+			inToken: links[0][:len(links[0]) - 4] + "AAAA",
+			outMsg: "Error",
+			mustFail: true,
+		},
+		{
+			desc: "case 3 - access token in place of link token",
+			inToken: accessToken,
+			outMsg: "Error",
+			mustFail: true,
+		},
+		{
+			desc: "case 4 - right link token",
+			inToken: links[0],
+			outMsg: "Authorized",
+			mustFail: false,
+		},
+		{
+			desc: "case 5 - replayed link token",
+			inToken: links[0],
+			outMsg: "Error",
+			mustFail: true,
+		},
+	}
+
+	for _, tC := range cases {
+		token, refreshToken, challengeId, msg, err := tester.sesService.ConsumeMagicLink(ctx, tC.inToken)
+		require.Equal(t, tC.outMsg, msg, tC.desc)
+		require.Empty(t, challengeId)
+
+		if !tC.mustFail {
+			require.NoError(t, err, tC.desc)
+			require.NotEmpty(t, token)
+			require.NotEmpty(t, refreshToken)
+		} else {
+			require.ErrorIs(t, err, utils.ErrInvalidCredentials, tC.desc)
+			require.Empty(t, token)
+			require.Empty(t, refreshToken)
+		}
+	}
+}
+
+func TestMagicLinkSendCooldown(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	codeSendLimiter := services.NewCodeSendLimiter(tester.logger, services.CodeSendLimits{MagicLink: services.SendLimit{Cooldown: time.Minute, DailyQuota: 10}}, tester.tempStor)
+	sesService := services.NewSessionService(tester.logger, tester.cfg.JWTTokenTTL, tester.cfg.RefreshTokenTTL, tester.keyRing, tester.tokenOptions, tester.challengeBinding, tester.revocationChecker, tester.totpAuthenticator, tester.recoveryCodes, tester.passkeyAuthenticator, tester.magicLinks, tester.trustedDevices, tester.codeAttemptsLimiter, codeSendLimiter, tester.codeFormats, tester.codeDeliverer, tester.permStor, tester.tempStor)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+
+	_, err := sesService.RequestMagicLink(ctx, "test@mail.ru")
+	require.NoError(t, err)
+
+	// limited request leaves no usable link behind
+	msg, err := sesService.RequestMagicLink(ctx, "test@mail.ru")
+	require.ErrorIs(t, err, utils.ErrCodeSendCooldown)
+	require.Equal(t, "Error", msg)
+
+	require.Len(t, tester.tempStor.GetMagicLinks(ctx), 1)
+}
+
+func TestMagicLinkWith2FA(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	_, err := tester.sesService.RequestMagicLink(ctx, "test@mail.ru")
+	require.NoError(t, err)
+
+	links := tester.tempStor.GetMagicLinks(ctx)
+	require.Len(t, links, 1)
+
+	// the link replaces only the password, the second factor is still required
+	token, _, challengeId, msg, err := tester.sesService.ConsumeMagicLink(ctx, links[0])
+	require.NoError(t, err)
+	require.Equal(t, "2FA code sended", msg)
+	require.Empty(t, token)
+	require.NotEmpty(t, challengeId)
+
+	code, err := tester.tempStor.GetTwoFACode(ctx, challengeId)
+	require.NoError(t, err)
+
+	token, _, _, err = tester.sesService.LoginWith2FACode(ctx, challengeId, code, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+}
+
+// trustedContext is the laptop client that sends trust token of a remembered device
+func trustedContext(ctx context.Context, deviceTrustToken string) context.Context {
+	ctx = clientContext(ctx, "10.0.0.1", "laptop")
+	return metadata.NewIncomingContext(ctx, metadata.Pairs("user-agent", "laptop", utils_client.DeviceTrustHeader, deviceTrustToken))
+}
+
+func TestTrustedDevices(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	for _, email := range []string{"test@mail.ru", "test2@mail.ru"} {
+		tester.accService.Register(ctx, email, "admin")
+		user := tester.permStor.UsersStorage[email]
+		user.Use2FA = true
+		tester.permStor.UsersStorage[email] = user
+	}
+
+	laptopCtx := clientContext(ctx, "10.0.0.1", "laptop")
+
+	// without remember device there is no trust token
+	_, _, challengeId, _, _ := tester.sesService.Login(laptopCtx, "test@mail.ru", "admin")
+	code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+	_, _, deviceTrustToken, err := tester.sesService.LoginWith2FACode(laptopCtx, challengeId, code, false)
+	require.NoError(t, err)
+	require.Empty(t, deviceTrustToken)
+
+	_, _, challengeId, _, _ = tester.sesService.Login(laptopCtx, "test@mail.ru", "admin")
+	code, _ = tester.tempStor.GetTwoFACode(ctx, challengeId)
+	accessToken, _, deviceTrustToken, err := tester.sesService.LoginWith2FACode(laptopCtx, challengeId, code, true)
+	require.NoError(t, err)
+	require.NotEmpty(t, deviceTrustToken)
+
+	// trust token is of its own kind, it never passes for an access token
+	_, _, _, err = tester.sesService.ValidateToken(ctx, deviceTrustToken)
+	require.ErrorIs(t, err, utils.ErrInvalidCredentials)
+
+	_, active, err := tester.sesService.IntrospectToken(ctx, deviceTrustToken)
+	require.NoError(t, err)
+	require.False(t, active)
+
+	trustClaims := &utils_jwt.DeviceTrustClaims{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(deviceTrustToken, trustClaims)
+	require.NoError(t, err)
+	require.NotEqual(t, "JWT", parsed.Header["typ"])
+	require.NotContains(t, trustClaims.Audience, tester.tokenOptions.Audience[0])
+
+	cases := []struct {
+		desc string
+		inCtx context.Context
+		inEmail string
+		outMsg string
+	}{
+		{
+			desc: "case 1 - trusted device skips 2FA",
+			inCtx: trustedContext(ctx, deviceTrustToken),
+			inEmail: "test@mail.ru",
+			outMsg: "Authorized",
+		},
+		{
+			desc: "case 2 - no trust token",
+			inCtx: laptopCtx,
+			inEmail: "test@mail.ru",
+			outMsg: "2FA code sended",
+		},
+		{
+			desc: "case 3 - trust token of another user",
+			inCtx: trustedContext(ctx, deviceTrustToken),
+			inEmail: "test2@mail.ru",
+			outMsg: "2FA code sended",
+		},
+		{
+			desc: "case 4 - forged trust token",
+			inCtx: trustedContext(ctx, deviceTrustToken[:len(deviceTrustToken) - 4] + "AAAA"),
+			inEmail: "test@mail.ru",
+			outMsg: "2FA code sended",
+		},
+		{
+			desc: "case 5 - access token in place of trust token",
+			inCtx: trustedContext(ctx, accessToken),
+			inEmail: "test@mail.ru",
+			outMsg: "2FA code sended",
+		},
+	}
+
+	for _, tC := range cases {
+		token, _, challengeId, msg, err := tester.sesService.Login(tC.inCtx, tC.inEmail, "admin")
+		require.NoError(t, err, tC.desc)
+		require.Equal(t, tC.outMsg, msg, tC.desc)
+
+		if msg == "Authorized" {
+			require.NotEmpty(t, token)
+			require.Empty(t, challengeId)
+		} else {
+			require.Empty(t, token)
+			require.NotEmpty(t, challengeId)
+		}
+	}
+
+	devices, err := tester.sesService.ListTrustedDevices(ctx, accessToken)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	require.Equal(t, "laptop", devices[0].UserAgent)
+	require.Equal(t, "10.0.0.1", devices[0].ClientIP)
+
+	_, err = tester.sesService.RevokeTrustedDevice(ctx, accessToken, "unknown")
+	require.ErrorIs(t, err, utils.ErrTrustedDeviceNotFound)
+
+	msg, err := tester.sesService.RevokeTrustedDevice(ctx, accessToken, devices[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, "Success", msg)
+
+	_, _, _, msg, _ = tester.sesService.Login(trustedContext(ctx, deviceTrustToken), "test@mail.ru", "admin")
+	require.Equal(t, "2FA code sended", msg)
+
+	devices, _ = tester.sesService.ListTrustedDevices(ctx, accessToken)
+	require.Empty(t, devices)
+}
+
+func TestTrustedDeviceAfterLogoutAll(t *testing.T) {
+
+	ctx, tester := NewTester(t)
+
+	tester.accService.Register(ctx, "test@mail.ru", "admin")
+	user := tester.permStor.UsersStorage["test@mail.ru"]
+	user.Use2FA = true
+	tester.permStor.UsersStorage["test@mail.ru"] = user
+
+	_, _, challengeId, _, _ := tester.sesService.Login(ctx, "test@mail.ru", "admin")
+	code, _ := tester.tempStor.GetTwoFACode(ctx, challengeId)
+	accessToken, _, deviceTrustToken, err := tester.sesService.LoginWith2FACode(ctx, challengeId, code, true)
+	require.NoError(t, err)
+
+	// logout everywhere bumps token version, remembered devices are forgotten too
+	_, err = tester.sesService.LogoutAll(ctx, accessToken)
+	require.NoError(t, err)
+
+	_, _, _, msg, err := tester.sesService.Login(trustedContext(ctx, deviceTrustToken), "test@mail.ru", "admin")
+	require.NoError(t, err)
+	require.Equal(t, "2FA code sended", msg)
+}
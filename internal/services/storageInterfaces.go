@@ -3,24 +3,185 @@ package services
 import (
 	"authSAS/internal/models"
 	"context"
+	"time"
 )
 
 // SessionService storage interfaces
 
 type UserGetter interface {
 	GetUserByEmail(ctx context.Context, email string) (user models.User, err error)
+	GetUserById(ctx context.Context, uid int64) (user models.User, err error)
 }
 
 type LogoutJWTKeeper interface {
-	KeepLogoutJWT(ctx context.Context, uid int64, token string) (err error)
+	KeepLogoutJWT(ctx context.Context, uid int64, jti string, expiresAt time.Time) (err error)
 }
 
-type TwoFACodeKeeper interface {
-	KeepTwoFACode(ctx context.Context, email string, code int) (err error)
+type LogoutJWTChecker interface {
+	IsJWTLoggedOut(ctx context.Context, jti string) (loggedOut bool, err error)
+}
+
+// PurgeExpiredLogoutJWTs removes entries of expired tokens, purged is 0 while
+// another instance is purging
+type LogoutJWTPurger interface {
+	PurgeExpiredLogoutJWTs(ctx context.Context) (purged int64, err error)
+}
+
+type RefreshTokenKeeper interface {
+	KeepRefreshToken(ctx context.Context, uid int64, familyId string, tokenHash string, expiresAt time.Time) (err error)
+}
+
+// UseRefreshToken marks the token as used in one step, so a token can be exchanged only once
+type RefreshTokenUser interface {
+	UseRefreshToken(ctx context.Context, tokenHash string) (refreshToken models.RefreshToken, err error)
+}
+
+type SessionKeeper interface {
+	KeepSession(ctx context.Context, session models.Session) (err error)
+}
+
+type SessionsGetter interface {
+	GetUserSessions(ctx context.Context, uid int64) (sessions []models.Session, err error)
+}
+
+type SessionChecker interface {
+	IsSessionRevoked(ctx context.Context, sessionId string) (revoked bool, err error)
+}
+
+// Revoking a session also revokes its refresh token family
+type SessionRevoker interface {
+	RevokeSession(ctx context.Context, uid int64, sessionId string) (err error)
+	RevokeOtherSessions(ctx context.Context, uid int64, exceptSessionId string) (err error)
+}
+
+type TrustedDeviceKeeper interface {
+	KeepTrustedDevice(ctx context.Context, device models.TrustedDevice) (err error)
+}
+
+// UseTrustedDevice checks the device is trusted for the user of the token version and marks it used,
+// revoked, expired or unknown device is ErrTrustedDeviceNotFound
+type TrustedDeviceUser interface {
+	UseTrustedDevice(ctx context.Context, uid int64, deviceId string, tokenVersion int64) (err error)
+}
+
+// GetUserTrustedDevices returns devices that still skip the second factor
+type TrustedDevicesGetter interface {
+	GetUserTrustedDevices(ctx context.Context, uid int64) (devices []models.TrustedDevice, err error)
+}
+
+type TrustedDeviceRevoker interface {
+	RevokeTrustedDevice(ctx context.Context, uid int64, deviceId string) (err error)
+}
+
+// Login challenge lives for code_ttl under its random id, so concurrent logins of one user don't interfere
+type LoginChallengeKeeper interface {
+	KeepLoginChallenge(ctx context.Context, challenge models.LoginChallenge) (err error)
+}
+
+type LoginChallengeGetter interface {
+	GetLoginChallenge(ctx context.Context, challengeId string) (challenge models.LoginChallenge, err error)
+}
+
+// DeleteLoginChallenge is ErrLoginChallengeNotFound when the challenge is already gone,
+// so of concurrent callers only one consumes it
+type LoginChallengeDeleter interface {
+	DeleteLoginChallenge(ctx context.Context, challengeId string) (err error)
+}
+
+// BumpTokenVersion invalidates every token issued to the user before
+// and revokes all of the user's sessions
+type TokenVersionBumper interface {
+	BumpTokenVersion(ctx context.Context, uid int64) (err error)
+}
+
+// KeepTOTPSecret stores encrypted secret of a new enrollment, TOTP stays disabled until confirmed
+type TOTPSecretKeeper interface {
+	KeepTOTPSecret(ctx context.Context, uid int64, encryptedSecret string) (err error)
+}
+
+type TOTPEnabler interface {
+	EnableTOTP(ctx context.Context, uid int64) (err error)
+}
+
+// UseTOTPStep moves the last used time step forward, an older or the same step is ErrTOTPCodeReused
+type TOTPStepUser interface {
+	UseTOTPStep(ctx context.Context, uid int64, step int64) (err error)
+}
+
+// ReplaceRecoveryCodes drops all codes of the user and stores new ones
+type RecoveryCodesKeeper interface {
+	ReplaceRecoveryCodes(ctx context.Context, uid int64, codeHashes [][]byte) (err error)
+}
+
+type RecoveryCodesGetter interface {
+	GetUnusedRecoveryCodes(ctx context.Context, uid int64) (codes []models.RecoveryCode, err error)
+}
+
+// UseRecoveryCode marks the code consumed in one step, a consumed code is ErrRecoveryCodeUsed
+type RecoveryCodeUser interface {
+	UseRecoveryCode(ctx context.Context, codeId int64) (err error)
+}
+
+type WebAuthnCredentialKeeper interface {
+	KeepWebAuthnCredential(ctx context.Context, credential models.WebAuthnCredential) (err error)
+}
+
+type WebAuthnCredentialsGetter interface {
+	GetUserWebAuthnCredentials(ctx context.Context, uid int64) (credentials []models.WebAuthnCredential, err error)
+}
+
+// UpdateWebAuthnCredential stores state reported by the authenticator on login
+type WebAuthnCredentialUpdater interface {
+	UpdateWebAuthnCredential(ctx context.Context, credentialId []byte, signCount uint32, backupState bool) (err error)
+}
+
+// WebAuthn ceremony state (challenge etc.) lives for code_ttl
+type WebAuthnSessionKeeper interface {
+	KeepWebAuthnSession(ctx context.Context, challengeId string, session []byte) (err error)
+}
+
+// TakeWebAuthnSession returns and deletes the state, so a challenge is answered only once
+type WebAuthnSessionTaker interface {
+	TakeWebAuthnSession(ctx context.Context, challengeId string) (session []byte, err error)
+}
+
+// CountFailedCodeAttempt increments wrong guesses of the code in one step, the counter lives
+// for code_ttl and starts over when a new code of the purpose is kept
+type CodeAttemptsCounter interface {
+	CountFailedCodeAttempt(ctx context.Context, purpose models.CodePurpose, id string) (attempts int64, err error)
+}
+
+// DropCode deletes the code (login challenge for CodePurposeLogin), so it can't be guessed anymore
+type CodeDropper interface {
+	DropCode(ctx context.Context, purpose models.CodePurpose, id string) (err error)
+}
+
+// ReserveCodeSend counts a send of the purpose's code to the recipient in one step. Within cooldown
+// of the previous send it is ErrCodeSendCooldown, after dailyQuota sends of the last 24h it is
+// ErrCodeSendQuotaExceeded, retryAfter tells when a send is allowed again. Zero or negative turns a limit off
+type CodeSendReserver interface {
+	ReserveCodeSend(ctx context.Context, purpose models.CodePurpose, recipient string, cooldown time.Duration, dailyQuota int) (retryAfter time.Duration, err error)
+}
+
+// KeepRevocation stores revoked jti or sid for ttl (remaining lifetime of the token)
+type RevocationCacheKeeper interface {
+	KeepRevocation(ctx context.Context, id string, ttl time.Duration) (err error)
+}
+
+// IsRevocationCached is true when any of ids is stored, false means the cache has no answer
+type RevocationCacheChecker interface {
+	IsRevocationCached(ctx context.Context, ids ...string) (revoked bool, err error)
 }
 
-type TwoFACodeGetter interface {
-	GetTwoFACode(ctx context.Context, email string) (code int, err error)
+// KeepTokenVersion stores token version of the user for ttl unless a newer one is already stored,
+// versions only grow, so a late write of a stale version can't hide a bump
+type TokenVersionCacheKeeper interface {
+	KeepTokenVersion(ctx context.Context, uid int64, version int64, ttl time.Duration) (err error)
+}
+
+// GetCachedTokenVersion is found false when the cache has no answer
+type TokenVersionCacheGetter interface {
+	GetCachedTokenVersion(ctx context.Context, uid int64) (version int64, found bool, err error)
 }
 
 // AccountService storage interfaces
@@ -37,20 +198,62 @@ type PassChanger interface {
 	ChangePassword(ctx context.Context, email string, newPassHash []byte) (err error)
 }
 
-type EmailVerifyCodeKeeper interface {
-	KeepEmailVerifyCode(ctx context.Context, email string, code int) (err error)
+// ChangeEmail replaces the email of the user in one step, it is ErrUserNotFound when the user's email
+// is not oldEmail anymore and ErrUserAlreadyExists when newEmail is taken. The new address is marked
+// verified, it was proven by the code sent to it
+type EmailChanger interface {
+	ChangeEmail(ctx context.Context, uid int64, oldEmail string, newEmail string) (err error)
 }
 
-type EmailVerifyCodeGetter interface {
-	GetEmailVerifyCode(ctx context.Context, email string) (code int, err error)
+// SetCodeChannel sets phone of the user and the channel one-time codes go to, empty phone removes it
+type CodeChannelSetter interface {
+	SetCodeChannel(ctx context.Context, uid int64, phone string, channel models.DeliveryChannel) (err error)
+}
+
+// SetUse2FA switches emailed 2FA codes, turning 2FA off also drops enrolled TOTP and recovery codes
+type TwoFASetter interface {
+	SetUse2FA(ctx context.Context, uid int64, use2FA bool) (err error)
+}
+
+// KeepTwoFACode keeps the emailed login code of the challenge
+type TwoFACodeKeeper interface {
+	KeepTwoFACode(ctx context.Context, challengeId string, code string) (err error)
+}
+
+// KeepMagicLink keeps the link token until it is consumed or code TTL runs out
+type MagicLinkKeeper interface {
+	KeepMagicLink(ctx context.Context, tokenId string, token string) (err error)
+}
+
+type EmailVerifyCodeKeeper interface {
+	KeepEmailVerifyCode(ctx context.Context, email string, code string) (err error)
 }
 
 type PassRecoverCodeKeeper interface {
-	KeepPassRecoverCode(ctx context.Context, email string, code int) (err error)
+	KeepPassRecoverCode(ctx context.Context, email string, code string) (err error)
+}
+
+type TwoFASettingsCodeKeeper interface {
+	KeepTwoFASettingsCode(ctx context.Context, email string, code string) (err error)
+}
+
+// KeepChangeEmailCode keeps the code sent to the new address under the current email,
+// so a user has one pending change at a time
+type ChangeEmailCodeKeeper interface {
+	KeepChangeEmailCode(ctx context.Context, email string, code string) (err error)
+}
+
+// KeepConfirmPhoneCode keeps the code sent to the new phone under the email,
+// so a user has one pending phone at a time
+type ConfirmPhoneCodeKeeper interface {
+	KeepConfirmPhoneCode(ctx context.Context, email string, code string) (err error)
 }
 
-type PassRecoverCodeGetter interface {
-	GetPassRecoverCode(ctx context.Context, email string) (code int, err error)
+// ConsumeCode compares the code with the kept one and deletes it on match in one step,
+// so a code is used at most once. Mismatch is ErrWrongCode, missing code is ErrCodeNotFound.
+// Codes are kept as keyed digests, never in plain text, and compared in constant time
+type CodeConsumer interface {
+	ConsumeCode(ctx context.Context, purpose models.CodePurpose, id string, code string) (err error)
 }
 
 
@@ -59,18 +262,57 @@ type PassRecoverCodeGetter interface {
 type PermanentStorage interface {
 	UserGetter
 	LogoutJWTKeeper
+	LogoutJWTChecker
+	LogoutJWTPurger
+	RefreshTokenKeeper
+	RefreshTokenUser
+	SessionKeeper
+	SessionsGetter
+	SessionChecker
+	SessionRevoker
+	TrustedDeviceKeeper
+	TrustedDeviceUser
+	TrustedDevicesGetter
+	TrustedDeviceRevoker
+	TokenVersionBumper
+	TOTPSecretKeeper
+	TOTPEnabler
+	TOTPStepUser
+	RecoveryCodesKeeper
+	RecoveryCodesGetter
+	RecoveryCodeUser
+	WebAuthnCredentialKeeper
+	WebAuthnCredentialsGetter
+	WebAuthnCredentialUpdater
 
 	UserCreator
 	EmailVerificator
 	PassChanger
+	EmailChanger
+	TwoFASetter
+	CodeChannelSetter
 }
 
 type TemporaryStorage interface {
-	TwoFACodeKeeper
-	TwoFACodeGetter
+	LoginChallengeKeeper
+	LoginChallengeGetter
+	LoginChallengeDeleter
+	CodeAttemptsCounter
+	CodeDropper
+	CodeSendReserver
+	WebAuthnSessionKeeper
+	WebAuthnSessionTaker
+	RevocationCacheKeeper
+	RevocationCacheChecker
+	TokenVersionCacheKeeper
+	TokenVersionCacheGetter
 
+	TwoFACodeKeeper
 	EmailVerifyCodeKeeper
-	EmailVerifyCodeGetter
 	PassRecoverCodeKeeper
-	PassRecoverCodeGetter
+	TwoFASettingsCodeKeeper
+	ChangeEmailCodeKeeper
+	ConfirmPhoneCodeKeeper
+	MagicLinkKeeper
+	CodeConsumer
 }
\ No newline at end of file
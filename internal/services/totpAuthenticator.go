@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_secretbox "authSAS/internal/utils/secretBox"
+	utils_totp "authSAS/internal/utils/totp"
+)
+
+// totpWindow is how many time steps around now are accepted (clock drift of the phone)
+const totpWindow = 1
+
+// TOTPAuthenticator enrolls and checks authenticator app codes (RFC 6238).
+// Secrets are stored encrypted, every time step can be used only once.
+type TOTPAuthenticator struct {
+	logger *slog.Logger
+	issuer string
+	secretBox *utils_secretbox.SecretBox
+	totpSecretKeeper TOTPSecretKeeper
+	totpEnabler TOTPEnabler
+	totpStepUser TOTPStepUser
+}
+
+// NewTOTPAuthenticator creates authenticator, enrollment is disabled while secretBox is nil
+func NewTOTPAuthenticator(logger *slog.Logger, issuer string, secretBox *utils_secretbox.SecretBox, permanentStorage PermanentStorage) *TOTPAuthenticator {
+	return &TOTPAuthenticator{
+		logger: logger,
+		issuer: issuer,
+		secretBox: secretBox,
+		totpSecretKeeper: permanentStorage,
+		totpEnabler: permanentStorage,
+		totpStepUser: permanentStorage,
+	}
+}
+
+// Enroll stores a new secret of the user, it starts to work after Confirm
+func (a *TOTPAuthenticator) Enroll(ctx context.Context, user models.User) (secret string, uri string, err error) {
+	if a.secretBox == nil {
+		return "", "", utils.ErrTOTPDisabled
+	}
+
+	if user.TOTPEnabled {
+		return "", "", utils.ErrTOTPAlreadyEnabled
+	}
+
+	secret, err = utils_totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	encryptedSecret, err := a.secretBox.Seal(secret, secretOwner(user))
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := a.totpSecretKeeper.KeepTOTPSecret(ctx, user.Id, encryptedSecret); err != nil {
+		return "", "", err
+	}
+
+	return secret, utils_totp.URI(a.issuer, user.Email, secret), nil
+}
+
+// Confirm enables enrolled TOTP once the user proved the app generates right codes
+func (a *TOTPAuthenticator) Confirm(ctx context.Context, user models.User, code string) (err error) {
+	if user.TOTPEnabled {
+		return utils.ErrTOTPAlreadyEnabled
+	}
+
+	if err := a.verify(ctx, user, code); err != nil {
+		return err
+	}
+
+	return a.totpEnabler.EnableTOTP(ctx, user.Id)
+}
+
+// Verify checks login code of the user with enabled TOTP
+func (a *TOTPAuthenticator) Verify(ctx context.Context, user models.User, code string) (err error) {
+	if !user.TOTPEnabled {
+		return utils.ErrTOTPNotEnrolled
+	}
+
+	return a.verify(ctx, user, code)
+}
+
+func (a *TOTPAuthenticator) verify(ctx context.Context, user models.User, code string) (err error) {
+	if a.secretBox == nil {
+		return utils.ErrTOTPDisabled
+	}
+
+	if user.TOTPSecret == "" {
+		return utils.ErrTOTPNotEnrolled
+	}
+
+	secret, err := a.secretBox.Open(user.TOTPSecret, secretOwner(user))
+	if err != nil {
+		return err
+	}
+
+	step, ok, err := utils_totp.Validate(secret, code, time.Now(), totpWindow)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return utils.ErrWrong2FACode
+	}
+
+	return a.totpStepUser.UseTOTPStep(ctx, user.Id, step)
+}
+
+// secretOwner binds encrypted secret to the user, a secret copied to another row does not open
+func secretOwner(user models.User) string {
+	return strconv.FormatInt(user.Id, 10)
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_client "authSAS/internal/utils/clientInfo"
+	utils_jwt "authSAS/internal/utils/jwt"
+	utils_random "authSAS/internal/utils/randomCode"
+)
+
+// TrustedDevices remembers devices that passed the second factor. The trust token is signed
+// by the JWT key ring and points to a device record, so a device can be revoked any time
+type TrustedDevices struct {
+	logger *slog.Logger
+	ttl time.Duration
+	keyRing *utils_jwt.KeyRing
+	tokenOptions utils_jwt.Options
+	trustedDeviceKeeper TrustedDeviceKeeper
+	trustedDeviceUser TrustedDeviceUser
+}
+
+func NewTrustedDevices(logger *slog.Logger, ttl time.Duration, keyRing *utils_jwt.KeyRing, tokenOptions utils_jwt.Options, permanentStorage PermanentStorage) *TrustedDevices {
+	return &TrustedDevices{
+		logger: logger,
+		ttl: ttl,
+		keyRing: keyRing,
+		tokenOptions: tokenOptions,
+		trustedDeviceKeeper: permanentStorage,
+		trustedDeviceUser: permanentStorage,
+	}
+}
+
+// Trust remembers the client of ctx as a device of the user and returns its trust token
+func (d *TrustedDevices) Trust(ctx context.Context, user models.User) (trustToken string, err error) {
+	deviceId, err := utils_random.RandToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	clientIP, userAgent := utils_client.FromContext(ctx)
+
+	device := models.TrustedDevice{
+		Id: deviceId,
+		UserId: user.Id,
+		TokenVersion: user.TokenVersion,
+		CreatedAt: now,
+		ExpiresAt: now.Add(d.ttl),
+		LastUsedAt: now,
+		ClientIP: clientIP,
+		UserAgent: userAgent,
+	}
+
+	trustToken, err = utils_jwt.NewDeviceTrustToken(user.Id, deviceId, d.ttl, d.keyRing.Active(), d.tokenOptions)
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.trustedDeviceKeeper.KeepTrustedDevice(ctx, device); err != nil {
+		return "", err
+	}
+
+	d.logger.Info("Device trusted", "uid", user.Id, "device", deviceId)
+
+	return trustToken, nil
+}
+
+// IsTrusted tells whether the trust token sent with ctx belongs to a trusted device of the user
+func (d *TrustedDevices) IsTrusted(ctx context.Context, user models.User) (trusted bool, err error) {
+	trustToken := utils_client.DeviceTrustToken(ctx)
+	if trustToken == "" {
+		return false, nil
+	}
+
+	uid, deviceId, err := utils_jwt.ParseDeviceTrustToken(trustToken, d.keyRing, d.tokenOptions)
+	if err != nil || uid != user.Id {
+		return false, nil
+	}
+
+	err = d.trustedDeviceUser.UseTrustedDevice(ctx, user.Id, deviceId, user.TokenVersion)
+	if err != nil {
+		if errors.Is(err, utils.ErrTrustedDeviceNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,60 @@
+package mockups
+
+import (
+	"authSAS/internal/models"
+	"context"
+	"sync"
+)
+
+// SentCode is a code recorded by CodeDelivererMockup
+type SentCode struct {
+	User models.User
+	Message models.CodeMessage
+}
+
+// SentNotice is a security notice recorded by CodeDelivererMockup
+type SentNotice struct {
+	User models.User
+	Notice models.SecurityNotice
+}
+
+// CodeDelivererMockup is an in-memory delivery channel, it records codes and notices in place of sending them
+type CodeDelivererMockup struct {
+	Sent []SentCode
+	Notices []SentNotice
+	sync.RWMutex
+}
+
+func NewCodeDelivererMokup() (*CodeDelivererMockup) {
+	return &CodeDelivererMockup{}
+}
+
+func (d *CodeDelivererMockup) DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) (err error) {
+	d.RWMutex.Lock()
+	d.Sent = append(d.Sent, SentCode{User: user, Message: message})
+	d.RWMutex.Unlock()
+
+	return nil
+}
+
+func (d *CodeDelivererMockup) NotifySecurityEvent(ctx context.Context, user models.User, notice models.SecurityNotice) (err error) {
+	d.RWMutex.Lock()
+	d.Notices = append(d.Notices, SentNotice{User: user, Notice: notice})
+	d.RWMutex.Unlock()
+
+	return nil
+}
+
+// LastCode returns the latest code of the purpose sent to the user of the email
+func (d *CodeDelivererMockup) LastCode(email string, purpose models.CodePurpose) (code string, ok bool) {
+	d.RWMutex.RLock()
+	defer d.RWMutex.RUnlock()
+
+	for i := len(d.Sent) - 1; i >= 0; i-- {
+		if d.Sent[i].User.Email == email && d.Sent[i].Message.Purpose == purpose {
+			return d.Sent[i].Message.Code, true
+		}
+	}
+
+	return "", false
+}
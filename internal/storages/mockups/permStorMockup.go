@@ -5,12 +5,19 @@ import (
 	"authSAS/internal/utils"
 	"context"
 	"sync"
+	"time"
 )
 
 type PermStorMockup struct {
 	UsersStorage map[string] models.User
-	JwtStore map[int64] string
+	JwtStore map[string] time.Time
+	RefreshTokenStore map[string] models.RefreshToken
+	SessionStore map[string] models.Session
+	RecoveryCodeStore map[int64] models.RecoveryCode // unused codes only
+	WebAuthnCredentialStore map[string] models.WebAuthnCredential
+	TrustedDeviceStore map[string] models.TrustedDevice // revoked devices are deleted
 	usersCnt int
+	recoveryCodesCnt int64
 	sync.RWMutex
  
 }
@@ -18,7 +25,12 @@ type PermStorMockup struct {
 func NewPermStorMokup() (*PermStorMockup) {
 	return &PermStorMockup{
 		UsersStorage: make(map[string] models.User), 
-		JwtStore: make(map[int64] string),
+		JwtStore: make(map[string] time.Time),
+		RefreshTokenStore: make(map[string] models.RefreshToken),
+		SessionStore: make(map[string] models.Session),
+		RecoveryCodeStore: make(map[int64] models.RecoveryCode),
+		WebAuthnCredentialStore: make(map[string] models.WebAuthnCredential),
+		TrustedDeviceStore: make(map[string] models.TrustedDevice),
 		usersCnt: 0,
 	}
 }
@@ -35,22 +47,257 @@ func (s *PermStorMockup) GetUserByEmail(ctx context.Context, email string) (user
 	return result, nil
 }
 
-func (s *PermStorMockup) KeepLogoutJWT(ctx context.Context, uid int64, token string) (err error) {
+func (s *PermStorMockup) GetUserById(ctx context.Context, uid int64) (user models.User, err error) {
 	s.RWMutex.RLock()
-	_, ok := s.JwtStore[uid]
-	s.RWMutex.RUnlock()
+	defer s.RWMutex.RUnlock()
 
-	if ok {
+	for _, result := range s.UsersStorage {
+		if result.Id == uid {
+			return result, nil
+		}
+	}
+
+	return models.User{}, utils.ErrUserNotFound
+}
+
+func (s *PermStorMockup) KeepLogoutJWT(ctx context.Context, uid int64, jti string, expiresAt time.Time) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if _, ok := s.JwtStore[jti]; ok {
 		return utils.ErrJWTAlreadyAdded
 	}
 
+	s.JwtStore[jti] = expiresAt
+
+	return nil
+}
+
+func (s *PermStorMockup) IsJWTLoggedOut(ctx context.Context, jti string) (loggedOut bool, err error) {
+	s.RWMutex.RLock()
+	_, ok := s.JwtStore[jti]
+	s.RWMutex.RUnlock()
+
+	return ok, nil
+}
+
+func (s *PermStorMockup) PurgeExpiredLogoutJWTs(ctx context.Context) (purged int64, err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	for jti, expiresAt := range s.JwtStore {
+		if expiresAt.Before(time.Now()) {
+			delete(s.JwtStore, jti)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *PermStorMockup) KeepRefreshToken(ctx context.Context, uid int64, familyId string, tokenHash string, expiresAt time.Time) (err error) {
+	s.RWMutex.Lock()
+	s.RefreshTokenStore[tokenHash] = models.RefreshToken{
+		Id: int64(len(s.RefreshTokenStore) + 1),
+		UserId: uid,
+		FamilyId: familyId,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	}
+	s.RWMutex.Unlock()
+
+	return nil
+}
+
+func (s *PermStorMockup) UseRefreshToken(ctx context.Context, tokenHash string) (refreshToken models.RefreshToken, err error) {
 	s.RWMutex.Lock()
-	s.JwtStore[uid] = token
+	defer s.RWMutex.Unlock()
+
+	result, ok := s.RefreshTokenStore[tokenHash]
+	if !ok {
+		return models.RefreshToken{}, utils.ErrRefreshTokenNotFound
+	}
+
+	if result.IsRevoked {
+		return result, utils.ErrRefreshTokenRevoked
+	}
+
+	if result.IsUsed {
+		return result, utils.ErrRefreshTokenReused
+	}
+
+	result.IsUsed = true
+	s.RefreshTokenStore[tokenHash] = result
+
+	return result, nil
+}
+
+func (s *PermStorMockup) KeepSession(ctx context.Context, session models.Session) (err error) {
+	s.RWMutex.Lock()
+	s.SessionStore[session.Id] = session
 	s.RWMutex.Unlock()
 
 	return nil
 }
 
+func (s *PermStorMockup) GetUserSessions(ctx context.Context, uid int64) (sessions []models.Session, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	for _, session := range s.SessionStore {
+		if session.UserId == uid && !session.IsRevoked && session.ExpiresAt.After(time.Now()) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (s *PermStorMockup) IsSessionRevoked(ctx context.Context, sessionId string) (revoked bool, err error) {
+	s.RWMutex.RLock()
+	session, ok := s.SessionStore[sessionId]
+	s.RWMutex.RUnlock()
+
+	if !ok {
+		return false, utils.ErrSessionNotFound
+	}
+
+	return session.IsRevoked, nil
+}
+
+func (s *PermStorMockup) RevokeSession(ctx context.Context, uid int64, sessionId string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	session, ok := s.SessionStore[sessionId]
+	if !ok || session.UserId != uid {
+		return utils.ErrSessionNotFound
+	}
+
+	session.IsRevoked = true
+	s.SessionStore[sessionId] = session
+
+	s.revokeRefreshTokens(func(refreshToken models.RefreshToken) bool {
+		return refreshToken.FamilyId == sessionId
+	})
+
+	return nil
+}
+
+func (s *PermStorMockup) RevokeOtherSessions(ctx context.Context, uid int64, exceptSessionId string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	for id, session := range s.SessionStore {
+		if session.UserId == uid && id != exceptSessionId {
+			session.IsRevoked = true
+			s.SessionStore[id] = session
+		}
+	}
+
+	s.revokeRefreshTokens(func(refreshToken models.RefreshToken) bool {
+		return refreshToken.UserId == uid && refreshToken.FamilyId != exceptSessionId
+	})
+
+	return nil
+}
+
+func (s *PermStorMockup) KeepTrustedDevice(ctx context.Context, device models.TrustedDevice) (err error) {
+	s.RWMutex.Lock()
+	s.TrustedDeviceStore[device.Id] = device
+	s.RWMutex.Unlock()
+
+	return nil
+}
+
+func (s *PermStorMockup) UseTrustedDevice(ctx context.Context, uid int64, deviceId string, tokenVersion int64) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	device, ok := s.TrustedDeviceStore[deviceId]
+	if !ok || device.UserId != uid || device.TokenVersion != tokenVersion || !device.ExpiresAt.After(time.Now()) {
+		return utils.ErrTrustedDeviceNotFound
+	}
+
+	device.LastUsedAt = time.Now()
+	s.TrustedDeviceStore[deviceId] = device
+
+	return nil
+}
+
+func (s *PermStorMockup) GetUserTrustedDevices(ctx context.Context, uid int64) (devices []models.TrustedDevice, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	var tokenVersion int64
+	for _, user := range s.UsersStorage {
+		if user.Id == uid {
+			tokenVersion = user.TokenVersion
+		}
+	}
+
+	for _, device := range s.TrustedDeviceStore {
+		if device.UserId == uid && device.TokenVersion == tokenVersion && device.ExpiresAt.After(time.Now()) {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+func (s *PermStorMockup) RevokeTrustedDevice(ctx context.Context, uid int64, deviceId string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	device, ok := s.TrustedDeviceStore[deviceId]
+	if !ok || device.UserId != uid {
+		return utils.ErrTrustedDeviceNotFound
+	}
+
+	delete(s.TrustedDeviceStore, deviceId)
+
+	return nil
+}
+
+// revokeRefreshTokens must be called under write lock
+func (s *PermStorMockup) revokeRefreshTokens(match func(refreshToken models.RefreshToken) bool) {
+	for hash, refreshToken := range s.RefreshTokenStore {
+		if match(refreshToken) {
+			refreshToken.IsRevoked = true
+			s.RefreshTokenStore[hash] = refreshToken
+		}
+	}
+}
+
+func (s *PermStorMockup) BumpTokenVersion(ctx context.Context, uid int64) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	for email, user := range s.UsersStorage {
+		if user.Id != uid {
+			continue
+		}
+
+		user.TokenVersion++
+		s.UsersStorage[email] = user
+
+		for id, session := range s.SessionStore {
+			if session.UserId == uid {
+				session.IsRevoked = true
+				s.SessionStore[id] = session
+			}
+		}
+
+		s.revokeRefreshTokens(func(refreshToken models.RefreshToken) bool {
+			return refreshToken.UserId == uid
+		})
+
+		return nil
+	}
+
+	return utils.ErrUserNotFound
+}
+
 func (s *PermStorMockup) CreateUser(ctx context.Context, email string, passHash []byte) (userId int64, err error) {
 	s.RWMutex.RLock()
 	_, ok := s.UsersStorage[email]
@@ -111,4 +358,193 @@ func (s *PermStorMockup) ChangePassword(ctx context.Context, email string, newPa
 	s.RWMutex.Unlock()
 
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *PermStorMockup) ChangeEmail(ctx context.Context, uid int64, oldEmail string, newEmail string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	user, ok := s.UsersStorage[oldEmail]
+	if !ok || user.Id != uid {
+		return utils.ErrUserNotFound
+	}
+
+	if _, ok := s.UsersStorage[newEmail]; ok {
+		return utils.ErrUserAlreadyExists
+	}
+
+	user.Email = newEmail
+	user.IsVerified = true
+
+	delete(s.UsersStorage, oldEmail)
+	s.UsersStorage[newEmail] = user
+
+	return nil
+}
+
+func (s *PermStorMockup) KeepTOTPSecret(ctx context.Context, uid int64, encryptedSecret string) (err error) {
+	return s.updateUser(uid, func(user *models.User) error {
+		user.TOTPSecret = encryptedSecret
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		return nil
+	})
+}
+
+func (s *PermStorMockup) EnableTOTP(ctx context.Context, uid int64) (err error) {
+	return s.updateUser(uid, func(user *models.User) error {
+		if user.TOTPSecret == "" {
+			return utils.ErrTOTPNotEnrolled
+		}
+		user.TOTPEnabled = true
+		return nil
+	})
+}
+
+func (s *PermStorMockup) UseTOTPStep(ctx context.Context, uid int64, step int64) (err error) {
+	return s.updateUser(uid, func(user *models.User) error {
+		if step <= user.TOTPLastStep {
+			return utils.ErrTOTPCodeReused
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+}
+
+func (s *PermStorMockup) SetCodeChannel(ctx context.Context, uid int64, phone string, channel models.DeliveryChannel) (err error) {
+	return s.updateUser(uid, func(user *models.User) error {
+		user.Phone = phone
+		user.PreferredChannel = channel
+		return nil
+	})
+}
+
+func (s *PermStorMockup) SetUse2FA(ctx context.Context, uid int64, use2FA bool) (err error) {
+	return s.updateUser(uid, func(user *models.User) error {
+		user.Use2FA = use2FA
+		if !use2FA {
+			user.TOTPSecret = ""
+			user.TOTPEnabled = false
+			s.deleteRecoveryCodes(uid)
+		}
+		return nil
+	})
+}
+
+func (s *PermStorMockup) ReplaceRecoveryCodes(ctx context.Context, uid int64, codeHashes [][]byte) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	s.deleteRecoveryCodes(uid)
+
+	for _, codeHash := range codeHashes {
+		s.recoveryCodesCnt++
+		s.RecoveryCodeStore[s.recoveryCodesCnt] = models.RecoveryCode{
+			Id: s.recoveryCodesCnt,
+			UserId: uid,
+			CodeHash: codeHash,
+		}
+	}
+
+	return nil
+}
+
+func (s *PermStorMockup) GetUnusedRecoveryCodes(ctx context.Context, uid int64) (codes []models.RecoveryCode, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	for _, code := range s.RecoveryCodeStore {
+		if code.UserId == uid {
+			codes = append(codes, code)
+		}
+	}
+
+	return codes, nil
+}
+
+func (s *PermStorMockup) UseRecoveryCode(ctx context.Context, codeId int64) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if _, ok := s.RecoveryCodeStore[codeId]; !ok {
+		return utils.ErrRecoveryCodeUsed
+	}
+
+	delete(s.RecoveryCodeStore, codeId)
+
+	return nil
+}
+
+func (s *PermStorMockup) KeepWebAuthnCredential(ctx context.Context, credential models.WebAuthnCredential) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if _, ok := s.WebAuthnCredentialStore[string(credential.Id)]; ok {
+		return utils.ErrWebAuthnCredentialAlreadyExists
+	}
+
+	credential.CreatedAt = time.Now()
+	s.WebAuthnCredentialStore[string(credential.Id)] = credential
+
+	return nil
+}
+
+func (s *PermStorMockup) GetUserWebAuthnCredentials(ctx context.Context, uid int64) (credentials []models.WebAuthnCredential, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	for _, credential := range s.WebAuthnCredentialStore {
+		if credential.UserId == uid {
+			credentials = append(credentials, credential)
+		}
+	}
+
+	return credentials, nil
+}
+
+func (s *PermStorMockup) UpdateWebAuthnCredential(ctx context.Context, credentialId []byte, signCount uint32, backupState bool) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	credential, ok := s.WebAuthnCredentialStore[string(credentialId)]
+	if !ok {
+		return utils.ErrPasskeyNotFound
+	}
+
+	credential.SignCount = signCount
+	credential.BackupState = backupState
+	s.WebAuthnCredentialStore[string(credentialId)] = credential
+
+	return nil
+}
+
+// deleteRecoveryCodes must be called under the lock
+func (s *PermStorMockup) deleteRecoveryCodes(uid int64) {
+	for id, code := range s.RecoveryCodeStore {
+		if code.UserId == uid {
+			delete(s.RecoveryCodeStore, id)
+		}
+	}
+}
+
+// updateUser applies update to the user found by id, nothing is stored when update fails
+func (s *PermStorMockup) updateUser(uid int64, update func(user *models.User) error) error {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	for email, user := range s.UsersStorage {
+		if user.Id != uid {
+			continue
+		}
+
+		if err := update(&user); err != nil {
+			return err
+		}
+
+		s.UsersStorage[email] = user
+
+		return nil
+	}
+
+	return utils.ErrUserNotFound
+}
@@ -1,56 +1,135 @@
 package mockups
 
 import (
+	"authSAS/internal/models"
 	"authSAS/internal/utils"
 	"context"
+	"crypto/subtle"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 )
 
 type TempStorMockup struct {
-	codeStorage map[string] int
+	codeStorage map[string] string // plain codes, so tests can read the sent ones
+	RevocationStorage map[string] time.Time
+	TokenVersionStorage map[int64] cachedTokenVersion
+	WebAuthnSessionStorage map[string] []byte
+	LoginChallengeStorage map[string] models.LoginChallenge
+	CodeAttemptsStorage map[string] int64
+	CodeSendStorage map[string] *CodeSends
 	sync.RWMutex
 }
 
+// CodeSends of one purpose and recipient, tests may move the times back to skip the waiting
+type CodeSends struct {
+	CooldownUntil time.Time
+	Sent int
+	QuotaResetAt time.Time
+}
+
+type cachedTokenVersion struct {
+	version int64
+	expiresAt time.Time
+}
+
 func NewTempStorMokup() (*TempStorMockup) {
-	return &TempStorMockup{codeStorage: make(map[string] int)}
+	return &TempStorMockup{
+		codeStorage: make(map[string] string),
+		RevocationStorage: make(map[string] time.Time),
+		TokenVersionStorage: make(map[int64] cachedTokenVersion),
+		WebAuthnSessionStorage: make(map[string] []byte),
+		LoginChallengeStorage: make(map[string] models.LoginChallenge),
+		CodeAttemptsStorage: make(map[string] int64),
+		CodeSendStorage: make(map[string] *CodeSends),
+	}
+}
+
+func (s *TempStorMockup) KeepLoginChallenge(ctx context.Context, challenge models.LoginChallenge) (err error) {
+	s.RWMutex.Lock()
+	s.LoginChallengeStorage[challenge.Id] = challenge
+	s.RWMutex.Unlock()
+
+	return nil
+}
+
+func (s *TempStorMockup) GetLoginChallenge(ctx context.Context, challengeId string) (challenge models.LoginChallenge, err error) {
+	s.RWMutex.RLock()
+	challenge, ok := s.LoginChallengeStorage[challengeId]
+	s.RWMutex.RUnlock()
+
+	if !ok {
+		return models.LoginChallenge{}, utils.ErrLoginChallengeNotFound
+	}
+
+	return challenge, nil
 }
 
-func (s *TempStorMockup) KeepTwoFACode(ctx context.Context, email string, code int) (err error) {
-	key := fmt.Sprintf("2fa_code_key: %s", email)
+func (s *TempStorMockup) DeleteLoginChallenge(ctx context.Context, challengeId string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if _, ok := s.LoginChallengeStorage[challengeId]; !ok {
+		return utils.ErrLoginChallengeNotFound
+	}
+
+	delete(s.LoginChallengeStorage, challengeId)
+
+	return nil
+}
 
+func (s *TempStorMockup) KeepWebAuthnSession(ctx context.Context, challengeId string, session []byte) (err error) {
 	s.RWMutex.Lock()
-	s.codeStorage[key] = code
+	s.WebAuthnSessionStorage[challengeId] = session
 	s.RWMutex.Unlock()
 
 	return nil
 }
 
-func (s *TempStorMockup) GetTwoFACode(ctx context.Context, email string) (code int, err error) {
-	key := fmt.Sprintf("2fa_code_key: %s", email)
+func (s *TempStorMockup) TakeWebAuthnSession(ctx context.Context, challengeId string) (session []byte, err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	session, ok := s.WebAuthnSessionStorage[challengeId]
+	if !ok {
+		return nil, utils.ErrWebAuthnSessionNotFound
+	}
+
+	delete(s.WebAuthnSessionStorage, challengeId)
+
+	return session, nil
+}
+
+func (s *TempStorMockup) KeepTwoFACode(ctx context.Context, challengeId string, code string) (err error) {
+	s.keepCode(models.CodePurposeTwoFA, challengeId, code)
+
+	return nil
+}
+
+// GetTwoFACode lets tests read the sent code
+func (s *TempStorMockup) GetTwoFACode(ctx context.Context, challengeId string) (code string, err error) {
+	key := fmt.Sprintf("2fa_code_key: %s", challengeId)
 
 	s.RWMutex.RLock()
 	result , ok := s.codeStorage[key]
 	s.RWMutex.RUnlock()
 
 	if !ok {
-		return 0, utils.Err2FACodeNotFound
+		return "", utils.ErrCodeNotFound
 	}
 
 	return result, nil
 }
 
-func (s *TempStorMockup) KeepEmailVerifyCode(ctx context.Context, email string, code int) (err error) {
-	key := fmt.Sprintf("email_verify_key: %s", email)
-
-	s.RWMutex.Lock()
-	s.codeStorage[key] = code
-	s.RWMutex.Unlock()
+func (s *TempStorMockup) KeepEmailVerifyCode(ctx context.Context, email string, code string) (err error) {
+	s.keepCode(models.CodePurposeEmailVerify, email, code)
 
 	return nil
 }
 
-func (s *TempStorMockup) GetEmailVerifyCode(ctx context.Context, email string) (code int, err error) {
+// GetEmailVerifyCode lets tests read the sent code
+func (s *TempStorMockup) GetEmailVerifyCode(ctx context.Context, email string) (code string, err error) {
 	key := fmt.Sprintf("email_verify_key: %s", email)
 
 	s.RWMutex.RLock()
@@ -58,32 +137,218 @@ func (s *TempStorMockup) GetEmailVerifyCode(ctx context.Context, email string) (
 	s.RWMutex.RUnlock()
 
 	if !ok {
-		return 0, utils.ErrEmailVerifyCodeNotFound
+		return "", utils.ErrCodeNotFound
 	}
 
 	return result, nil
 }
 
-func (s *TempStorMockup) KeepPassRecoverCode(ctx context.Context, email string, code int) (err error) {
+func (s *TempStorMockup) KeepPassRecoverCode(ctx context.Context, email string, code string) (err error) {
+	s.keepCode(models.CodePurposePassRecover, email, code)
+
+	return nil
+}
+
+// GetPassRecoverCode lets tests read the sent code
+func (s *TempStorMockup) GetPassRecoverCode(ctx context.Context, email string) (code string, err error) {
 	key := fmt.Sprintf("pass_recover_key: %s", email)
 
-	s.RWMutex.Lock()
-	s.codeStorage[key] = code
-	s.RWMutex.Unlock()
+	s.RWMutex.RLock()
+	result , ok := s.codeStorage[key]
+	s.RWMutex.RUnlock()
+
+	if !ok {
+		return "", utils.ErrCodeNotFound
+	}
+
+	return result, nil
+}
+
+func (s *TempStorMockup) KeepTwoFASettingsCode(ctx context.Context, email string, code string) (err error) {
+	s.keepCode(models.CodePurposeTwoFASettings, email, code)
 
 	return nil
 }
 
-func (s *TempStorMockup) GetPassRecoverCode(ctx context.Context, email string) (code int, err error) {
-	key := fmt.Sprintf("pass_recover_key: %s", email)
+// GetTwoFASettingsCode lets tests read the sent code
+func (s *TempStorMockup) GetTwoFASettingsCode(ctx context.Context, email string) (code string, err error) {
+	key := fmt.Sprintf("2fa_settings_key: %s", email)
 
 	s.RWMutex.RLock()
 	result , ok := s.codeStorage[key]
 	s.RWMutex.RUnlock()
 
 	if !ok {
-		return 0, utils.ErrPassRecoverCodeNotFound
+		return "", utils.ErrCodeNotFound
 	}
 
 	return result, nil
-}
\ No newline at end of file
+}
+
+func (s *TempStorMockup) KeepChangeEmailCode(ctx context.Context, email string, code string) (err error) {
+	s.keepCode(models.CodePurposeChangeEmail, email, code)
+
+	return nil
+}
+
+func (s *TempStorMockup) KeepConfirmPhoneCode(ctx context.Context, email string, code string) (err error) {
+	s.keepCode(models.CodePurposeConfirmPhone, email, code)
+
+	return nil
+}
+
+func (s *TempStorMockup) KeepMagicLink(ctx context.Context, tokenId string, token string) (err error) {
+	s.keepCode(models.CodePurposeMagicLink, tokenId, token)
+
+	return nil
+}
+
+// GetMagicLinks lets tests read the sent link tokens
+func (s *TempStorMockup) GetMagicLinks(ctx context.Context) (tokens []string) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	for key, token := range s.codeStorage {
+		if strings.HasPrefix(key, "magic_link_key: ") {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
+
+func (s *TempStorMockup) KeepRevocation(ctx context.Context, id string, ttl time.Duration) (err error) {
+	s.RWMutex.Lock()
+	s.RevocationStorage[id] = time.Now().Add(ttl)
+	s.RWMutex.Unlock()
+
+	return nil
+}
+
+func (s *TempStorMockup) IsRevocationCached(ctx context.Context, ids ...string) (revoked bool, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	for _, id := range ids {
+		if expiresAt, ok := s.RevocationStorage[id]; ok && expiresAt.After(time.Now()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *TempStorMockup) KeepTokenVersion(ctx context.Context, uid int64, version int64, ttl time.Duration) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if stored, ok := s.TokenVersionStorage[uid]; ok && stored.version > version {
+		version = stored.version
+	}
+
+	s.TokenVersionStorage[uid] = cachedTokenVersion{version: version, expiresAt: time.Now().Add(ttl)}
+
+	return nil
+}
+
+func (s *TempStorMockup) GetCachedTokenVersion(ctx context.Context, uid int64) (version int64, found bool, err error) {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+
+	stored, ok := s.TokenVersionStorage[uid]
+	if !ok || !stored.expiresAt.After(time.Now()) {
+		return 0, false, nil
+	}
+
+	return stored.version, true, nil
+}
+
+func (s *TempStorMockup) CountFailedCodeAttempt(ctx context.Context, purpose models.CodePurpose, id string) (attempts int64, err error) {
+	key := fmt.Sprintf("%s_attempts_key: %s", purpose, id)
+
+	s.RWMutex.Lock()
+	s.CodeAttemptsStorage[key]++
+	attempts = s.CodeAttemptsStorage[key]
+	s.RWMutex.Unlock()
+
+	return attempts, nil
+}
+
+func (s *TempStorMockup) ReserveCodeSend(ctx context.Context, purpose models.CodePurpose, recipient string, cooldown time.Duration, dailyQuota int) (retryAfter time.Duration, err error) {
+	key := fmt.Sprintf("%s_send_key: %s", purpose, recipient)
+	now := time.Now()
+
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	sends, ok := s.CodeSendStorage[key]
+	if !ok {
+		sends = &CodeSends{}
+		s.CodeSendStorage[key] = sends
+	}
+
+	if sends.CooldownUntil.After(now) {
+		return sends.CooldownUntil.Sub(now), utils.ErrCodeSendCooldown
+	}
+
+	if !sends.QuotaResetAt.After(now) {
+		sends.Sent = 0
+	}
+
+	if dailyQuota > 0 && sends.Sent >= dailyQuota {
+		return sends.QuotaResetAt.Sub(now), utils.ErrCodeSendQuotaExceeded
+	}
+
+	if dailyQuota > 0 {
+		if sends.Sent == 0 {
+			sends.QuotaResetAt = now.Add(24 * time.Hour)
+		}
+		sends.Sent++
+	}
+
+	sends.CooldownUntil = now.Add(cooldown)
+
+	return 0, nil
+}
+
+func (s *TempStorMockup) ConsumeCode(ctx context.Context, purpose models.CodePurpose, id string, code string) (err error) {
+	key := fmt.Sprintf("%s_key: %s", purpose, id)
+
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	keptCode, ok := s.codeStorage[key]
+	if !ok {
+		return utils.ErrCodeNotFound
+	}
+
+	if subtle.ConstantTimeCompare([]byte(keptCode), []byte(code)) != 1 {
+		return utils.ErrWrongCode
+	}
+
+	delete(s.codeStorage, key)
+	delete(s.CodeAttemptsStorage, fmt.Sprintf("%s_attempts_key: %s", purpose, id))
+
+	return nil
+}
+
+func (s *TempStorMockup) DropCode(ctx context.Context, purpose models.CodePurpose, id string) (err error) {
+	s.RWMutex.Lock()
+	defer s.RWMutex.Unlock()
+
+	if purpose == models.CodePurposeLogin {
+		delete(s.LoginChallengeStorage, id)
+		return nil
+	}
+
+	delete(s.codeStorage, fmt.Sprintf("%s_key: %s", purpose, id))
+
+	return nil
+}
+
+func (s *TempStorMockup) keepCode(purpose models.CodePurpose, id string, code string) {
+	s.RWMutex.Lock()
+	s.codeStorage[fmt.Sprintf("%s_key: %s", purpose, id)] = code
+	delete(s.CodeAttemptsStorage, fmt.Sprintf("%s_attempts_key: %s", purpose, id))
+	s.RWMutex.Unlock()
+}
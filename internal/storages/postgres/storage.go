@@ -3,6 +3,7 @@ package postgres
 import (
 	"context"
 	"errors"
+	"time"
 
 	"authSAS/internal/models"
 	"authSAS/internal/utils"
@@ -23,7 +24,8 @@ func NewStorage(pool *pgxpool.Pool) (*PermanentStorage) {
 // For Session Service 
 
 func (s *PermanentStorage) GetUserByEmail(ctx context.Context, email string) (user models.User, err error) {
-	query := `SELECT id, email, password_hash, is_verified, use_2fa, is_admin 
+	query := `SELECT id, email, password_hash, is_verified, use_2fa, is_admin, token_version, 
+	COALESCE(totp_secret, ''), totp_enabled, totp_last_step, COALESCE(phone, ''), preferred_channel 
 	FROM users 
 	WHERE email = $1`
 
@@ -34,6 +36,12 @@ func (s *PermanentStorage) GetUserByEmail(ctx context.Context, email string) (us
 		&user.IsVerified,
 		&user.Use2FA,
 		&user.IsAdmin,
+		&user.TokenVersion,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
+		&user.Phone,
+		&user.PreferredChannel,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -46,11 +54,42 @@ func (s *PermanentStorage) GetUserByEmail(ctx context.Context, email string) (us
 	return user, nil
 }
 
-func (s *PermanentStorage) KeepLogoutJWT(ctx context.Context, uid int64, token string) (err error) {
-	query := `INSERT INTO bad_jwts (user_id, token) 
-	VALUES ($1, $2);`
+func (s *PermanentStorage) GetUserById(ctx context.Context, uid int64) (user models.User, err error) {
+	query := `SELECT id, email, password_hash, is_verified, use_2fa, is_admin, token_version, 
+	COALESCE(totp_secret, ''), totp_enabled, totp_last_step, COALESCE(phone, ''), preferred_channel 
+	FROM users 
+	WHERE id = $1`
 
-	_, err = s.pool.Exec(ctx, query, uid, token)
+	err = s.pool.QueryRow(ctx, query, uid).Scan(
+		&user.Id,
+		&user.Email,
+		&user.PassHash,
+		&user.IsVerified,
+		&user.Use2FA,
+		&user.IsAdmin,
+		&user.TokenVersion,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
+		&user.Phone,
+		&user.PreferredChannel,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, utils.ErrUserNotFound
+		}
+
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+func (s *PermanentStorage) KeepLogoutJWT(ctx context.Context, uid int64, jti string, expiresAt time.Time) (err error) {
+	query := `INSERT INTO bad_jwts (user_id, jti, expires_at) 
+	VALUES ($1, $2, $3);`
+
+	_, err = s.pool.Exec(ctx, query, uid, jti, expiresAt)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
@@ -62,6 +101,559 @@ func (s *PermanentStorage) KeepLogoutJWT(ctx context.Context, uid int64, token s
 	return nil
 }
 
+func (s *PermanentStorage) IsJWTLoggedOut(ctx context.Context, jti string) (loggedOut bool, err error) {
+	query := `SELECT EXISTS (SELECT 1 FROM bad_jwts WHERE jti = $1)`
+
+	err = s.pool.QueryRow(ctx, query, jti).Scan(&loggedOut)
+	if err != nil {
+		return false, err
+	}
+
+	return loggedOut, nil
+}
+
+// purgeLockId is the advisory lock key that lets only one instance purge bad_jwts at a time
+const purgeLockId = 7263150412
+
+func (s *PermanentStorage) PurgeExpiredLogoutJWTs(ctx context.Context) (purged int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, purgeLockId).Scan(&locked); err != nil {
+		return 0, err
+	}
+
+	if !locked {
+		return 0, nil
+	}
+
+	query := `DELETE FROM bad_jwts 
+	WHERE expires_at < now()`
+
+	result, err := tx.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+func (s *PermanentStorage) KeepRefreshToken(ctx context.Context, uid int64, familyId string, tokenHash string, expiresAt time.Time) (err error) {
+	query := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) 
+	VALUES ($1, $2, $3, $4);`
+
+	_, err = s.pool.Exec(ctx, query, uid, familyId, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) UseRefreshToken(ctx context.Context, tokenHash string) (refreshToken models.RefreshToken, err error) {
+	query := `UPDATE refresh_tokens 
+	SET is_used = true 
+	WHERE token_hash = $1 AND NOT is_used AND NOT is_revoked 
+	RETURNING id, user_id, family_id, token_hash, expires_at, is_used, is_revoked`
+
+	err = s.pool.QueryRow(ctx, query, tokenHash).Scan(
+		&refreshToken.Id,
+		&refreshToken.UserId,
+		&refreshToken.FamilyId,
+		&refreshToken.TokenHash,
+		&refreshToken.ExpiresAt,
+		&refreshToken.IsUsed,
+		&refreshToken.IsRevoked,
+	)
+	if err == nil {
+		return refreshToken, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return models.RefreshToken{}, err
+	}
+
+	// token is unknown, already used or revoked - find out which one
+	query = `SELECT id, user_id, family_id, token_hash, expires_at, is_used, is_revoked 
+	FROM refresh_tokens 
+	WHERE token_hash = $1`
+
+	err = s.pool.QueryRow(ctx, query, tokenHash).Scan(
+		&refreshToken.Id,
+		&refreshToken.UserId,
+		&refreshToken.FamilyId,
+		&refreshToken.TokenHash,
+		&refreshToken.ExpiresAt,
+		&refreshToken.IsUsed,
+		&refreshToken.IsRevoked,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.RefreshToken{}, utils.ErrRefreshTokenNotFound
+		}
+		return models.RefreshToken{}, err
+	}
+
+	if refreshToken.IsRevoked {
+		return refreshToken, utils.ErrRefreshTokenRevoked
+	}
+
+	return refreshToken, utils.ErrRefreshTokenReused
+}
+
+func (s *PermanentStorage) KeepSession(ctx context.Context, session models.Session) (err error) {
+	query := `INSERT INTO sessions (id, user_id, issued_at, expires_at, client_ip, user_agent) 
+	VALUES ($1, $2, $3, $4, $5, $6);`
+
+	_, err = s.pool.Exec(ctx, query, session.Id, session.UserId, session.IssuedAt, session.ExpiresAt, session.ClientIP, session.UserAgent)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) GetUserSessions(ctx context.Context, uid int64) (sessions []models.Session, err error) {
+	query := `SELECT id, user_id, issued_at, expires_at, client_ip, user_agent, is_revoked 
+	FROM sessions 
+	WHERE user_id = $1 AND NOT is_revoked AND expires_at > now() 
+	ORDER BY issued_at DESC`
+
+	rows, err := s.pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session models.Session
+		err = rows.Scan(
+			&session.Id,
+			&session.UserId,
+			&session.IssuedAt,
+			&session.ExpiresAt,
+			&session.ClientIP,
+			&session.UserAgent,
+			&session.IsRevoked,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s *PermanentStorage) IsSessionRevoked(ctx context.Context, sessionId string) (revoked bool, err error) {
+	query := `SELECT is_revoked 
+	FROM sessions 
+	WHERE id = $1`
+
+	err = s.pool.QueryRow(ctx, query, sessionId).Scan(&revoked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, utils.ErrSessionNotFound
+		}
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (s *PermanentStorage) RevokeSession(ctx context.Context, uid int64, sessionId string) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE sessions 
+	SET is_revoked = true 
+	WHERE id = $1 AND user_id = $2`
+
+	result, err := tx.Exec(ctx, query, sessionId, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrSessionNotFound
+	}
+
+	query = `UPDATE refresh_tokens 
+	SET is_revoked = true 
+	WHERE family_id = $1`
+
+	if _, err := tx.Exec(ctx, query, sessionId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PermanentStorage) RevokeOtherSessions(ctx context.Context, uid int64, exceptSessionId string) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE sessions 
+	SET is_revoked = true 
+	WHERE user_id = $1 AND id <> $2 AND NOT is_revoked`
+
+	if _, err := tx.Exec(ctx, query, uid, exceptSessionId); err != nil {
+		return err
+	}
+
+	query = `UPDATE refresh_tokens 
+	SET is_revoked = true 
+	WHERE user_id = $1 AND family_id <> $2 AND NOT is_revoked`
+
+	if _, err := tx.Exec(ctx, query, uid, exceptSessionId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PermanentStorage) KeepTrustedDevice(ctx context.Context, device models.TrustedDevice) (err error) {
+	query := `INSERT INTO trusted_devices (id, user_id, token_version, created_at, expires_at, last_used_at, client_ip, user_agent) 
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+
+	_, err = s.pool.Exec(ctx, query, device.Id, device.UserId, device.TokenVersion, device.CreatedAt, device.ExpiresAt, device.LastUsedAt, device.ClientIP, device.UserAgent)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) UseTrustedDevice(ctx context.Context, uid int64, deviceId string, tokenVersion int64) (err error) {
+	query := `UPDATE trusted_devices 
+	SET last_used_at = now() 
+	WHERE id = $1 AND user_id = $2 AND token_version = $3 AND NOT is_revoked AND expires_at > now()`
+
+	result, err := s.pool.Exec(ctx, query, deviceId, uid, tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrTrustedDeviceNotFound
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) GetUserTrustedDevices(ctx context.Context, uid int64) (devices []models.TrustedDevice, err error) {
+	query := `SELECT d.id, d.user_id, d.token_version, d.created_at, d.expires_at, d.last_used_at, d.client_ip, d.user_agent 
+	FROM trusted_devices d 
+	JOIN users u ON u.id = d.user_id 
+	WHERE d.user_id = $1 AND NOT d.is_revoked AND d.expires_at > now() AND d.token_version = u.token_version 
+	ORDER BY d.last_used_at DESC`
+
+	rows, err := s.pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var device models.TrustedDevice
+		err = rows.Scan(
+			&device.Id,
+			&device.UserId,
+			&device.TokenVersion,
+			&device.CreatedAt,
+			&device.ExpiresAt,
+			&device.LastUsedAt,
+			&device.ClientIP,
+			&device.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+func (s *PermanentStorage) RevokeTrustedDevice(ctx context.Context, uid int64, deviceId string) (err error) {
+	query := `UPDATE trusted_devices 
+	SET is_revoked = true 
+	WHERE id = $1 AND user_id = $2 AND NOT is_revoked`
+
+	result, err := s.pool.Exec(ctx, query, deviceId, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrTrustedDeviceNotFound
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) BumpTokenVersion(ctx context.Context, uid int64) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE users 
+	SET token_version = token_version + 1 
+	WHERE id = $1`
+
+	result, err := tx.Exec(ctx, query, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrUserNotFound
+	}
+
+	query = `UPDATE sessions 
+	SET is_revoked = true 
+	WHERE user_id = $1 AND NOT is_revoked`
+
+	if _, err := tx.Exec(ctx, query, uid); err != nil {
+		return err
+	}
+
+	query = `UPDATE refresh_tokens 
+	SET is_revoked = true 
+	WHERE user_id = $1 AND NOT is_revoked`
+
+	if _, err := tx.Exec(ctx, query, uid); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PermanentStorage) KeepTOTPSecret(ctx context.Context, uid int64, encryptedSecret string) (err error) {
+	query := `UPDATE users 
+	SET totp_secret = $1, totp_enabled = false, totp_last_step = 0 
+	WHERE id = $2`
+
+	result, err := s.pool.Exec(ctx, query, encryptedSecret, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) EnableTOTP(ctx context.Context, uid int64) (err error) {
+	query := `UPDATE users 
+	SET totp_enabled = true 
+	WHERE id = $1 AND totp_secret IS NOT NULL`
+
+	result, err := s.pool.Exec(ctx, query, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrTOTPNotEnrolled
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) UseTOTPStep(ctx context.Context, uid int64, step int64) (err error) {
+	// compare and set in one statement, two concurrent logins can not use the same code
+	query := `UPDATE users 
+	SET totp_last_step = $1 
+	WHERE id = $2 AND totp_last_step < $1`
+
+	result, err := s.pool.Exec(ctx, query, step, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) ReplaceRecoveryCodes(ctx context.Context, uid int64, codeHashes [][]byte) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `DELETE FROM recovery_codes 
+	WHERE user_id = $1`
+
+	if _, err := tx.Exec(ctx, query, uid); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO recovery_codes (user_id, code_hash) 
+	VALUES ($1, $2)`
+
+	for _, codeHash := range codeHashes {
+		if _, err := tx.Exec(ctx, query, uid, codeHash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PermanentStorage) GetUnusedRecoveryCodes(ctx context.Context, uid int64) (codes []models.RecoveryCode, err error) {
+	query := `SELECT id, user_id, code_hash 
+	FROM recovery_codes 
+	WHERE user_id = $1 AND used_at IS NULL 
+	ORDER BY id`
+
+	rows, err := s.pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var code models.RecoveryCode
+
+		if err := rows.Scan(&code.Id, &code.UserId, &code.CodeHash); err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, rows.Err()
+}
+
+func (s *PermanentStorage) UseRecoveryCode(ctx context.Context, codeId int64) (err error) {
+	query := `UPDATE recovery_codes 
+	SET used_at = now() 
+	WHERE id = $1 AND used_at IS NULL`
+
+	result, err := s.pool.Exec(ctx, query, codeId)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrRecoveryCodeUsed
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) KeepWebAuthnCredential(ctx context.Context, credential models.WebAuthnCredential) (err error) {
+	query := `INSERT INTO webauthn_credentials (id, user_id, public_key, attestation_type, transports, sign_count, aaguid, backup_eligible, backup_state) 
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = s.pool.Exec(ctx, query,
+		credential.Id,
+		credential.UserId,
+		credential.PublicKey,
+		credential.AttestationType,
+		credential.Transports,
+		int64(credential.SignCount),
+		credential.AAGUID,
+		credential.BackupEligible,
+		credential.BackupState,
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return utils.ErrWebAuthnCredentialAlreadyExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) GetUserWebAuthnCredentials(ctx context.Context, uid int64) (credentials []models.WebAuthnCredential, err error) {
+	query := `SELECT id, user_id, public_key, attestation_type, transports, sign_count, aaguid, backup_eligible, backup_state, created_at 
+	FROM webauthn_credentials 
+	WHERE user_id = $1 
+	ORDER BY created_at`
+
+	rows, err := s.pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var credential models.WebAuthnCredential
+		var signCount int64
+
+		err := rows.Scan(
+			&credential.Id,
+			&credential.UserId,
+			&credential.PublicKey,
+			&credential.AttestationType,
+			&credential.Transports,
+			&signCount,
+			&credential.AAGUID,
+			&credential.BackupEligible,
+			&credential.BackupState,
+			&credential.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credential.SignCount = uint32(signCount)
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (s *PermanentStorage) UpdateWebAuthnCredential(ctx context.Context, credentialId []byte, signCount uint32, backupState bool) (err error) {
+	query := `UPDATE webauthn_credentials 
+	SET sign_count = $1, backup_state = $2, last_used_at = now() 
+	WHERE id = $3`
+
+	result, err := s.pool.Exec(ctx, query, int64(signCount), backupState, credentialId)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrPasskeyNotFound
+	}
+
+	return nil
+}
+
 // For Account Service 
 
 func (s *PermanentStorage) CreateUser(ctx context.Context, email string, passHash []byte) (userId int64, err error) {
@@ -113,4 +705,89 @@ func (s *PermanentStorage) ChangePassword(ctx context.Context, email string, new
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *PermanentStorage) ChangeEmail(ctx context.Context, uid int64, oldEmail string, newEmail string) (err error) {
+	query := `UPDATE users 
+	SET email = $1, is_verified = true 
+	WHERE id = $2 AND email = $3`
+
+	result, err := s.pool.Exec(ctx, query, newEmail, uid, oldEmail)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return utils.ErrUserAlreadyExists
+		}
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) SetCodeChannel(ctx context.Context, uid int64, phone string, channel models.DeliveryChannel) (err error) {
+	query := `UPDATE users 
+	SET phone = NULLIF($1, ''), preferred_channel = $2 
+	WHERE id = $3`
+
+	result, err := s.pool.Exec(ctx, query, phone, channel, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *PermanentStorage) SetUse2FA(ctx context.Context, uid int64, use2FA bool) (err error) {
+	query := `UPDATE users 
+	SET use_2fa = $1 
+	WHERE id = $2`
+
+	if use2FA {
+		result, err := s.pool.Exec(ctx, query, use2FA, uid)
+		if err != nil {
+			return err
+		}
+
+		if result.RowsAffected() == 0 {
+			return utils.ErrUserNotFound
+		}
+
+		return nil
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query = `UPDATE users 
+	SET use_2fa = $1, totp_secret = NULL, totp_enabled = false 
+	WHERE id = $2`
+
+	result, err := tx.Exec(ctx, query, use2FA, uid)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return utils.ErrUserNotFound
+	}
+
+	query = `DELETE FROM recovery_codes 
+	WHERE user_id = $1`
+
+	if _, err := tx.Exec(ctx, query, uid); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
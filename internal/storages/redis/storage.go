@@ -1,28 +1,87 @@
 package redis
 
 import (
+	"authSAS/internal/models"
 	"authSAS/internal/utils"
+	utils_hash "authSAS/internal/utils/hash"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// deleteCodeScript deletes the code (and its attempts counter) only when it is still the checked digest,
+// GET, compare and DEL run atomically so a code can't be used twice
+var deleteCodeScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`)
+
+// reserveCodeSendScript checks the cooldown and the daily counter of the recipient and counts the send,
+// returns {0, 0} when the send is allowed, {1, ms left} on cooldown and {2, ms left} when the quota is used up
+var reserveCodeSendScript = redis.NewScript(`
+local cooldown = redis.call("PTTL", KEYS[1])
+if cooldown > 0 then
+	return {1, cooldown}
+end
+local quota = tonumber(ARGV[2])
+local sent = tonumber(redis.call("GET", KEYS[2]) or "0")
+if quota > 0 and sent >= quota then
+	return {2, redis.call("PTTL", KEYS[2])}
+end
+if quota > 0 then
+	redis.call("INCR", KEYS[2])
+	if sent == 0 then
+		redis.call("PEXPIRE", KEYS[2], ARGV[3])
+	end
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call("SET", KEYS[1], 1, "PX", ARGV[1])
+end
+return {0, 0}
+`)
+
+// keepTokenVersionScript stores the token version unless a newer one is already stored,
+// the ttl is renewed either way
+var keepTokenVersionScript = redis.NewScript(`
+local stored = tonumber(redis.call("GET", KEYS[1]) or "-1")
+local version = tonumber(ARGV[1])
+if stored > version then
+	version = stored
+end
+redis.call("SET", KEYS[1], version, "PX", ARGV[2])
+return version
+`)
+
+// codeSendQuotaWindow is the period of daily_quota, it starts with the first send
+const codeSendQuotaWindow = 24 * time.Hour
+
+// TemporaryStorage keeps codes as HMAC digests, codeHMACKey never leaves the app
 type TemporaryStorage struct {
 	client *redis.Client
 	codeTTL time.Duration
+	codeHMACKey []byte
 }
 
-func NewStorage(client *redis.Client, codeTTL time.Duration) (*TemporaryStorage) {
-	return &TemporaryStorage{client: client, codeTTL: codeTTL}
+func NewStorage(client *redis.Client, codeTTL time.Duration, codeHMACKey []byte) (*TemporaryStorage) {
+	return &TemporaryStorage{client: client, codeTTL: codeTTL, codeHMACKey: codeHMACKey}
 }
 
-func (s *TemporaryStorage) KeepTwoFACode(ctx context.Context, email string, code int) (err error) {
-	key := fmt.Sprintf("2fa_code_key: %s", email)
+func (s *TemporaryStorage) KeepLoginChallenge(ctx context.Context, challenge models.LoginChallenge) (err error) {
+	key := fmt.Sprintf("login_challenge_key: %s", challenge.Id)
 
-	err = s.client.Set(ctx, key, code, s.codeTTL).Err()
+	val, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.Set(ctx, key, val, s.codeTTL).Err()
 	if err != nil {
 		return err
 	}
@@ -30,33 +89,43 @@ func (s *TemporaryStorage) KeepTwoFACode(ctx context.Context, email string, code
 	return nil
 }
 
-func (s *TemporaryStorage) GetTwoFACode(ctx context.Context, email string) (code int, err error) {
-	key := fmt.Sprintf("2fa_code_key: %s", email)
+func (s *TemporaryStorage) GetLoginChallenge(ctx context.Context, challengeId string) (challenge models.LoginChallenge, err error) {
+	key := fmt.Sprintf("login_challenge_key: %s", challengeId)
 
-	val, err := s.client.Get(ctx, key).Result()
+	val, err := s.client.Get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
-			return 0, utils.Err2FACodeNotFound
+			return models.LoginChallenge{}, utils.ErrLoginChallengeNotFound
 		}
-		return 0, err
+		return models.LoginChallenge{}, err
 	}
 
-	if val == "" {
-		return 0, utils.Err2FACodeNotFound
+	if err := json.Unmarshal(val, &challenge); err != nil {
+		return models.LoginChallenge{}, err
 	}
 
-	code, err = strconv.Atoi(val)
+	return challenge, nil
+}
+
+func (s *TemporaryStorage) DeleteLoginChallenge(ctx context.Context, challengeId string) (err error) {
+	key := fmt.Sprintf("login_challenge_key: %s", challengeId)
+
+	deleted, err := s.client.Del(ctx, key).Result()
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	if deleted == 0 {
+		return utils.ErrLoginChallengeNotFound
 	}
 
-	return code, nil
+	return nil
 }
 
-func (s *TemporaryStorage) KeepEmailVerifyCode(ctx context.Context, email string, code int) (err error) {
-	key := fmt.Sprintf("email_verify_key: %s", email)
+func (s *TemporaryStorage) KeepWebAuthnSession(ctx context.Context, challengeId string, session []byte) (err error) {
+	key := fmt.Sprintf("webauthn_session_key: %s", challengeId)
 
-	err = s.client.Set(ctx, key, code, s.codeTTL).Err()
+	err = s.client.Set(ctx, key, session, s.codeTTL).Err()
 	if err != nil {
 		return err
 	}
@@ -64,30 +133,61 @@ func (s *TemporaryStorage) KeepEmailVerifyCode(ctx context.Context, email string
 	return nil
 }
 
-func (s *TemporaryStorage) GetEmailVerifyCode(ctx context.Context, email string) (code int, err error) {
-	key := fmt.Sprintf("email_verify_key: %s", email)
+func (s *TemporaryStorage) TakeWebAuthnSession(ctx context.Context, challengeId string) (session []byte, err error) {
+	key := fmt.Sprintf("webauthn_session_key: %s", challengeId)
 
-	val, err := s.client.Get(ctx, key).Result()
+	session, err = s.client.GetDel(ctx, key).Bytes()
 	if err != nil {
-		return 0, err
+		if err == redis.Nil {
+			return nil, utils.ErrWebAuthnSessionNotFound
+		}
+		return nil, err
 	}
 
-	if val == "" {
-		return 0, utils.ErrEmailVerifyCodeNotFound
+	return session, nil
+}
+
+func (s *TemporaryStorage) KeepTwoFACode(ctx context.Context, challengeId string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeTwoFA, challengeId, code)
+}
+
+func (s *TemporaryStorage) KeepEmailVerifyCode(ctx context.Context, email string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeEmailVerify, email, code)
+}
+
+func (s *TemporaryStorage) KeepPassRecoverCode(ctx context.Context, email string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposePassRecover, email, code)
+}
+
+func (s *TemporaryStorage) KeepRevocation(ctx context.Context, id string, ttl time.Duration) (err error) {
+	key := fmt.Sprintf("revoked_key: %s", id)
+
+	err = s.client.Set(ctx, key, 1, ttl).Err()
+	if err != nil {
+		return err
 	}
 
-	code, err = strconv.Atoi(val)
+	return nil
+}
+
+func (s *TemporaryStorage) IsRevocationCached(ctx context.Context, ids ...string) (revoked bool, err error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("revoked_key: %s", id))
+	}
+
+	found, err := s.client.Exists(ctx, keys...).Result()
 	if err != nil {
-		return 0, err
+		return false, err
 	}
 
-	return code, nil
+	return found > 0, nil
 }
 
-func (s *TemporaryStorage) KeepPassRecoverCode(ctx context.Context, email string, code int) (err error) {
-	key := fmt.Sprintf("pass_recover_key: %s", email)
+func (s *TemporaryStorage) KeepTokenVersion(ctx context.Context, uid int64, version int64, ttl time.Duration) (err error) {
+	key := fmt.Sprintf("token_version_key: %d", uid)
 
-	err = s.client.Set(ctx, key, code, s.codeTTL).Err()
+	err = keepTokenVersionScript.Run(ctx, s.client, []string{key}, version, ttl.Milliseconds()).Err()
 	if err != nil {
 		return err
 	}
@@ -95,22 +195,136 @@ func (s *TemporaryStorage) KeepPassRecoverCode(ctx context.Context, email string
 	return nil
 }
 
-func (s *TemporaryStorage) GetPassRecoverCode(ctx context.Context, email string) (code int, err error) {
-	key := fmt.Sprintf("pass_recover_key: %s", email)
+func (s *TemporaryStorage) GetCachedTokenVersion(ctx context.Context, uid int64) (version int64, found bool, err error) {
+	key := fmt.Sprintf("token_version_key: %d", uid)
+
+	version, err = s.client.Get(ctx, key).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return version, true, nil
+}
+
+func (s *TemporaryStorage) KeepTwoFASettingsCode(ctx context.Context, email string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeTwoFASettings, email, code)
+}
+
+func (s *TemporaryStorage) KeepChangeEmailCode(ctx context.Context, email string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeChangeEmail, email, code)
+}
+
+func (s *TemporaryStorage) KeepConfirmPhoneCode(ctx context.Context, email string, code string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeConfirmPhone, email, code)
+}
+
+func (s *TemporaryStorage) KeepMagicLink(ctx context.Context, tokenId string, token string) (err error) {
+	return s.keepCode(ctx, models.CodePurposeMagicLink, tokenId, token)
+}
+
+func (s *TemporaryStorage) CountFailedCodeAttempt(ctx context.Context, purpose models.CodePurpose, id string) (attempts int64, err error) {
+	key := attemptsKey(purpose, id)
 
-	val, err := s.client.Get(ctx, key).Result()
+	var incr *redis.IntCmd
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireNX(ctx, key, s.codeTTL)
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	if val == "" {
-		return 0, utils.ErrPassRecoverCodeNotFound
+	return incr.Val(), nil
+}
+
+func (s *TemporaryStorage) ReserveCodeSend(ctx context.Context, purpose models.CodePurpose, recipient string, cooldown time.Duration, dailyQuota int) (retryAfter time.Duration, err error) {
+	keys := []string{
+		fmt.Sprintf("%s_send_cooldown_key: %s", purpose, recipient),
+		fmt.Sprintf("%s_send_quota_key: %s", purpose, recipient),
 	}
 
-	code, err = strconv.Atoi(val)
+	res, err := reserveCodeSendScript.Run(ctx, s.client, keys, cooldown.Milliseconds(), dailyQuota, codeSendQuotaWindow.Milliseconds()).Int64Slice()
 	if err != nil {
 		return 0, err
 	}
 
-	return code, nil
-}
\ No newline at end of file
+	retryAfter = time.Duration(res[1]) * time.Millisecond
+
+	switch res[0] {
+	case 1:
+		return retryAfter, utils.ErrCodeSendCooldown
+	case 2:
+		return retryAfter, utils.ErrCodeSendQuotaExceeded
+	}
+
+	return 0, nil
+}
+
+func (s *TemporaryStorage) ConsumeCode(ctx context.Context, purpose models.CodePurpose, id string, code string) (err error) {
+	key := codeKey(purpose, id)
+
+	kept, err := s.client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return utils.ErrCodeNotFound
+		}
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(kept), []byte(s.codeDigest(purpose, id, code))) != 1 {
+		return utils.ErrWrongCode
+	}
+
+	// a concurrent consumer or a newly sent code wins, the digest is gone or changed then
+	deleted, err := deleteCodeScript.Run(ctx, s.client, []string{key, attemptsKey(purpose, id)}, kept).Int()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return utils.ErrCodeNotFound
+	}
+
+	return nil
+}
+
+func (s *TemporaryStorage) DropCode(ctx context.Context, purpose models.CodePurpose, id string) (err error) {
+	err = s.client.Del(ctx, codeKey(purpose, id)).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// keepCode stores digest of a new code of the purpose, failed attempts of the previous code are forgotten
+func (s *TemporaryStorage) keepCode(ctx context.Context, purpose models.CodePurpose, id string, code string) (err error) {
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, codeKey(purpose, id), s.codeDigest(purpose, id, code), s.codeTTL)
+		pipe.Del(ctx, attemptsKey(purpose, id))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// codeDigest binds the code to its purpose and id, a digest copied under another key doesn't match
+func (s *TemporaryStorage) codeDigest(purpose models.CodePurpose, id string, code string) string {
+	return utils_hash.HMACSHA256(s.codeHMACKey, fmt.Sprintf("%s\x00%s\x00%s", purpose, id, code))
+}
+
+func codeKey(purpose models.CodePurpose, id string) string {
+	return fmt.Sprintf("%s_key: %s", purpose, id)
+}
+
+func attemptsKey(purpose models.CodePurpose, id string) string {
+	return fmt.Sprintf("%s_attempts_key: %s", purpose, id)
+}
@@ -0,0 +1,155 @@
+package utils_client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// DeviceTrustHeader is the request metadata key with the trust token of a remembered device
+const DeviceTrustHeader = "device-trust"
+
+// ForwardedForHeader is the request metadata key proxies append the address of the previous hop to
+const ForwardedForHeader = "x-forwarded-for"
+
+// MaxUserAgentLength is the size of user_agent columns, longer user agents are cut to it
+const MaxUserAgentLength = 512
+
+var ErrInvalidTrustedProxy = errors.New("invalid trusted proxy, CIDR or ip address expected")
+
+type clientIPKey struct{}
+
+// TrustedProxies are networks of proxies (load balancers) in front of the service,
+// the client ip of calls coming from them is taken from x-forwarded-for
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies accepts CIDRs and single addresses
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	trustedProxies := make(TrustedProxies, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			trustedProxies = append(trustedProxies, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, ErrInvalidTrustedProxy
+		}
+		trustedProxies = append(trustedProxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return trustedProxies, nil
+}
+
+// ClientIP walks x-forwarded-for from the right while the hops are trusted proxies, the first
+// other address is the client. Calls not coming from a trusted proxy get their peer address
+func (p TrustedProxies) ClientIP(ctx context.Context) string {
+	ip := peerIP(ctx)
+	if !p.contains(ip) {
+		return ip
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ip
+	}
+
+	var hops []string
+	for _, value := range md.Get(ForwardedForHeader) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// the rest of the header can't be trusted, the last trusted hop is all we know
+			return ip
+		}
+
+		ip = addr.Unmap().String()
+		if !p.contains(ip) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+// UnaryServerInterceptor puts the client ip resolved by ClientIP into the call context, FromContext returns it
+func (p TrustedProxies) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if len(p) == 0 {
+			return handler(ctx, req)
+		}
+
+		return handler(context.WithValue(ctx, clientIPKey{}, p.ClientIP(ctx)), req)
+	}
+}
+
+func (p TrustedProxies) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FromContext returns ip and user agent of the gRPC client, empty strings if they are unknown.
+// The ip is the one resolved by TrustedProxies interceptor, the peer address without it.
+// The user agent is cut to MaxUserAgentLength characters, so it always fits the storage
+func FromContext(ctx context.Context) (ip string, userAgent string) {
+	ip, ok := ctx.Value(clientIPKey{}).(string)
+	if !ok {
+		ip = peerIP(ctx)
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			userAgent = values[0]
+		}
+	}
+
+	if runes := []rune(userAgent); len(runes) > MaxUserAgentLength {
+		userAgent = string(runes[:MaxUserAgentLength])
+	}
+
+	return ip, userAgent
+}
+
+// DeviceTrustToken returns trust token the gRPC client sent, empty string if there is none
+func DeviceTrustToken(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(DeviceTrustHeader); len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+func peerIP(ctx context.Context) (ip string) {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+
+	return ip
+}
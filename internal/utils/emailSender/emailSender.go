@@ -1,10 +1,11 @@
 package emailsender
 
 import (
+	"authSAS/internal/models"
 	"authSAS/internal/utils"
+	"context"
 	"log/slog"
 	"net/smtp"
-	"strconv"
 )
 
 type EmailSender struct {
@@ -21,16 +22,29 @@ func NewEmailSender(logger *slog.Logger, email string, password string)  *EmailS
 	}
 }
 
+// DeliverCode makes EmailSender the email channel of code delivery
+func (s *EmailSender) DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) error {
+	if message.Code == "" {
+		s.logger.Debug("Email sender error", "email", user.Email, "err", "Inavlid credentials")
+		return utils.ErrInvalidCredentials
+	}
 
+	return s.send(user.Email, message.Text())
+}
+
+// NotifySecurityEvent makes EmailSender the security notifier
+func (s *EmailSender) NotifySecurityEvent(ctx context.Context, user models.User, notice models.SecurityNotice) error {
+	return s.send(user.Email, notice.Text())
+}
 
-func (s *EmailSender) SendEmail(userEmail string, code int) error {
+func (s *EmailSender) send(userEmail string, text string) error {
 
 	if s.email == "" || s.password == "" {
 		s.logger.Debug("Email sender error", "err", "Inavlid config")
 		return utils.ErrInternalServer
 	}
 
-	if userEmail == "" || code == 0 {
+	if userEmail == "" {
 		s.logger.Debug("Email sender error", "email", userEmail, "err", "Inavlid credentials")
 		return utils.ErrInvalidCredentials
 	}
@@ -38,7 +52,7 @@ func (s *EmailSender) SendEmail(userEmail string, code int) error {
 	to := userEmail
 	from := s.email
 	mesage := []byte("Hello from MyApp!\r\n"+
-					"Here is your code: "+strconv.Itoa(code))
+					text)
 
 	addr := "smtp.yandex.ru:587"
 	host := "smtp.yandex.ru"
@@ -1,6 +1,9 @@
 package utils
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrInternalServer = errors.New("internal server error")
@@ -12,15 +15,60 @@ var (
 	ErrEmptyJWT = errors.New("token is required")
 
 	ErrJWTAlreadyAdded = errors.New("jwt already added")
+	ErrJWTRevoked = errors.New("jwt revoked")
 	ErrUserAlreadyExists = errors.New("user already exists")
 	ErrUserEmailAlreadyVerified = errors.New("user's email already verified")
+	ErrEmailNotChanged = errors.New("new email is the current one")
+	ErrTwoFAAlreadyEnabled = errors.New("2 factor auth already enabled")
+	ErrTwoFANotEnabled = errors.New("2 factor auth not enabled")
 
 	ErrUserNotFound = errors.New("user not found")
-	Err2FACodeNotFound = errors.New("2 factor auth code not found in temp. storage")
-	ErrEmailVerifyCodeNotFound = errors.New("email verify code not found in temp. storage")
-	ErrPassRecoverCodeNotFound = errors.New("password recover code not found in temp. storage")
+	ErrLoginChallengeNotFound = errors.New("login challenge not found in temp. storage")
+	ErrCodeNotFound = errors.New("code not found in temp. storage")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrSessionNotFound = errors.New("session not found")
+	ErrTrustedDeviceNotFound = errors.New("trusted device not found")
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+	ErrPasskeyNotFound = errors.New("user has no passkeys")
+	ErrWebAuthnSessionNotFound = errors.New("webauthn challenge not found in temp. storage")
+
+	ErrRefreshTokenReused = errors.New("refresh token already used")
+	ErrRefreshTokenRevoked = errors.New("refresh token revoked")
+
+	ErrTOTPDisabled = errors.New("totp is not configured")
+	ErrWebAuthnDisabled = errors.New("webauthn is not configured")
+	ErrMagicLinkDisabled = errors.New("magic link is not configured")
+	ErrSMSDisabled = errors.New("sms is not configured")
+	ErrMagicLinkUsed = errors.New("magic link already used or expired")
+	ErrInvalidPhone = errors.New("phone must be in E.164 format")
+	ErrUnknownDeliveryChannel = errors.New("unknown code delivery channel")
+	ErrPhoneRequired = errors.New("phone is required by the channel")
+	ErrPhoneNotChanged = errors.New("new phone is the current one")
+	ErrWebAuthnCredentialAlreadyExists = errors.New("webauthn credential already exists")
+	ErrTOTPNotEnrolled = errors.New("totp is not enrolled")
+	ErrTOTPAlreadyEnabled = errors.New("totp already enabled")
+	ErrTOTPCodeReused = errors.New("totp code already used")
+	ErrRecoveryCodeUsed = errors.New("recovery code already used")
+	ErrLoginChallengeClientMismatch = errors.New("login challenge belongs to another client")
+	ErrTooManyCodeAttempts = errors.New("too many wrong code attempts, request a new code")
+	ErrCodeSendCooldown = errors.New("code was sent recently, wait before requesting another one")
+	ErrCodeSendQuotaExceeded = errors.New("daily quota of sent codes exceeded")
 
 	ErrWrong2FACode = errors.New("wrong 2 factor auth code")
+	ErrWrongCode = errors.New("wrong code")
 	ErrWrongVerificationCode = errors.New("wrong email verification code")
 	ErrWrongPasswordRecoverCode = errors.New("wrong password recover code")
-)
\ No newline at end of file
+)
+// RetryAfterError is a limit error (ErrCodeSendCooldown etc.) with the time left until the call is allowed again
+type RetryAfterError struct {
+	Err error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
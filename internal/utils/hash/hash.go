@@ -0,0 +1,34 @@
+package utils_hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+var ErrInvalidHMACKey = errors.New("hmac key must be base64 encoded, at least 32 bytes")
+
+// SHA256 returns hex encoded sha256 digest of the value
+func SHA256(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// DecodeHMACKey decodes base64 key of keyed digests
+func DecodeHMACKey(key string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) < 32 {
+		return nil, ErrInvalidHMACKey
+	}
+
+	return raw, nil
+}
+
+// HMACSHA256 returns hex encoded keyed digest of the value, without the key digests of short codes can't be brute forced
+func HMACSHA256(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
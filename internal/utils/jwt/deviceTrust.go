@@ -0,0 +1,63 @@
+package utils_jwt
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const deviceTrustPurpose = "device_trust"
+
+// DeviceTrustClaims of remembered device token, jti is id of the trusted device record. Its typ and aud
+// are its own, so it is never taken for an access token
+type DeviceTrustClaims struct {
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// NewDeviceTrustToken creates trust token of the user's device
+func NewDeviceTrustToken(uid int64, deviceId string, duration time.Duration, key *Key, opts Options) (string, error) {
+	now := time.Now()
+	opts = opts.forKind(deviceTrustPurpose)
+
+	claims := DeviceTrustClaims{
+		Purpose: deviceTrustPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: opts.Issuer,
+			Subject: strconv.FormatInt(uid, 10),
+			Audience: opts.Audience,
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt: jwt.NewNumericDate(now),
+			ID: deviceId,
+		},
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	token.Header["typ"] = deviceTrustTokenType
+
+	return token.SignedString(key.signKey)
+}
+
+// ParseDeviceTrustToken checks the token like ParseToken does and returns uid and device id,
+// tokens of other kinds are not accepted
+func ParseDeviceTrustToken(tokenString string, keyRing *KeyRing, opts Options) (uid int64, deviceId string, err error) {
+	claims := &DeviceTrustClaims{}
+
+	if err := parseWithClaims(tokenString, claims, keyRing, opts.forKind(deviceTrustPurpose), deviceTrustTokenType); err != nil {
+		return 0, "", err
+	}
+
+	if claims.Purpose != deviceTrustPurpose || claims.ID == "" {
+		return 0, "", jwt.ErrTokenInvalidClaims
+	}
+
+	uid, err = strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, "", jwt.ErrTokenInvalidClaims
+	}
+
+	return uid, claims.ID, nil
+}
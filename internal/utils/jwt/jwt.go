@@ -2,24 +2,150 @@ package utils_jwt
 
 import (
 	"authSAS/internal/models"
+	utils_random "authSAS/internal/utils/randomCode"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func NewToken(user models.User, duration time.Duration, secret string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+// Claims of access token, registered claims follow RFC 7519 (sub is uid, jti is unique per token)
+type Claims struct {
+	UID          int64  `json:"uid"`
+	Email        string `json:"email"`
+	IsAdmin      bool   `json:"is_admin"`
+	SessionId    string `json:"sid"`
+	TokenVersion int64  `json:"ver"`
+	jwt.RegisteredClaims
+}
 
-	claims := token.Claims.(jwt.MapClaims)
-	claims["uid"] = user.Id
-	claims["email"] = user.Email
-	claims["is_admin"] = user.IsAdmin
-	claims["exp"] = time.Now().Add(duration).Unix()
+// Tokens of every kind are signed by the same keys, so each kind has its own typ header and
+// parsing accepts only the expected one. Kinds other than access tokens also get their own aud:
+// resource servers check aud of access tokens and never take a link or device token for one
+const (
+	accessTokenType = "JWT"
+	magicLinkTokenType = "magic-link+jwt"
+	deviceTrustTokenType = "device-trust+jwt"
+)
+
+// Options are issuer and audiences put into issued tokens and enforced while parsing,
+// Leeway is allowed clock skew for exp, nbf and iat
+type Options struct {
+	Issuer   string
+	Audience []string
+	Leeway   time.Duration
+}
+
+// forKind replaces audiences with the one of tokens of the kind, only authSAS (issuer) accepts them
+func (opts Options) forKind(purpose string) Options {
+	opts.Audience = []string{opts.Issuer + "/" + purpose}
+	return opts
+}
+
+// NewToken creates token of the session, every token gets unique jti
+func NewToken(user models.User, sessionId string, duration time.Duration, key *Key, opts Options) (string, error) {
+	jti, err := utils_random.RandToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	claims := Claims{
+		UID: user.Id,
+		Email: user.Email,
+		IsAdmin: user.IsAdmin,
+		SessionId: sessionId,
+		TokenVersion: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: opts.Issuer,
+			Subject: strconv.FormatInt(user.Id, 10),
+			Audience: opts.Audience,
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt: jwt.NewNumericDate(now),
+			ID: jti,
+		},
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
 
-	tokenString, err := token.SignedString([]byte(secret))
+	tokenString, err := token.SignedString(key.signKey)
 	if err != nil {
 		return "", err
 	}
 
 	return tokenString, nil
-}
\ No newline at end of file
+}
+
+// ParseToken checks the signature (key is chosen by kid), exp, nbf, iss and aud of the token and returns its claims
+func ParseToken(tokenString string, keyRing *KeyRing, opts Options) (*Claims, error) {
+	claims := &Claims{}
+
+	if err := parseWithClaims(tokenString, claims, keyRing, opts, accessTokenType); err != nil {
+		return nil, err
+	}
+
+	if claims.Subject != strconv.FormatInt(claims.UID, 10) || claims.ID == "" || claims.SessionId == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// parseWithClaims checks the typ header, the signature (key is chosen by kid), exp, nbf, iss and aud of the token and fills claims
+func parseWithClaims(tokenString string, claims jwt.Claims, keyRing *KeyRing, opts Options, tokenType string) error {
+	parserOptions := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+
+	if opts.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(opts.Issuer))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		// token of another kind
+		if typ, _ := token.Header["typ"].(string); !strings.EqualFold(typ, tokenType) {
+			return nil, jwt.ErrTokenInvalidClaims
+		}
+
+		kid, _ := token.Header["kid"].(string)
+
+		key, ok := keyRing.Get(kid)
+		if !ok {
+			return nil, jwt.ErrTokenUnverifiable
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+
+		return key.verifyKey, nil
+	}, parserOptions...)
+	if err != nil {
+		return err
+	}
+
+	if !token.Valid {
+		return jwt.ErrTokenInvalidClaims
+	}
+
+	audience, err := claims.GetAudience()
+	if err != nil {
+		return err
+	}
+
+	// token must be meant for at least one of allowed audiences
+	if len(opts.Audience) > 0 && !slices.ContainsFunc(audience, func(aud string) bool {
+		return slices.Contains(opts.Audience, aud)
+	}) {
+		return jwt.ErrTokenInvalidAudience
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package utils_jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported jwt signing algorithm")
+
+type Key struct {
+	Kid string
+	Method jwt.SigningMethod
+	signKey any
+	verifyKey any
+}
+
+// NewHMACKey creates HS256 key from shared secret, such keys are never published in JWKS
+func NewHMACKey(kid string, secret string) (*Key, error) {
+	if kid == "" {
+		return nil, errors.New("jwt key requires kid")
+	}
+
+	if secret == "" {
+		return nil, errors.New("HS256 key requires jwt secret")
+	}
+
+	return &Key{
+		Kid: kid,
+		Method: jwt.SigningMethodHS256,
+		signKey: []byte(secret),
+		verifyKey: []byte(secret),
+	}, nil
+}
+
+// LoadKey creates key of the algorithm (HS256, RS256, ES256, EdDSA),
+// asymmetric keys are read from PEM encoded private key file
+func LoadKey(kid string, algorithm string, privateKeyPath string, secret string) (*Key, error) {
+	if algorithm == jwt.SigningMethodHS256.Alg() {
+		return NewHMACKey(kid, secret)
+	}
+
+	if kid == "" {
+		return nil, errors.New("jwt key requires kid")
+	}
+
+	pemData, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key of %q: %w", kid, err)
+	}
+
+	var private crypto.Signer
+	var method jwt.SigningMethod
+
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = jwt.ParseRSAPrivateKeyFromPEM(pemData)
+		method = jwt.SigningMethodRS256
+	case jwt.SigningMethodES256.Alg():
+		var ecKey *ecdsa.PrivateKey
+		ecKey, err = jwt.ParseECPrivateKeyFromPEM(pemData)
+		if err == nil && ecKey.Curve != elliptic.P256() {
+			err = errors.New("ES256 requires P-256 key")
+		}
+		private = ecKey
+		method = jwt.SigningMethodES256
+	case jwt.SigningMethodEdDSA.Alg():
+		var edKey crypto.PrivateKey
+		edKey, err = jwt.ParseEdPrivateKeyFromPEM(pemData)
+		if err == nil {
+			private = edKey.(ed25519.PrivateKey)
+		}
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parse private key of %q: %w", kid, err)
+	}
+
+	return &Key{
+		Kid: kid,
+		Method: method,
+		signKey: private,
+		verifyKey: private.Public(),
+	}, nil
+}
+
+// KeySpec describes one key of the ring, empty Algorithm is HS256 and empty Secret is the secret of the ring
+type KeySpec struct {
+	Kid string
+	Algorithm string
+	PrivateKeyPath string
+	Secret string
+}
+
+type KeyRing struct {
+	active *Key
+	keys map[string]*Key
+}
+
+// NewKeyRing creates ring which signs tokens with the key of activeKid, other keys only verify
+func NewKeyRing(activeKid string, keys ...*Key) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string]*Key, len(keys))}
+
+	for _, key := range keys {
+		if _, ok := ring.keys[key.Kid]; ok {
+			return nil, fmt.Errorf("duplicate jwt key %q", key.Kid)
+		}
+		ring.keys[key.Kid] = key
+	}
+
+	active, ok := ring.keys[activeKid]
+	if !ok {
+		return nil, fmt.Errorf("active jwt key %q not found", activeKid)
+	}
+	ring.active = active
+
+	return ring, nil
+}
+
+// LoadKeyRing creates ring of the specs signing with the key of activeKid, without specs
+// the ring holds single HS256 key of secret
+func LoadKeyRing(activeKid string, specs []KeySpec, secret string) (*KeyRing, error) {
+	if len(specs) == 0 {
+		key, err := NewHMACKey(activeKid, secret)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyRing(activeKid, key)
+	}
+
+	keys := make([]*Key, 0, len(specs))
+
+	for _, spec := range specs {
+		keySecret := spec.Secret
+		if keySecret == "" {
+			keySecret = secret
+		}
+
+		algorithm := spec.Algorithm
+		if algorithm == "" {
+			algorithm = jwt.SigningMethodHS256.Alg()
+		}
+
+		key, err := LoadKey(spec.Kid, algorithm, spec.PrivateKeyPath, keySecret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeyRing(activeKid, keys...)
+}
+
+func (r *KeyRing) Active() *Key {
+	return r.active
+}
+
+// Get returns key by kid, tokens without kid are checked with the active key
+func (r *KeyRing) Get(kid string) (*Key, bool) {
+	if kid == "" {
+		return r.active, true
+	}
+
+	key, ok := r.keys[kid]
+	return key, ok
+}
+
+// JWK is a public key in RFC 7517 format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns public part of every asymmetric key of the ring, retired keys included,
+// so verifiers can check tokens issued before rotation
+func (r *KeyRing) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, key := range r.keys {
+		jwk, ok := key.jwk()
+		if ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+
+	return jwks
+}
+
+func (k *Key) jwk() (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	jwk := JWK{Use: "sig", Alg: k.Method.Alg(), Kid: k.Kid}
+
+	switch public := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = public.Curve.Params().Name
+		jwk.X = encode(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = encode(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(public)
+	default:
+		return JWK{}, false
+	}
+
+	return jwk, true
+}
@@ -0,0 +1,74 @@
+package utils_jwt
+
+import (
+	"authSAS/internal/models"
+	utils_random "authSAS/internal/utils/randomCode"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const magicLinkPurpose = "magic_link"
+
+// MagicLinkClaims of passwordless login link token, its typ and aud are its own, so it is never taken for an access token
+type MagicLinkClaims struct {
+	Email   string `json:"email"`
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// NewMagicLinkToken creates link token of the user, jti makes it single-use
+func NewMagicLinkToken(user models.User, duration time.Duration, key *Key, opts Options) (tokenString string, jti string, err error) {
+	jti, err = utils_random.RandToken(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	opts = opts.forKind(magicLinkPurpose)
+
+	claims := MagicLinkClaims{
+		Email: user.Email,
+		Purpose: magicLinkPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: opts.Issuer,
+			Subject: strconv.FormatInt(user.Id, 10),
+			Audience: opts.Audience,
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt: jwt.NewNumericDate(now),
+			ID: jti,
+		},
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	token.Header["typ"] = magicLinkTokenType
+
+	tokenString, err = token.SignedString(key.signKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return tokenString, jti, nil
+}
+
+// ParseMagicLinkToken checks the token like ParseToken does, tokens of other kinds are not accepted
+func ParseMagicLinkToken(tokenString string, keyRing *KeyRing, opts Options) (*MagicLinkClaims, error) {
+	claims := &MagicLinkClaims{}
+
+	if err := parseWithClaims(tokenString, claims, keyRing, opts.forKind(magicLinkPurpose), magicLinkTokenType); err != nil {
+		return nil, err
+	}
+
+	if claims.Purpose != magicLinkPurpose || claims.ID == "" || claims.Email == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	if _, err := strconv.ParseInt(claims.Subject, 10, 64); err != nil {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,101 @@
+package utils_random
+
+import (
+	cryptoRand "crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	AlphabetNumeric = "numeric"
+	AlphabetAlphanumeric = "alphanumeric"
+)
+
+// alphanumeric codes leave out 0, O, 1 and I, they are easy to mistype
+const (
+	numericChars = "0123456789"
+	alphanumericChars = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+)
+
+// OTPSeparator splits groups of a formatted code, NormalizeOTP drops it
+const OTPSeparator = "-"
+
+var ErrInvalidOTPFormat = errors.New("invalid one-time code format")
+
+// OTPFormat of emailed one-time codes. GroupSize > 0 splits the code shown to the user
+// into groups (123-456), the kept code has no separators
+type OTPFormat struct {
+	Length int
+	Alphabet string
+	GroupSize int
+}
+
+// Validate checks the format. Numeric codes are at most 9 digits, so they still fit int32 code fields of the proto
+func (f OTPFormat) Validate() error {
+	switch {
+	case f.Alphabet != AlphabetNumeric && f.Alphabet != AlphabetAlphanumeric:
+		return ErrInvalidOTPFormat
+	case f.Length < 4 || f.Length > 32:
+		return ErrInvalidOTPFormat
+	case f.Alphabet == AlphabetNumeric && f.Length > 9:
+		return ErrInvalidOTPFormat
+	case f.GroupSize < 0:
+		return ErrInvalidOTPFormat
+	}
+
+	return nil
+}
+
+// NewOTP returns a code from crypto/rand: the kept one and the formatted one for the user.
+// Numeric codes never start with 0, int32 proto fields would lose it
+func NewOTP(f OTPFormat) (code string, formatted string, err error) {
+	if err := f.Validate(); err != nil {
+		return "", "", err
+	}
+
+	chars := numericChars
+	if f.Alphabet == AlphabetAlphanumeric {
+		chars = alphanumericChars
+	}
+
+	buf := make([]byte, f.Length)
+
+	for i := range buf {
+		from := chars
+		if i == 0 && f.Alphabet == AlphabetNumeric {
+			from = chars[1:]
+		}
+
+		n, err := cryptoRand.Int(cryptoRand.Reader, big.NewInt(int64(len(from))))
+		if err != nil {
+			return "", "", err
+		}
+
+		buf[i] = from[n.Int64()]
+	}
+
+	code = string(buf)
+
+	return code, formatOTP(code, f.GroupSize), nil
+}
+
+// NormalizeOTP turns the code typed by the user into the kept form: no separators or spaces, upper case
+func NormalizeOTP(code string) string {
+	return strings.ToUpper(strings.NewReplacer(OTPSeparator, "", " ", "").Replace(code))
+}
+
+func formatOTP(code string, groupSize int) string {
+	if groupSize <= 0 || groupSize >= len(code) {
+		return code
+	}
+
+	groups := make([]string, 0, len(code) / groupSize + 1)
+	for len(code) > groupSize {
+		groups = append(groups, code[:groupSize])
+		code = code[groupSize:]
+	}
+	groups = append(groups, code)
+
+	return strings.Join(groups, OTPSeparator)
+}
@@ -1,7 +1,28 @@
 package utils_random
 
-import "math/rand/v2"
+import (
+	cryptoRand "crypto/rand"
+	"encoding/base64"
+	"math/big"
+)
 
-func RandRange(min, max int) int {
-    return rand.IntN(max-min) + min
-}
\ No newline at end of file
+// RandSecureRange returns number from [min, max) made by crypto/rand
+func RandSecureRange(min, max int) (int, error) {
+	n, err := cryptoRand.Int(cryptoRand.Reader, big.NewInt(int64(max-min)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()) + min, nil
+}
+
+// RandToken returns url-safe string made from size random bytes
+func RandToken(size int) (string, error) {
+	buf := make([]byte, size)
+
+	if _, err := cryptoRand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,65 @@
+package utils_secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrInvalidKey = errors.New("secret box key must be base64 encoded 32 bytes")
+var ErrMalformedCiphertext = errors.New("malformed ciphertext")
+
+// SecretBox encrypts small secrets (TOTP secrets etc.) before they are stored, AES-256-GCM
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates box from base64 encoded 32 byte key
+func NewSecretBox(key string) (*SecretBox, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal returns base64 of nonce and ciphertext, additionalData binds it to its owner (user id etc.)
+func (b *SecretBox) Seal(plaintext string, additionalData string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(additionalData))
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b *SecretBox) Open(ciphertext string, additionalData string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", ErrMalformedCiphertext
+	}
+
+	nonce, sealed := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+
+	plaintext, err := b.aead.Open(nil, nonce, sealed, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,74 @@
+package smssender
+
+import (
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SMSSender is an adapter of generic HTTP SMS providers: POST url with JSON {"from", "to", "text"}
+// and the bearer token, any 2xx answer means the message is accepted
+type SMSSender struct {
+	logger *slog.Logger
+	client *http.Client
+	url string
+	token string
+	from string
+}
+
+func NewSMSSender(logger *slog.Logger, url string, token string, from string, timeout time.Duration) *SMSSender {
+	return &SMSSender{
+		logger: logger,
+		client: &http.Client{Timeout: timeout},
+		url: url,
+		token: token,
+		from: from,
+	}
+}
+
+type smsRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// DeliverCode makes SMSSender the SMS channel of code delivery
+func (s *SMSSender) DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) error {
+	if user.Phone == "" {
+		return utils.ErrPhoneRequired
+	}
+
+	body, err := json.Marshal(smsRequest{From: s.from, To: user.Phone, Text: message.Text()})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.logger.Debug("Send SMS code error", "uid", user.Id, "err", err.Error())
+		return utils.ErrInternalServer
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		s.logger.Debug("Send SMS code error", "uid", user.Id, "err", fmt.Sprintf("provider answered %d", resp.StatusCode))
+		return utils.ErrInternalServer
+	}
+
+	return nil
+}
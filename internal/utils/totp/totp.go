@@ -0,0 +1,103 @@
+package utils_totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// RFC 6238 parameters supported by every authenticator app: SHA1, 6 digits, 30s step
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns base32 (no padding) encoded 160 bit secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// URI is otpauth:// key URI understood by authenticator apps
+func URI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", "6")
+	query.Set("period", "30")
+
+	u := url.URL{
+		Scheme: "otpauth",
+		Host: "totp",
+		Path: "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// QRCode is PNG image of the uri
+func QRCode(uri string) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, 256)
+}
+
+// Step is the time step number of t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code is the code of the time step, zero-padded to Digits like the apps show it
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation (RFC 4226 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value % 1000000), nil
+}
+
+// Validate checks code against steps of t within ±window and returns the matched step
+func Validate(secret string, code string, t time.Time, window int64) (step int64, ok bool, err error) {
+	current := Step(t)
+
+	for step := current - window; step <= current + window; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,79 @@
+package webhooksender
+
+import (
+	"authSAS/internal/models"
+	"authSAS/internal/utils"
+	utils_hash "authSAS/internal/utils/hash"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader carries "sha256=" and hex HMAC-SHA256 of the request body keyed by the shared secret
+const SignatureHeader = "X-Signature"
+
+// WebhookSender posts codes to an outbound webhook, a chat bot behind it sends them to the user
+type WebhookSender struct {
+	logger *slog.Logger
+	client *http.Client
+	url string
+	secret []byte
+}
+
+func NewWebhookSender(logger *slog.Logger, url string, secret string, timeout time.Duration) *WebhookSender {
+	return &WebhookSender{
+		logger: logger,
+		client: &http.Client{Timeout: timeout},
+		url: url,
+		secret: []byte(secret),
+	}
+}
+
+type webhookRequest struct {
+	UserId  int64  `json:"user_id"`
+	Email   string `json:"email"`
+	Phone   string `json:"phone,omitempty"`
+	Purpose string `json:"purpose"`
+	Code    string `json:"code"`
+	Text    string `json:"text"`
+}
+
+// DeliverCode makes WebhookSender the webhook channel of code delivery
+func (s *WebhookSender) DeliverCode(ctx context.Context, user models.User, message models.CodeMessage) error {
+	body, err := json.Marshal(webhookRequest{
+		UserId: user.Id,
+		Email: user.Email,
+		Phone: user.Phone,
+		Purpose: string(message.Purpose),
+		Code: message.Code,
+		Text: message.Text(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+utils_hash.HMACSHA256(s.secret, string(body)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.logger.Debug("Send webhook code error", "uid", user.Id, "err", err.Error())
+		return utils.ErrInternalServer
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		s.logger.Debug("Send webhook code error", "uid", user.Id, "err", fmt.Sprintf("webhook answered %d", resp.StatusCode))
+		return utils.ErrInternalServer
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    family_id VARCHAR(64) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    is_used BOOLEAN NOT NULL DEFAULT false,
+    is_revoked BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
@@ -0,0 +1,14 @@
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    issued_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    client_ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    is_revoked BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- refresh token family is the session now, older families have no session row
+UPDATE refresh_tokens SET is_revoked = true;
@@ -0,0 +1,7 @@
+TRUNCATE bad_jwts;
+
+DROP INDEX bad_jwts_expires_at_idx;
+
+ALTER TABLE bad_jwts DROP COLUMN expires_at;
+ALTER TABLE bad_jwts DROP COLUMN jti;
+ALTER TABLE bad_jwts ADD COLUMN token VARCHAR(255) NOT NULL UNIQUE;
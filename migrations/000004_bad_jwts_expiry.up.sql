@@ -0,0 +1,9 @@
+-- tokens are blacklisted by jti now, old rows belong to tokens without jti
+-- which are rejected anyway
+TRUNCATE bad_jwts;
+
+ALTER TABLE bad_jwts DROP COLUMN token;
+ALTER TABLE bad_jwts ADD COLUMN jti VARCHAR(64) NOT NULL UNIQUE;
+ALTER TABLE bad_jwts ADD COLUMN expires_at TIMESTAMPTZ NOT NULL;
+
+CREATE INDEX bad_jwts_expires_at_idx ON bad_jwts (expires_at);
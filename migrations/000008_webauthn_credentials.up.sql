@@ -0,0 +1,15 @@
+CREATE TABLE webauthn_credentials (
+    id BYTEA PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL DEFAULT '',
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    aaguid BYTEA NOT NULL DEFAULT '',
+    backup_eligible BOOLEAN NOT NULL DEFAULT false,
+    backup_state BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN preferred_channel;
+ALTER TABLE users DROP COLUMN phone;
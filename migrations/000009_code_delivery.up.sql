@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN phone TEXT;
+ALTER TABLE users ADD COLUMN preferred_channel TEXT NOT NULL DEFAULT 'email';
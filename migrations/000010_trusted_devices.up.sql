@@ -0,0 +1,13 @@
+CREATE TABLE trusted_devices (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    token_version INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    client_ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    is_revoked BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX trusted_devices_user_id_idx ON trusted_devices (user_id);